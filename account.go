@@ -0,0 +1,142 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+// stravaDeauthorizeURL is where access to an athlete's Strava data is given
+// up. Tests point it at a local server.
+var stravaDeauthorizeURL = "https://www.strava.com/oauth/deauthorize"
+
+// AuditEntry records something done to a member's account.
+type AuditEntry struct {
+	Time      time.Time `json:"time"`
+	AthleteID int64     `json:"athlete_id"`
+	Name      string    `json:"name"`
+
+	// What was done, like "disconnect".
+	Action string `json:"action"`
+
+	// Who did it: "member" for the member themselves, or "admin".
+	By string `json:"by"`
+}
+
+// Deauthorize asks Strava to stop sharing an athlete's data with us, using
+// the access token from ts. Strava having already stopped accepting the
+// token counts as success.
+func Deauthorize(ctx context.Context, client *http.Client, ts oauth2.TokenSource) error {
+	tok, err := ts.Token()
+	if IsAuthError(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	form := url.Values{"access_token": {tok.AccessToken}}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, stravaDeauthorizeURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusUnauthorized {
+		return nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("deauthorizing on Strava: %s", resp.Status)
+	}
+	return nil
+}
+
+// DisconnectUser removes a member from the group: Strava is told to stop
+// sharing their data, everything kept about them is deleted, and an audit
+// entry saying who did it is added. by is as for AuditEntry. Deauthorising
+// uses client, and tokens are refreshed with the HTTP client from ctx as
+// described by oauth2.HTTPClient.
+func DisconnectUser(ctx context.Context, store Store, client *http.Client, id int64, by string, now time.Time) error {
+	u, err := store.GetUser(ctx, id)
+	if err != nil {
+		return err
+	}
+	if u.Connected() {
+		if err := Deauthorize(ctx, client, UserTokenSource(ctx, store, u)); err != nil {
+			return err
+		}
+	}
+	name := strings.TrimSpace(u.FirstName + " " + u.LastName)
+	err = store.AddAuditEntry(ctx, &AuditEntry{Time: now, AthleteID: id, Name: name, Action: "disconnect", By: by})
+	if err != nil {
+		return err
+	}
+	return store.DeleteUser(ctx, id)
+}
+
+// clearRejectedToken disconnects the user after Strava has rejected their
+// token, keeping their activities until they reconnect. It says whether the
+// token was cleared, which it isn't if they've connected again since.
+func clearRejectedToken(ctx context.Context, users UserStore, u *User) (bool, error) {
+	rejected, cleared := u.StravaToken, false
+	_, err := users.UpdateUser(ctx, u.ID, func(stored *User) error {
+		cleared = stored.StravaToken == rejected
+		if cleared {
+			stored.setToken(&oauth2.Token{})
+		}
+		return nil
+	})
+	return cleared, err
+}
+
+// registerAccountHandlers sets up managing members' accounts:
+//
+//	POST /admin/disconnect
+//	    Disconnects the user with the given athlete_id, deleting everything
+//	    kept about them.
+//	GET /admin/audit
+//	    The audit log as a JSON list of AuditEntry, oldest first.
+func registerAccountHandlers(mux *http.ServeMux, env *Env) {
+	store := env.Store
+
+	mux.Handle("/admin/disconnect", env.admin(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		ctx := env.context(r)
+		id, err := strconv.ParseInt(r.FormValue("athlete_id"), 10, 64)
+		if err != nil {
+			http.Error(w, "athlete_id must be a Strava athlete ID", http.StatusBadRequest)
+			return
+		}
+		err = DisconnectUser(env.oauthContext(ctx), store, env.client(ctx), id, "admin", time.Now())
+		if err == ErrNoSuchUser {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			handleError(w, err)
+			return
+		}
+		w.Write([]byte("ok")) // nolint: errcheck
+	}))
+
+	mux.Handle("/admin/audit", env.admin(func(w http.ResponseWriter, r *http.Request) {
+		entries, err := store.GetAuditLog(env.context(r))
+		if err != nil {
+			handleError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, entries)
+	}))
+}
@@ -0,0 +1,153 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	strava "github.com/strava/go.strava"
+	"golang.org/x/oauth2"
+)
+
+// newFakeDeauthorizeServer stands in for Strava's deauthorize endpoint,
+// recording the access tokens it's sent. It rejects the token "revoked".
+func newFakeDeauthorizeServer(t *testing.T) (*[]string, func()) {
+	var tokens []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		token := r.FormValue("access_token")
+		if token == "revoked" {
+			http.Error(w, `{"message": "Authorization Error"}`, http.StatusUnauthorized)
+			return
+		}
+		tokens = append(tokens, token)
+		w.Write([]byte(`{"access_token": "` + token + `"}`)) // nolint: errcheck
+	}))
+	old := stravaDeauthorizeURL
+	stravaDeauthorizeURL = srv.URL
+	return &tokens, func() {
+		stravaDeauthorizeURL = old
+		srv.Close()
+	}
+}
+
+func TestDeauthorize(t *testing.T) {
+	tokens, done := newFakeDeauthorizeServer(t)
+	defer done()
+	ctx := context.Background()
+	for _, token := range []string{"a", "revoked"} {
+		if err := Deauthorize(ctx, http.DefaultClient, oauth2.StaticTokenSource(&oauth2.Token{AccessToken: token})); err != nil {
+			t.Errorf("Deauthorizing %q: %v", token, err)
+		}
+	}
+	if len(*tokens) != 1 || (*tokens)[0] != "a" {
+		t.Errorf("Expected only the good token to be deauthorized, got %v", *tokens)
+	}
+	// A token that can't be refreshed has already been revoked.
+	expired := newTokenSource(ctx, &oauth2.Token{AccessToken: "old", Expiry: saturday}, nil)
+	if err := Deauthorize(ctx, http.DefaultClient, expired); err != nil {
+		t.Errorf("Expected an unrefreshable token to count as deauthorized, got %v", err)
+	}
+}
+
+func TestDisconnect(t *testing.T) {
+	tokens, done := newFakeDeauthorizeServer(t)
+	defer done()
+	ctx := context.Background()
+	store := NewMemoryStore()
+	if _, err := RegisterNewUser(ctx, store, makeAuth("a", "alice", "k", 1), time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := RegisterOfflineUser(ctx, store, 2, "bob"); err != nil {
+		t.Fatal(err)
+	}
+	act := run(saturday.Add(morning), 20*time.Minute, short)
+	act.Id = 1
+	for _, id := range []int64{1, 2} {
+		if err := store.PutActivities(ctx, id, []*strava.ActivitySummary{act}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	srv := httptest.NewServer(NewHandler(&Env{Store: store, Admin: RequireToken("secret"), SessionKey: []byte(testSessionKey)}))
+	defer srv.Close()
+
+	client, s := loggedIn(t, 1)
+	resp, err := client.PostForm(srv.URL+"/me/disconnect", url.Values{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Errorf("Expected disconnecting without the CSRF token to fail, got %s", resp.Status)
+	}
+	resp, err = client.PostForm(srv.URL+"/me/disconnect", url.Values{csrfField: {csrfToken([]byte(testSessionKey), s)}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusSeeOther {
+		t.Errorf("Expected to be sent to the main page, got %s", resp.Status)
+	}
+	if _, err := store.GetUser(ctx, 1); err != ErrNoSuchUser {
+		t.Errorf("Expected alice to be deleted, got %v", err)
+	}
+	if acts, err := store.GetActivities(ctx, 1); err != nil || len(acts) != 0 {
+		t.Errorf("Expected alice's activities to be deleted, got %v (%v)", acts, err)
+	}
+	if len(*tokens) != 1 || (*tokens)[0] != "a" {
+		t.Errorf("Expected alice's token to be deauthorized, got %v", *tokens)
+	}
+
+	admin := func(id string) int {
+		req, err := http.NewRequest("POST", srv.URL+"/admin/disconnect", strings.NewReader(url.Values{"athlete_id": {id}}.Encode()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.Header.Set("Authorization", "Bearer secret")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	if status := admin("2"); status != http.StatusOK {
+		t.Errorf("Expected bob to be disconnected, got %d", status)
+	}
+	if status := admin("2"); status != http.StatusNotFound {
+		t.Errorf("Expected bob to be gone, got %d", status)
+	}
+	if _, err := store.GetUser(ctx, 2); err != ErrNoSuchUser {
+		t.Errorf("Expected bob to be deleted, got %v", err)
+	}
+	if len(*tokens) != 1 {
+		t.Errorf("Expected nothing to deauthorize for an offline user, got %v", *tokens)
+	}
+
+	req, err := http.NewRequest("GET", srv.URL+"/admin/audit", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", "Bearer secret")
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var entries []AuditEntry
+	if err := json.NewDecoder(resp.Body).Decode(&entries); err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 || entries[0].Name != "alice k" || entries[0].By != "member" || entries[1].AthleteID != 2 || entries[1].By != "admin" || entries[1].Action != "disconnect" {
+		t.Errorf("Expected alice then bob to be disconnected, got %+v", entries)
+	}
+}
@@ -0,0 +1,74 @@
+package handlers
+
+import (
+	"time"
+
+	strava "github.com/strava/go.strava"
+)
+
+// Activity is a Strava activity as it is stored in the datastore. It keeps
+// the scalar parts of strava.ActivitySummary that are useful for analysis.
+type Activity struct {
+	Name               string
+	Type               string
+	StartDate          time.Time
+	StartDateLocal     time.Time
+	TimeZone           string
+	Distance           float64
+	MovingTime         int
+	ElapsedTime        int
+	TotalElevationGain float64
+	AverageSpeed       float64
+	MaxSpeed           float64
+	Trainer            bool
+	Commute            bool
+	Manual             bool
+	Private            bool
+	Flagged            bool
+}
+
+// NewActivity copies the parts of a Strava activity that we store.
+func NewActivity(act *strava.ActivitySummary) *Activity {
+	return &Activity{
+		Name:               act.Name,
+		Type:               string(act.Type),
+		StartDate:          act.StartDate,
+		StartDateLocal:     act.StartDateLocal,
+		TimeZone:           act.TimeZone,
+		Distance:           act.Distance,
+		MovingTime:         act.MovingTime,
+		ElapsedTime:        act.ElapsedTime,
+		TotalElevationGain: act.TotalElevationGain,
+		AverageSpeed:       act.AverageSpeed,
+		MaxSpeed:           act.MaximunSpeed,
+		Trainer:            act.Trainer,
+		Commute:            act.Commute,
+		Manual:             act.Manual,
+		Private:            act.Private,
+		Flagged:            act.Flagged,
+	}
+}
+
+// Summary converts a stored activity back into the Strava representation
+// that ComputeWeeklySummaries consumes.
+func (a *Activity) Summary(id int64) *strava.ActivitySummary {
+	return &strava.ActivitySummary{
+		Id:                 id,
+		Name:               a.Name,
+		Type:               strava.ActivityType(a.Type),
+		StartDate:          a.StartDate,
+		StartDateLocal:     a.StartDateLocal,
+		TimeZone:           a.TimeZone,
+		Distance:           a.Distance,
+		MovingTime:         a.MovingTime,
+		ElapsedTime:        a.ElapsedTime,
+		TotalElevationGain: a.TotalElevationGain,
+		AverageSpeed:       a.AverageSpeed,
+		MaximunSpeed:       a.MaxSpeed,
+		Trainer:            a.Trainer,
+		Commute:            a.Commute,
+		Manual:             a.Manual,
+		Private:            a.Private,
+		Flagged:            a.Flagged,
+	}
+}
@@ -0,0 +1,139 @@
+package handlers
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	strava "github.com/strava/go.strava"
+)
+
+// EnduranceTypes are the activity types that can be counted towards training,
+// in the order they're listed in.
+var EnduranceTypes = []strava.ActivityType{
+	strava.ActivityTypes.Run,
+	"TrailRun",
+	"VirtualRun",
+	strava.ActivityTypes.Walk,
+	strava.ActivityTypes.Hike,
+	strava.ActivityTypes.Ride,
+}
+
+// isRun says whether activities of type t are some kind of run.
+func isRun(t strava.ActivityType) bool {
+	return t == strava.ActivityTypes.Run || t == "TrailRun" || t == "VirtualRun"
+}
+
+// ActivityTypeSet is the set of activity types a view counts. A nil set counts
+// just runs.
+type ActivityTypeSet map[strava.ActivityType]bool
+
+// AllEndurance counts every one of EnduranceTypes.
+func AllEndurance() ActivityTypeSet {
+	s := ActivityTypeSet{}
+	for _, t := range EnduranceTypes {
+		s[t] = true
+	}
+	return s
+}
+
+// Includes says whether activities of type t are counted.
+func (s ActivityTypeSet) Includes(t strava.ActivityType) bool {
+	if s == nil {
+		return t == strava.ActivityTypes.Run
+	}
+	return s[t]
+}
+
+// Runs is the set of just the kinds of run that s counts.
+func (s ActivityTypeSet) Runs() ActivityTypeSet {
+	result := ActivityTypeSet{}
+	for _, t := range s.Types() {
+		if isRun(t) {
+			result[t] = true
+		}
+	}
+	return result
+}
+
+// Types lists the counted types in the order of EnduranceTypes.
+func (s ActivityTypeSet) Types() []strava.ActivityType {
+	var result []strava.ActivityType
+	for _, t := range EnduranceTypes {
+		if s.Includes(t) {
+			result = append(result, t)
+		}
+	}
+	return result
+}
+
+// String lists the counted types the way ParseActivityTypes reads them.
+func (s ActivityTypeSet) String() string {
+	var names []string
+	for _, t := range s.Types() {
+		names = append(names, strings.ToLower(string(t)))
+	}
+	return strings.Join(names, ",")
+}
+
+// ParseActivityTypes parses a comma separated list of activity types, e.g.
+// "run,walk", or "all" for every one of EnduranceTypes.
+func ParseActivityTypes(s string) (ActivityTypeSet, error) {
+	if strings.EqualFold(s, "all") {
+		return AllEndurance(), nil
+	}
+	result := ActivityTypeSet{}
+	for _, name := range strings.Split(s, ",") {
+		t, err := parseActivityType(strings.TrimSpace(name))
+		if err != nil {
+			return nil, err
+		}
+		result[t] = true
+	}
+	return result, nil
+}
+
+func parseActivityType(name string) (strava.ActivityType, error) {
+	for _, t := range EnduranceTypes {
+		if strings.EqualFold(name, string(t)) {
+			return t, nil
+		}
+	}
+	return "", fmt.Errorf("%q isn't one of %v", name, EnduranceTypes)
+}
+
+// TypeSummary sums up the activities of one type in a week.
+type TypeSummary struct {
+	Type strava.ActivityType
+
+	// How many activities of the type were done.
+	Count int
+
+	// Elapsed and moving time.
+	Time       time.Duration
+	MovingTime time.Duration
+
+	// How much distance was covered, in metres.
+	Distance float64
+}
+
+// summarizeTypes breaks a week's activities down by type.
+func summarizeTypes(acts []*strava.ActivitySummary, types ActivityTypeSet) []TypeSummary {
+	var result []TypeSummary
+	for _, t := range types.Types() {
+		sum := TypeSummary{Type: t}
+		for _, a := range acts {
+			if a.Type != t {
+				continue
+			}
+			sum.Count++
+			sum.Time += time.Duration(a.ElapsedTime) * time.Second
+			sum.MovingTime += time.Duration(a.MovingTime) * time.Second
+			sum.Distance += a.Distance
+		}
+		if sum.Count > 0 {
+			result = append(result, sum)
+		}
+	}
+	return result
+}
@@ -0,0 +1,91 @@
+package handlers
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	strava "github.com/strava/go.strava"
+)
+
+func TestParseActivityTypes(t *testing.T) {
+	for _, tc := range []struct {
+		input    string
+		expected ActivityTypeSet
+	}{
+		{"run", ActivityTypeSet{"Run": true}},
+		{"trailrun, Walk", ActivityTypeSet{"TrailRun": true, "Walk": true}},
+		{"ALL", AllEndurance()},
+	} {
+		actual, err := ParseActivityTypes(tc.input)
+		if err != nil || !reflect.DeepEqual(actual, tc.expected) {
+			t.Errorf("%q: expected %v, got %v (%v)", tc.input, tc.expected, actual, err)
+		}
+	}
+	for _, input := range []string{"", "swim", "run,"} {
+		if _, err := ParseActivityTypes(input); err == nil {
+			t.Errorf("%q: expected an error", input)
+		}
+	}
+
+	if s := AllEndurance().String(); s != "run,trailrun,virtualrun,walk,hike,ride" {
+		t.Errorf("Unexpected list of all types: %s", s)
+	}
+	if s := ActivityTypeSet(nil).String(); s != "run" {
+		t.Errorf("Expected no types to mean runs, got %s", s)
+	}
+}
+
+func TestSummarizeWeeksByType(t *testing.T) {
+	walk := run(monday.Add(morning), time.Hour, short)
+	walk.Type = strava.ActivityTypes.Walk
+	acts := []*strava.ActivitySummary{
+		run(saturday.Add(morning), 20*time.Minute, short),
+		ride(saturday.Add(afternoon), 2*time.Hour, 4*long),
+		walk,
+		run(tuesday.Add(morning), 30*time.Minute, long),
+	}
+	for _, a := range acts {
+		a.MovingTime = a.ElapsedTime
+	}
+
+	weeks := SummarizeWeeks(acts, DefaultWeekStart, AllEndurance(), InclusionPolicy{})
+	if len(weeks) != 1 {
+		t.Fatalf("Expected one week, got %v", weeks)
+	}
+	w := weeks[0]
+	if w.Count != 4 || w.Distance != 2*short+5*long {
+		t.Errorf("Expected everything to count towards the week, got %+v", w)
+	}
+	// But the ride isn't the longest run, and doesn't change the pace.
+	if w.LongestDistance != long || w.RunDistance != short+long || w.Pace().Round(time.Second) != 2*time.Minute+59*time.Second {
+		t.Errorf("Expected only runs to count towards the longest run and pace, got %+v, pace %s", w, w.Pace())
+	}
+	expected := []TypeSummary{
+		{Type: "Run", Count: 2, Time: 50 * time.Minute, MovingTime: 50 * time.Minute, Distance: short + long},
+		{Type: "Walk", Count: 1, Time: time.Hour, MovingTime: time.Hour, Distance: short},
+		{Type: "Ride", Count: 1, Time: 2 * time.Hour, MovingTime: 2 * time.Hour, Distance: 4 * long},
+	}
+	if !reflect.DeepEqual(w.ByType, expected) {
+		t.Errorf("Expected %+v, got %+v", expected, w.ByType)
+	}
+	if s := formatByType(Metric, w.ByType); s != "Run 2 16.8km, Walk 1 5.6km, Ride 1 44.8km" {
+		t.Errorf("Unexpected breakdown %q", s)
+	}
+
+	// Runs and walks only.
+	weeks = SummarizeWeeks(acts, DefaultWeekStart, ActivityTypeSet{"Run": true, "Walk": true}, InclusionPolicy{})
+	if weeks[0].Count != 3 || len(weeks[0].ByType) != 2 {
+		t.Errorf("Expected the ride to be left out, got %+v", weeks[0])
+	}
+
+	// The leaderboard can count cross-training too.
+	lb := ComputeLeaderboard([]Runner{{Name: "james", Activities: acts}}, LeaderboardOptions{
+		Period: NewPeriod(WeekPeriod, saturday, DefaultWeekStart),
+		Metric: ByDistance,
+		Types:  AllEndurance(),
+	})
+	if e := lb.Entries[0]; e.Count != 4 || e.Streak != 2 {
+		t.Errorf("Expected all four activities over two days in a row, got %+v", e)
+	}
+}
@@ -1,16 +1,18 @@
 package handlers
 
 import (
+	"bytes"
 	"errors"
 	"fmt"
+	"net/url"
 	"reflect"
+	"strings"
 	"testing"
 	"time"
 
 	strava "github.com/strava/go.strava"
 	context "golang.org/x/net/context"
-	"google.golang.org/appengine"
-	"google.golang.org/appengine/aetest"
+	"golang.org/x/oauth2"
 )
 
 // run creates a run activity.
@@ -66,6 +68,21 @@ const (
 	long  = 11.2 * 1000
 )
 
+// summary makes the WeekSummary expected for runs made with run(), which have
+// no moving time or elevation.
+func summary(date time.Time, count int, elapsed time.Duration, distance, longestDistance float64, longestTime time.Duration) WeekSummary {
+	return WeekSummary{
+		Date:            date,
+		Count:           count,
+		Time:            elapsed,
+		Distance:        distance,
+		LongestDistance: longestDistance,
+		LongestTime:     longestTime,
+		RunDistance:     distance,
+		ByType:          []TypeSummary{{Type: strava.ActivityTypes.Run, Count: count, Time: elapsed, Distance: distance}},
+	}
+}
+
 func TestMarathon(t *testing.T) {
 	tcs := []struct {
 		message    string
@@ -79,7 +96,7 @@ func TestMarathon(t *testing.T) {
 				run(monday.Add(morning), 20*time.Minute, short),
 				run(tuesday.Add(morning), 10*time.Minute, short),
 			},
-			summaries: []WeekSummary{{week1, 3, (20 + 10 + 22) * time.Minute, short + short + long}},
+			summaries: []WeekSummary{summary(week1, 3, (20+10+22)*time.Minute, short+short+long, long, 22*time.Minute)},
 		},
 		{
 			message:    "no activities, no summaries",
@@ -93,8 +110,8 @@ func TestMarathon(t *testing.T) {
 				run(nextSaturday.Add(morning), 21*time.Minute, long),
 			},
 			summaries: []WeekSummary{
-				{week1, 1, 20 * time.Minute, short},
-				{week2, 1, 21 * time.Minute, long},
+				summary(week1, 1, 20*time.Minute, short, short, 20*time.Minute),
+				summary(week2, 1, 21*time.Minute, long, long, 21*time.Minute),
 			},
 		},
 		{
@@ -105,8 +122,8 @@ func TestMarathon(t *testing.T) {
 				run(nextSaturday.Add(morning), 21*time.Minute, long),
 			},
 			summaries: []WeekSummary{
-				{week1, 2, 30 * time.Minute, short + long},
-				{week2, 1, 21 * time.Minute, long},
+				summary(week1, 2, 30*time.Minute, short+long, long, 10*time.Minute),
+				summary(week2, 1, 21*time.Minute, long, long, 21*time.Minute),
 			},
 		},
 		{
@@ -123,7 +140,7 @@ func TestMarathon(t *testing.T) {
 				run(monday.Add(morning), 20*time.Minute, short),
 			},
 			summaries: []WeekSummary{
-				{week1, 1, 20 * time.Minute, short},
+				summary(week1, 1, 20*time.Minute, short, short, 20*time.Minute),
 			},
 		},
 		{
@@ -133,13 +150,13 @@ func TestMarathon(t *testing.T) {
 				run(nextSaturday.Add(morning), 20*time.Minute, short),
 			},
 			summaries: []WeekSummary{
-				{week2, 1, 20 * time.Minute, short},
+				summary(week2, 1, 20*time.Minute, short, short, 20*time.Minute),
 			},
 		},
 	}
 
 	for _, tc := range tcs {
-		mt := ComputeWeeklySummaries(tc.activities)
+		mt := ComputeWeeklySummaries(tc.activities, DefaultWeekStart)
 		expected := tc.summaries
 		if !reflect.DeepEqual(mt, expected) {
 			t.Errorf("Case '%s': Expected %v, but got %v", tc.message, expected, mt)
@@ -147,10 +164,10 @@ func TestMarathon(t *testing.T) {
 	}
 }
 
-// makeAuth returns a synthesised Strava auth response.
-func makeAuth(token, fname, lname string, id int64) *strava.AuthorizationResponse {
-	return &strava.AuthorizationResponse{
-		AccessToken: token,
+// makeAuth returns a synthesised Strava authorisation.
+func makeAuth(token, fname, lname string, id int64) *Authorization {
+	return &Authorization{
+		Token: &oauth2.Token{AccessToken: token},
 		Athlete: strava.AthleteDetailed{
 			AthleteSummary: strava.AthleteSummary{
 				AthleteMeta: strava.AthleteMeta{
@@ -164,20 +181,9 @@ func makeAuth(token, fname, lname string, id int64) *strava.AuthorizationRespons
 }
 
 func TestRegisterNewUser(t *testing.T) {
-	inst, err := aetest.NewInstance(&aetest.Options{
-		StronglyConsistentDatastore: true,
-	})
-	if err != nil {
-		t.Fatal(err)
-	}
-
-	defer inst.Close() // nolint: errcheck
-	req, err := inst.NewRequest("GET", "/", nil)
-	if err != nil {
-		t.Fatal(err)
-	}
-	ctx := appengine.NewContext(req)
-	users, err := GetUsers(ctx)
+	ctx := context.Background()
+	store := NewMemoryStore()
+	users, err := store.GetUsers(ctx)
 	if err != nil {
 		t.Fatalf("Couldn't read users: %s", err)
 	}
@@ -185,22 +191,56 @@ func TestRegisterNewUser(t *testing.T) {
 		t.Errorf("Expected 0 users, got %d", len(users))
 	}
 	auth := makeAuth("abc-123", "james", "k", 1234)
-	u, err := RegisterNewUser(ctx, auth)
+	auth.Athlete.Profile = "https://example.com/large.jpg"
+	auth.Athlete.ProfileMedium = "avatar/athlete/medium.png"
+	auth.Athlete.City = "Sydney"
+	auth.Athlete.Country = "Australia"
+	auth.Athlete.Gender = strava.Genders.Male
+	auth.Athlete.CreatedAt = monday
+	now := nextSaturday
+	u, err := RegisterNewUser(ctx, store, auth, now)
 	if err != nil {
 		t.Fatalf("Failed to register user %s", err)
 	}
-	expectedU := &User{"james", "k", "abc-123"}
+	expectedU := &User{
+		ID:               1234,
+		FirstName:        "james",
+		LastName:         "k",
+		StravaToken:      "abc-123",
+		ProfilePicture:   "https://example.com/large.jpg",
+		City:             "Sydney",
+		Country:          "Australia",
+		Sex:              "M",
+		CreatedAt:        monday,
+		ProfileRefreshed: now,
+	}
 	if !reflect.DeepEqual(u, expectedU) {
-		t.Fatalf("Expected %v got %v", u, expectedU)
+		t.Fatalf("Expected %v got %v", expectedU, u)
 	}
-	// Note, this only works because datastore is run in strongly consistent mode.
-	users, err = GetUsers(ctx)
+	users, err = store.GetUsers(ctx)
 	if err != nil {
 		t.Fatal(err)
 	}
 	if len(users) != 1 {
 		t.Errorf("Expected 1 user, got %d", len(users))
 	}
+
+	// Reconnecting replaces the token, and keeps what the authorisation
+	// doesn't say.
+	u.MeasurementPreference = "feet"
+	if err := store.PutUser(ctx, u); err != nil {
+		t.Fatal(err)
+	}
+	u, err = RegisterNewUser(ctx, store, makeAuth("def-456", "jim", "k", 1234), now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.StravaToken != "def-456" || u.FirstName != "jim" || u.MeasurementPreference != "feet" {
+		t.Errorf("Expected a new token and name with the old units, got %+v", u)
+	}
+	if users, _ := store.GetUsers(ctx); len(users) != 1 {
+		t.Errorf("Expected 1 user after reconnecting, got %d", len(users))
+	}
 }
 
 func TestPreviousSaturday(t *testing.T) {
@@ -229,91 +269,338 @@ func TestPreviousSaturday(t *testing.T) {
 	}
 }
 
-type fakeFetcher struct {
-	acts []*strava.ActivitySummary
-}
-
-func (f fakeFetcher) FetchActivities(token string) ([]*strava.ActivitySummary, error) {
-	return f.acts, nil
-}
+func TestWeekStart(t *testing.T) {
+	format := "2006-01-02"
 
-func TestPrepareTable(t *testing.T) {
-	f := stubFetcher(map[string][]*strava.ActivitySummary{
-		"abc123": []*strava.ActivitySummary{run(saturday, 1*time.Hour, short)},
-	})
-	umt, err := FetchUserHistory(context.Background(), []User{{"james2", "k", "abc123"}}, f)
-	if err != nil {
-		t.Fatal(err)
-	}
-	if umt[0].Name != "james2" {
-		t.Error("Expected name to be james2, but was" + umt[0].Name)
+	for _, tc := range []struct {
+		input    string
+		start    time.Weekday
+		expected string
+	}{
+		{"2018-03-05", time.Monday, "2018-03-05"},
+		{"2018-03-04", time.Monday, "2018-02-26"},
+		{"2018-03-10", time.Monday, "2018-03-05"},
+		{"2018-03-05", time.Sunday, "2018-03-04"},
+		{"2018-03-03", time.Sunday, "2018-02-25"},
+		{"2018-03-03", time.Saturday, "2018-03-03"},
+	} {
+		id := Must(time.Parse(format, tc.input))
+		ed := Must(time.Parse(format, tc.expected))
+		ad := WeekStart(id.Add(afternoon), tc.start)
+		if ed != ad {
+			t.Errorf("%s week of %s: expected %s got %s", tc.start, tc.input, ed.Format(format), ad.Format(format))
+		}
 	}
 }
 
-type stubFetcher map[string][]*strava.ActivitySummary
-
-func (sf stubFetcher) FetchActivities(token string) ([]*strava.ActivitySummary, error) {
-	acts, ok := sf[token]
-	if !ok {
-		return nil, errors.New("not found")
-	}
-	fmt.Printf("Returning '%s': %v", token, acts)
-	return acts, nil
+// at parses an RFC 3339 time or panics.
+func at(s string) time.Time {
+	return Must(time.Parse(time.RFC3339, s))
 }
 
-func TestFetchUsersActivity(t *testing.T) {
-	actsA := []*strava.ActivitySummary{run(saturday, 1*time.Hour, short)}
-	actsB := []*strava.ActivitySummary{run(monday, 1*time.Hour, short)}
-	m := map[string][]*strava.ActivitySummary{
-		"a": actsA,
-		"b": actsB,
-	}
-	f := stubFetcher(m)
-	_ = stubFetcher(map[string][]*strava.ActivitySummary{
-		"a": actsA,
-	})
-
-	cases := []struct {
-		users []User
-		acts  [][]*strava.ActivitySummary
-		fail  bool
+func TestLocalWeekStart(t *testing.T) {
+	const (
+		sydney     = "(GMT+10:00) Australia/Sydney"
+		newYork    = "(GMT-05:00) America/New_York"
+		losAngeles = "(GMT-08:00) America/Los_Angeles"
+	)
+	for _, tc := range []struct {
+		message   string
+		start     time.Time
+		local     time.Time
+		tz        string
+		weekStart time.Weekday
+		expected  string
 	}{
 		{
-			users: []User{{StravaToken: "a"}},
-			acts:  [][]*strava.ActivitySummary{actsA},
+			message:   "just after midnight Saturday in Sydney is Friday in UTC",
+			start:     at("2018-03-02T13:30:00Z"),
+			local:     at("2018-03-03T00:30:00Z"),
+			weekStart: time.Saturday,
+			expected:  "2018-03-03",
 		},
 		{
-			users: []User{{StravaToken: "a"}, {StravaToken: "b"}},
-			acts:  [][]*strava.ActivitySummary{actsA, actsB},
+			message:   "time zone is used when there's no local start date",
+			start:     at("2018-03-02T13:30:00Z"),
+			tz:        sydney,
+			weekStart: time.Saturday,
+			expected:  "2018-03-03",
 		},
 		{
-			users: []User{{StravaToken: "b"}, {StravaToken: "b"}},
-			acts:  [][]*strava.ActivitySummary{actsB, actsB},
+			message:   "just before midnight Friday in Sydney",
+			start:     at("2018-03-02T12:45:00Z"),
+			local:     at("2018-03-02T23:45:00Z"),
+			weekStart: time.Saturday,
+			expected:  "2018-02-24",
 		},
 		{
-			users: []User{{StravaToken: "b"}, {StravaToken: "a"}},
-			acts:  [][]*strava.ActivitySummary{actsB, actsA},
+			message:   "late Friday in Los Angeles is Saturday in UTC",
+			start:     at("2018-03-03T07:30:00Z"),
+			tz:        losAngeles,
+			weekStart: time.Saturday,
+			expected:  "2018-02-24",
 		},
 		{
-			users: []User{{StravaToken: "a"}, {StravaToken: "mystery"}},
-			fail:  true,
+			message:   "late Saturday in New York the night the clocks go forward",
+			start:     at("2018-03-11T04:30:00Z"),
+			tz:        newYork,
+			weekStart: time.Saturday,
+			expected:  "2018-03-10",
 		},
 		{
-			users: []User{{StravaToken: "mystery"}},
-			fail:  true,
+			message:   "late Sunday in New York after the clocks went forward is Monday in UTC",
+			start:     at("2018-03-12T03:30:00Z"),
+			tz:        newYork,
+			weekStart: time.Monday,
+			expected:  "2018-03-05",
 		},
 		{
-			users: []User{{StravaToken: "mystery"}, {StravaToken: "other-mystery"}},
-			fail:  true,
+			message:   "just after midnight Saturday in Sydney before the clocks go back",
+			start:     at("2018-03-30T13:15:00Z"),
+			tz:        sydney,
+			weekStart: time.Saturday,
+			expected:  "2018-03-31",
 		},
+		{
+			message:   "late Sunday in Sydney after the clocks went back",
+			start:     at("2018-04-01T13:30:00Z"),
+			tz:        sydney,
+			weekStart: time.Monday,
+			expected:  "2018-03-26",
+		},
+		{
+			message:   "unknown time zones fall back to UTC",
+			start:     at("2018-03-02T13:30:00Z"),
+			tz:        "(GMT+10:00) Nowhere/Special",
+			weekStart: time.Saturday,
+			expected:  "2018-02-24",
+		},
+	} {
+		act := &strava.ActivitySummary{StartDate: tc.start, StartDateLocal: tc.local, TimeZone: tc.tz}
+		expected := Must(time.Parse("2006-01-02", tc.expected))
+		if actual := WeekStart(LocalStartDate(act), tc.weekStart); actual != expected {
+			t.Errorf("Case '%s': expected %s got %s", tc.message, expected, actual)
+		}
 	}
-	for _, c := range cases {
-		acts, err := FetchUsersActivity(c.users, f)
-		if c.fail && err == nil {
-			t.Error("Expected a failure, but got nil error")
+}
+
+func TestMarathonLocalTime(t *testing.T) {
+	// Both runs are on Saturday morning in Sydney, but the first is on Friday in UTC.
+	early := run(at("2018-03-02T20:00:00Z"), 20*time.Minute, short)
+	early.StartDateLocal = at("2018-03-03T07:00:00Z")
+	late := run(at("2018-03-03T00:00:00Z"), 30*time.Minute, long)
+	late.StartDateLocal = at("2018-03-03T11:00:00Z")
+	expected := []WeekSummary{summary(week1, 2, 50*time.Minute, short+long, long, 30*time.Minute)}
+	if mt := ComputeWeeklySummaries([]*strava.ActivitySummary{late, early}, time.Saturday); !reflect.DeepEqual(mt, expected) {
+		t.Errorf("Expected %v, but got %v", expected, mt)
+	}
+}
+
+func TestParseWeekday(t *testing.T) {
+	for _, tc := range []struct {
+		input    string
+		expected time.Weekday
+		fail     bool
+	}{
+		{input: "monday", expected: time.Monday},
+		{input: "Sunday", expected: time.Sunday},
+		{input: "SAT", expected: time.Saturday},
+		{input: "mo", fail: true},
+		{input: "funday", fail: true},
+	} {
+		d, err := ParseWeekday(tc.input)
+		if tc.fail {
+			if err == nil {
+				t.Errorf("Expected %q to fail, got %s", tc.input, d)
+			}
+			continue
 		}
-		if !reflect.DeepEqual(acts, c.acts) {
-			t.Errorf("Expected acts %v, got %v", c.acts, acts)
+		if err != nil || d != tc.expected {
+			t.Errorf("Expected %q to parse as %s, got %s (%v)", tc.input, tc.expected, d, err)
+		}
+	}
+}
+
+func TestMarathonMetrics(t *testing.T) {
+	easy := run(saturday.Add(morning), 35*time.Minute, 5000)
+	easy.MovingTime = int((30 * time.Minute).Seconds())
+	easy.TotalElevationGain = 40
+	longRun := run(monday.Add(morning), 2*time.Hour, 20000)
+	longRun.MovingTime = int((time.Hour + 50*time.Minute).Seconds())
+	longRun.TotalElevationGain = 210.5
+
+	mt := ComputeWeeklySummaries([]*strava.ActivitySummary{longRun, easy}, DefaultWeekStart)
+	expected := []WeekSummary{{
+		Date:            week1,
+		Count:           2,
+		Time:            2*time.Hour + 35*time.Minute,
+		Distance:        25000,
+		MovingTime:      2*time.Hour + 20*time.Minute,
+		Elevation:       250.5,
+		LongestDistance: 20000,
+		LongestTime:     2 * time.Hour,
+		RunDistance:     25000,
+		RunMovingTime:   2*time.Hour + 20*time.Minute,
+		ByType: []TypeSummary{{
+			Type:       strava.ActivityTypes.Run,
+			Count:      2,
+			Time:       2*time.Hour + 35*time.Minute,
+			MovingTime: 2*time.Hour + 20*time.Minute,
+			Distance:   25000,
+		}},
+	}}
+	if !reflect.DeepEqual(mt, expected) {
+		t.Fatalf("Expected %v, but got %v", expected, mt)
+	}
+	if pace, expected := mt[0].Pace(), 5*time.Minute+36*time.Second; pace != expected {
+		t.Errorf("Expected pace %s, got %s", expected, pace)
+	}
+	if pace := (WeekSummary{}).Pace(); pace != 0 {
+		t.Errorf("Expected no pace without any distance, got %s", pace)
+	}
+}
+
+func TestMarathonWeekStart(t *testing.T) {
+	acts := []*strava.ActivitySummary{
+		run(saturday.Add(morning), 20*time.Minute, short),
+		run(monday.Add(morning), 10*time.Minute, long),
+		run(tuesday.Add(morning), 21*time.Minute, long),
+	}
+	sunday := saturday.Add(24 * time.Hour)
+	expected := []WeekSummary{
+		summary(sunday.Add(-7*24*time.Hour), 1, 20*time.Minute, short, short, 20*time.Minute),
+		summary(sunday, 2, 31*time.Minute, long+long, long, 10*time.Minute),
+	}
+	if mt := ComputeWeeklySummaries(acts, time.Sunday); !reflect.DeepEqual(mt, expected) {
+		t.Errorf("Expected %v, but got %v", expected, mt)
+	}
+}
+
+func TestFetchAllPages(t *testing.T) {
+	full := make([]*strava.ActivitySummary, activitiesPerPage)
+	for i := range full {
+		full[i] = run(saturday, time.Hour, short)
+	}
+	for _, tc := range []struct {
+		message string
+		pages   [][]*strava.ActivitySummary
+		count   int
+	}{
+		{"no activities", [][]*strava.ActivitySummary{nil}, 0},
+		{"one short page", [][]*strava.ActivitySummary{full[:3]}, 3},
+		{"full page then empty page", [][]*strava.ActivitySummary{full, nil}, activitiesPerPage},
+		{"two full pages then a short one", [][]*strava.ActivitySummary{full, full, full[:1]}, 2*activitiesPerPage + 1},
+	} {
+		var requested []int
+		acts, err := fetchAllPages(context.Background(), func(page int) ([]*strava.ActivitySummary, error) {
+			requested = append(requested, page)
+			if page > len(tc.pages) {
+				return nil, fmt.Errorf("page %d requested past the end", page)
+			}
+			return tc.pages[page-1], nil
+		})
+		if err != nil {
+			t.Errorf("Case '%s': %s", tc.message, err)
+			continue
+		}
+		if len(acts) != tc.count {
+			t.Errorf("Case '%s': expected %d activities, got %d", tc.message, tc.count, len(acts))
+		}
+		if len(requested) != len(tc.pages) {
+			t.Errorf("Case '%s': expected %d pages to be requested, got %v", tc.message, len(tc.pages), requested)
+		}
+	}
+
+	_, err := fetchAllPages(context.Background(), func(page int) ([]*strava.ActivitySummary, error) {
+		if page == 2 {
+			return nil, errors.New("rate limited")
+		}
+		return full, nil
+	})
+	if err == nil {
+		t.Error("Expected an error from a failing page")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	_, err = fetchAllPages(ctx, func(page int) ([]*strava.ActivitySummary, error) {
+		cancel()
+		return full, nil
+	})
+	if err != context.Canceled {
+		t.Errorf("Expected fetching to stop once cancelled, got %v", err)
+	}
+}
+
+func TestMainTplLoadError(t *testing.T) {
+	umt := []*UserMarathonTracking{
+		{Name: "james2", Weeks: ComputeWeeklySummaries([]*strava.ActivitySummary{run(saturday, 1*time.Hour, short)}, DefaultWeekStart)},
+		{Name: "revoked", Err: errors.New("not found")},
+	}
+	buf := bytes.NewBuffer(nil)
+	if err := mainTpl.Execute(buf, mainTplArgs{Umt: umt, Query: url.Values{"week_start": {"monday"}, "units": {"imperial"}}}); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(buf.String(), "Couldn't load revoked's latest activities") {
+		t.Errorf("Expected a notice for the failed user, got %s", buf)
+	}
+	if link := `href="?types=all&amp;units=imperial&amp;week_start=monday"`; !strings.Contains(buf.String(), link) {
+		t.Errorf("Expected the filter links to keep the rest of the query, got %s", buf)
+	}
+}
+
+type stubFetcher map[string][]*strava.ActivitySummary
+
+func (sf stubFetcher) FetchActivities(ctx context.Context, ts oauth2.TokenSource, after, before time.Time) ([]*strava.ActivitySummary, error) {
+	tok, err := ts.Token()
+	if err != nil {
+		return nil, err
+	}
+	token := tok.AccessToken
+	acts, ok := sf[token]
+	if !ok {
+		return nil, errors.New("not found")
+	}
+	fmt.Printf("Returning '%s': %v", token, acts)
+	var result []*strava.ActivitySummary
+	for _, act := range acts {
+		if (after.IsZero() || act.StartDate.After(after)) && (before.IsZero() || act.StartDate.Before(before)) {
+			result = append(result, act)
+		}
+	}
+	return result, nil
+}
+
+func (sf stubFetcher) FetchActivity(ctx context.Context, ts oauth2.TokenSource, id int64) (*strava.ActivitySummary, error) {
+	acts, err := sf.FetchActivities(ctx, ts, time.Time{}, time.Time{})
+	if err != nil {
+		return nil, err
+	}
+	for _, act := range acts {
+		if act.Id == id {
+			return act, nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+func TestFormat(t *testing.T) {
+	for _, tc := range []struct {
+		actual   string
+		expected string
+	}{
+		{formatDistance(Metric, 11234), "11.2km"},
+		{formatDistance("", 11234), "11.2km"},
+		{formatDistance(Imperial, 11234), "7.0mi"},
+		{formatElevation(Metric, 123.4), "123m"},
+		{formatElevation(Imperial, 123.4), "405ft"},
+		{formatDuration(2*time.Hour + 5*time.Minute + 30*time.Second), "2h 5m"},
+		{formatPace(Metric, 5*time.Minute+36*time.Second), "5:36/km"},
+		{formatPace(Metric, 4*time.Minute+59*time.Second+600*time.Millisecond), "5:00/km"},
+		{formatPace(Metric, 0), ""},
+		{formatPace(Imperial, 5*time.Minute+36*time.Second), "9:01/mi"},
+	} {
+		if tc.actual != tc.expected {
+			t.Errorf("Expected %q, got %q", tc.expected, tc.actual)
 		}
 	}
 }
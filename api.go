@@ -0,0 +1,473 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The JSON API is versioned by its path prefix. Fields may be added to the
+// types below within a version, but never renamed, removed or changed in
+// meaning. Every quantity has its unit in its name. Distances, paces and
+// elevations are always given in metric, and also in imperial when the
+// response's units are imperial.
+const apiPrefix = "/api/v1/"
+
+// APIUser is one user's training history.
+type APIUser struct {
+	// The user's Strava athlete ID.
+	AthleteID int64 `json:"athlete_id"`
+
+	Name string `json:"name"`
+
+	// A link to the user's 62x62 Strava profile picture, if they have one.
+	ProfilePicture string `json:"profile_picture,omitempty"`
+
+	// Why the user's latest activities couldn't be loaded, if they couldn't.
+	// Weeks may be out of date or missing when this is set.
+	Error string `json:"error,omitempty"`
+
+	// Whether the user has to authorise us on Strava again.
+	NeedsReconnect bool `json:"needs_reconnect"`
+
+	// The types of activity counted in weeks, e.g. ["Run", "Walk"].
+	ActivityTypes []string `json:"activity_types"`
+
+	// "metric" or "imperial": the user's preference on Strava, unless the
+	// request asked for other units.
+	Units string `json:"units"`
+
+	// The race the user is training for, if they have a training plan.
+	Race *APIRace `json:"race,omitempty"`
+
+	Weeks []APIWeek `json:"weeks"`
+}
+
+// APIRace is the race at the end of a user's training plan.
+type APIRace struct {
+	Name string `json:"name"`
+
+	// The day of the race, as YYYY-MM-DD.
+	Date string `json:"date"`
+}
+
+// APIWeek summarises the runs in one week. Weeks with no runs are omitted,
+// unless the user's training plan has something planned for them or the
+// inclusion policy left some out.
+type APIWeek struct {
+	// The first day of the week, as YYYY-MM-DD.
+	WeekStart string `json:"week_start"`
+
+	// How many runs were done, or activities if more types than runs are
+	// counted.
+	RunCount int `json:"run_count"`
+
+	// Total distance run, in kilometres.
+	DistanceKm float64 `json:"distance_km"`
+
+	// Total elapsed time of the runs, in whole seconds.
+	ElapsedTimeS int64 `json:"elapsed_time_s"`
+
+	// Total time spent moving, in whole seconds.
+	MovingTimeS int64 `json:"moving_time_s"`
+
+	// Total elevation gained, in metres.
+	ElevationGainM float64 `json:"elevation_gain_m"`
+
+	// Average moving time per kilometre of the week's runs, in whole
+	// seconds, or 0 if there weren't any. Other types of activity don't
+	// count.
+	AveragePaceSPerKm int64 `json:"average_pace_s_per_km"`
+
+	// The distance and elapsed time of the week's longest run, or 0 if there
+	// weren't any.
+	LongestRunDistanceKm float64 `json:"longest_run_distance_km"`
+	LongestRunElapsedS   int64   `json:"longest_run_elapsed_time_s"`
+
+	// The distance, elevation and pace fields above in miles and feet, for
+	// imperial units.
+	DistanceMi           *float64 `json:"distance_mi,omitempty"`
+	ElevationGainFt      *float64 `json:"elevation_gain_ft,omitempty"`
+	AveragePaceSPerMi    *int64   `json:"average_pace_s_per_mi,omitempty"`
+	LongestRunDistanceMi *float64 `json:"longest_run_distance_mi,omitempty"`
+
+	// What was planned for the week, if the user has a training plan that
+	// covers it.
+	Plan *APIWeekPlan `json:"plan,omitempty"`
+
+	Workload APIWorkload `json:"workload"`
+
+	// The week's activities broken down by type. Types with no activities
+	// are left out.
+	ByType []APITypeSummary `json:"by_type"`
+
+	// How many activities the inclusion policy left out of the week. They
+	// aren't counted anywhere else.
+	ExcludedCount int `json:"excluded_count"`
+}
+
+// APITypeSummary sums up one type of activity in a week.
+type APITypeSummary struct {
+	// The Strava activity type, e.g. "Run".
+	Type string `json:"type"`
+
+	Count        int      `json:"count"`
+	DistanceKm   float64  `json:"distance_km"`
+	DistanceMi   *float64 `json:"distance_mi,omitempty"`
+	ElapsedTimeS int64    `json:"elapsed_time_s"`
+	MovingTimeS  int64    `json:"moving_time_s"`
+}
+
+// APIWorkload compares a week's running with the weeks before it.
+type APIWorkload struct {
+	// The change in distance on the week before, as a percentage. Missing
+	// if nothing was run the week before.
+	DistanceChangePercent *float64 `json:"distance_change_percent,omitempty"`
+
+	// The week's distance divided by the average weekly distance over the
+	// 28 days ending with it. Missing if there isn't 28 days of history.
+	AcuteChronicRatio *float64 `json:"acute_chronic_ratio,omitempty"`
+
+	// Whether distance went up by more than 10% on the week before.
+	TenPercentRuleBroken bool `json:"ten_percent_rule_broken"`
+
+	// Whether the acute:chronic ratio is over 1.5.
+	HighInjuryRisk bool `json:"high_injury_risk"`
+}
+
+// APIWeekPlan compares a week's running with the user's training plan.
+type APIWeekPlan struct {
+	// The planned total distance and long run distance, in kilometres.
+	DistanceKm float64 `json:"distance_km"`
+	LongRunKm  float64 `json:"long_run_km"`
+
+	// The same in miles, for imperial units.
+	DistanceMi *float64 `json:"distance_mi,omitempty"`
+	LongRunMi  *float64 `json:"long_run_mi,omitempty"`
+
+	// How much of the planned distance has been run, as a percentage.
+	PercentComplete float64 `json:"percent_complete"`
+
+	// How many weeks after this one the race is. The race week itself is 0.
+	WeeksToRace int `json:"weeks_to_race"`
+}
+
+// NewAPIUser converts a user's history into its JSON form.
+func NewAPIUser(umt *UserMarathonTracking) *APIUser {
+	u := &APIUser{
+		AthleteID:      umt.AthleteID,
+		Name:           umt.Name,
+		ProfilePicture: umt.Picture,
+		NeedsReconnect: umt.NeedsReconnect(),
+		ActivityTypes:  apiActivityTypes(umt.Types),
+		Units:          string(umt.Units.orMetric()),
+		Weeks:          NewAPIWeeks(umt.Weeks, umt.Units),
+	}
+	if umt.Err != nil {
+		u.Error = umt.Err.Error()
+	}
+	if umt.Plan != nil {
+		u.Race = &APIRace{Name: umt.Plan.RaceName, Date: umt.Plan.RaceDate.Format(dateFormat)}
+	}
+	return u
+}
+
+// NewAPIWeeks converts weekly summaries into their JSON form, with imperial
+// fields if units are imperial.
+func NewAPIWeeks(weeks []WeekSummary, units Units) []APIWeek {
+	result := make([]APIWeek, len(weeks))
+	for i, w := range weeks {
+		result[i] = APIWeek{
+			WeekStart:    w.Date.Format(dateFormat),
+			RunCount:     w.Count,
+			DistanceKm:   w.Distance / 1000,
+			ElapsedTimeS: int64(w.Time / time.Second),
+
+			MovingTimeS:          int64(w.MovingTime / time.Second),
+			ElevationGainM:       w.Elevation,
+			AveragePaceSPerKm:    int64(w.Pace() / time.Second),
+			LongestRunDistanceKm: w.LongestDistance / 1000,
+			LongestRunElapsedS:   int64(w.LongestTime / time.Second),
+		}
+		if units == Imperial {
+			result[i].DistanceMi = floatPtr(units.Distance(w.Distance))
+			result[i].ElevationGainFt = floatPtr(units.Elevation(w.Elevation))
+			pace := int64(units.Pace(w.Pace()).Round(time.Second) / time.Second)
+			result[i].AveragePaceSPerMi = &pace
+			result[i].LongestRunDistanceMi = floatPtr(units.Distance(w.LongestDistance))
+		}
+		result[i].Workload = NewAPIWorkload(w.Workload)
+		result[i].ExcludedCount = w.Excluded
+		result[i].ByType = []APITypeSummary{}
+		for _, t := range w.ByType {
+			ts := APITypeSummary{
+				Type:         string(t.Type),
+				Count:        t.Count,
+				DistanceKm:   t.Distance / 1000,
+				ElapsedTimeS: int64(t.Time / time.Second),
+				MovingTimeS:  int64(t.MovingTime / time.Second),
+			}
+			if units == Imperial {
+				ts.DistanceMi = floatPtr(units.Distance(t.Distance))
+			}
+			result[i].ByType = append(result[i].ByType, ts)
+		}
+		if w.Plan != nil {
+			result[i].Plan = &APIWeekPlan{
+				DistanceKm:      w.Plan.Distance / 1000,
+				LongRunKm:       w.Plan.LongRun / 1000,
+				PercentComplete: w.PercentComplete(),
+				WeeksToRace:     w.Plan.WeeksToRace,
+			}
+			if units == Imperial {
+				result[i].Plan.DistanceMi = floatPtr(units.Distance(w.Plan.Distance))
+				result[i].Plan.LongRunMi = floatPtr(units.Distance(w.Plan.LongRun))
+			}
+		}
+	}
+	return result
+}
+
+// floatPtr returns a pointer to v, for optional fields.
+func floatPtr(v float64) *float64 {
+	return &v
+}
+
+// apiActivityTypes lists the types in a set.
+func apiActivityTypes(types ActivityTypeSet) []string {
+	result := []string{}
+	for _, t := range types.Types() {
+		result = append(result, string(t))
+	}
+	return result
+}
+
+// NewAPIWorkload converts a week's workload into its JSON form.
+func NewAPIWorkload(w Workload) APIWorkload {
+	result := APIWorkload{TenPercentRuleBroken: w.TooFast, HighInjuryRisk: w.HighRisk}
+	if w.PreviousDistance > 0 {
+		change := w.Change * 100
+		result.DistanceChangePercent = &change
+	}
+	if w.Ratio > 0 {
+		ratio := w.Ratio
+		result.AcuteChronicRatio = &ratio
+	}
+	return result
+}
+
+// APILeaderboard ranks the group over a week or month.
+type APILeaderboard struct {
+	// "week" or "month".
+	Period string `json:"period"`
+
+	// The first and last days of the period, as YYYY-MM-DD.
+	StartDate string `json:"start_date"`
+	EndDate   string `json:"end_date"`
+
+	// What runners are ranked by: "distance", "time", "count" or "streak".
+	Metric string `json:"metric"`
+
+	// The types of activity counted, e.g. ["Run", "Walk"].
+	ActivityTypes []string `json:"activity_types"`
+
+	// "metric" or "imperial", as the request asked. Metric by default.
+	Units string `json:"units"`
+
+	// The runners in order of rank, followed by those who couldn't be ranked.
+	Entries []APILeaderboardEntry `json:"entries"`
+
+	// The whole group's running, and the average per ranked runner.
+	Total   APIRunStats `json:"total"`
+	Average APIRunStats `json:"average"`
+}
+
+// APILeaderboardEntry is one runner's place on the leaderboard.
+type APILeaderboardEntry struct {
+	// The runner's position, starting at 1. Runners who tie share a rank.
+	// Missing if the runner's activities couldn't be loaded.
+	Rank int `json:"rank,omitempty"`
+
+	AthleteID int64  `json:"athlete_id"`
+	Name      string `json:"name"`
+
+	APIRunStats
+
+	// The most days in a row the runner ran on during the period.
+	LongestStreakDays int `json:"longest_streak_days"`
+
+	// Why the runner's activities couldn't be loaded, if they couldn't.
+	Error string `json:"error,omitempty"`
+}
+
+// APIRunStats adds up some runs.
+type APIRunStats struct {
+	// Total distance run, in kilometres, and in miles for imperial units.
+	DistanceKm float64  `json:"distance_km"`
+	DistanceMi *float64 `json:"distance_mi,omitempty"`
+
+	// Total elapsed time of the runs, in whole seconds.
+	ElapsedTimeS int64 `json:"elapsed_time_s"`
+
+	// How many runs were done. Averages may be fractional.
+	RunCount float64 `json:"run_count"`
+}
+
+// NewAPILeaderboard converts a leaderboard into its JSON form.
+func NewAPILeaderboard(lb *Leaderboard) *APILeaderboard {
+	result := &APILeaderboard{
+		Period:    string(lb.Period.Kind),
+		StartDate: lb.Period.Start.Format(dateFormat),
+		EndDate:   lb.Period.LastDay().Format(dateFormat),
+		Metric:    string(lb.Metric),
+
+		ActivityTypes: apiActivityTypes(lb.Types),
+		Units:         string(lb.Units.orMetric()),
+		Entries:       []APILeaderboardEntry{},
+		Total:         newAPIRunStats(lb.Units, lb.Total.Distance, lb.Total.Time, float64(lb.Total.Count)),
+		Average:       newAPIRunStats(lb.Units, lb.AverageDistance(), lb.AverageTime(), lb.AverageCount()),
+	}
+	for _, e := range lb.Entries {
+		ae := APILeaderboardEntry{
+			Rank:              e.Rank,
+			AthleteID:         e.AthleteID,
+			Name:              e.Name,
+			APIRunStats:       newAPIRunStats(lb.Units, e.Distance, e.Time, float64(e.Count)),
+			LongestStreakDays: e.Streak,
+		}
+		if e.Err != nil {
+			ae.Error = e.Err.Error()
+		}
+		result.Entries = append(result.Entries, ae)
+	}
+	return result
+}
+
+func newAPIRunStats(units Units, distance float64, elapsed time.Duration, count float64) APIRunStats {
+	result := APIRunStats{
+		DistanceKm:   distance / 1000,
+		ElapsedTimeS: int64(elapsed / time.Second),
+		RunCount:     count,
+	}
+	if units == Imperial {
+		result.DistanceMi = floatPtr(units.Distance(distance))
+	}
+	return result
+}
+
+// errNotFound is returned for API paths that don't exist.
+var errNotFound = errors.New("not found")
+
+// apiError is the body of every unsuccessful API response.
+type apiError struct {
+	Error string `json:"error"`
+}
+
+// writeJSON writes v as the JSON response body with the given status.
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v) // nolint: errcheck
+}
+
+// writeJSONError writes an API error response.
+func writeJSONError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, apiError{err.Error()})
+}
+
+// registerAPIHandlers sets up the JSON API:
+//
+//	GET /api/v1/users
+//	    Every user's history, as a list of APIUser.
+//	GET /api/v1/users/{athlete_id}
+//	    One user's history, as an APIUser.
+//	GET /api/v1/leaderboard
+//	    The group's leaderboard, as an APILeaderboard.
+//
+// Only members of the group can use it, with a session cookie or an API
+// token. The users endpoints accept the week_start, from, to, types,
+// exclude, trainer_percent and units query parameters, and the leaderboard
+// accepts period, date, week_start, metric, types, exclude, trainer_percent
+// and units, which work the same as they do for the HTML pages.
+func registerAPIHandlers(mux *http.ServeMux, env *Env) {
+	store := env.Store
+	mux.HandleFunc(apiPrefix+"leaderboard", env.apiMembersOnly(func(w http.ResponseWriter, r *http.Request) {
+		ctx := env.context(r)
+		opts, err := leaderboardParams(r, time.Now())
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, err)
+			return
+		}
+		users, err := store.GetUsers(ctx)
+		if err != nil {
+			writeJSONError(w, http.StatusInternalServerError, err)
+			return
+		}
+		lb := ComputeLeaderboard(LoadRunners(ctx, store, users), opts)
+		writeJSON(w, http.StatusOK, NewAPILeaderboard(lb))
+	}))
+
+	mux.HandleFunc(apiPrefix+"users", env.apiMembersOnly(func(w http.ResponseWriter, r *http.Request) {
+		ctx := env.context(r)
+		opts, err := historyOptionsParam(r)
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, err)
+			return
+		}
+		users, err := store.GetUsers(ctx)
+		if err != nil {
+			writeJSONError(w, http.StatusInternalServerError, err)
+			return
+		}
+		result := []*APIUser{}
+		for _, umt := range LoadUserHistory(ctx, store, users, opts) {
+			result = append(result, NewAPIUser(umt))
+		}
+		writeJSON(w, http.StatusOK, result)
+	}))
+
+	mux.HandleFunc(apiPrefix+"users/", env.apiMembersOnly(func(w http.ResponseWriter, r *http.Request) {
+		ctx := env.context(r)
+		id, err := strconv.ParseInt(strings.TrimPrefix(r.URL.Path, apiPrefix+"users/"), 10, 64)
+		if err != nil {
+			writeJSONError(w, http.StatusNotFound, errNotFound)
+			return
+		}
+		opts, err := historyOptionsParam(r)
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, err)
+			return
+		}
+		user, err := store.GetUser(ctx, id)
+		if err == ErrNoSuchUser {
+			writeJSONError(w, http.StatusNotFound, errNotFound)
+			return
+		}
+		if err != nil {
+			writeJSONError(w, http.StatusInternalServerError, err)
+			return
+		}
+		umt := LoadUserHistory(ctx, store, []User{*user}, opts)[0]
+		writeJSON(w, http.StatusOK, NewAPIUser(umt))
+	}))
+}
+
+// apiMembersOnly only lets through API requests from members of the group
+// who are logged in or have an API token.
+func (e *Env) apiMembersOnly(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		_, err := e.apiMember(r)
+		if err == errNotLoggedIn {
+			writeJSONError(w, http.StatusUnauthorized, err)
+			return
+		}
+		if err != nil {
+			writeJSONError(w, http.StatusInternalServerError, err)
+			return
+		}
+		h(w, r)
+	}
+}
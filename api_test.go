@@ -0,0 +1,249 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	strava "github.com/strava/go.strava"
+)
+
+func TestAPIUserJSON(t *testing.T) {
+	umt := &UserMarathonTracking{
+		AthleteID: 1234,
+		Name:      "james",
+		Weeks: []WeekSummary{
+			{
+				Date:            week1,
+				Count:           2,
+				Time:            90*time.Minute + 500*time.Millisecond,
+				Distance:        12345,
+				MovingTime:      time.Hour,
+				RunDistance:     12345,
+				RunMovingTime:   time.Hour,
+				Elevation:       123.4,
+				LongestDistance: 10000,
+				LongestTime:     70 * time.Minute,
+				Workload:        Workload{PreviousDistance: 9876, Change: 0.25, Ratio: 1.75, TooFast: true, HighRisk: true},
+			},
+		},
+		Err: fmt.Errorf("refreshing: %w", ErrUnauthorized),
+	}
+	b, err := json.Marshal(NewAPIUser(umt))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var actual map[string]interface{}
+	if err := json.Unmarshal(b, &actual); err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]interface{}{
+		"athlete_id":      1234.0,
+		"name":            "james",
+		"error":           "refreshing: strava rejected the user's token",
+		"needs_reconnect": true,
+		"activity_types":  []interface{}{"Run"},
+		"units":           "metric",
+		"weeks": []interface{}{
+			map[string]interface{}{
+				"week_start":     "2018-03-03",
+				"run_count":      2.0,
+				"distance_km":    12.345,
+				"elapsed_time_s": 5400.0,
+
+				"moving_time_s":              3600.0,
+				"elevation_gain_m":           123.4,
+				"average_pace_s_per_km":      291.0,
+				"longest_run_distance_km":    10.0,
+				"longest_run_elapsed_time_s": 4200.0,
+
+				"by_type":        []interface{}{},
+				"excluded_count": 0.0,
+				"workload": map[string]interface{}{
+					"distance_change_percent": 25.0,
+					"acute_chronic_ratio":     1.75,
+					"ten_percent_rule_broken": true,
+					"high_injury_risk":        true,
+				},
+			},
+		},
+	}
+	if !reflect.DeepEqual(actual, expected) {
+		t.Errorf("Expected %v, got %v", expected, actual)
+	}
+
+	// Users with no runs have an empty list of weeks rather than null.
+	b, err = json.Marshal(NewAPIUser(&UserMarathonTracking{Name: "lazy"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := `{"athlete_id":0,"name":"lazy","needs_reconnect":false,"activity_types":["Run"],"units":"metric","weeks":[]}`; string(b) != expected {
+		t.Errorf("Expected %s, got %s", expected, b)
+	}
+}
+
+func TestAPIUserJSONImperial(t *testing.T) {
+	umt := &UserMarathonTracking{
+		Name:  "james",
+		Units: Imperial,
+		Weeks: []WeekSummary{{
+			Date:            week1,
+			Count:           1,
+			Distance:        metresPerMile * 5,
+			MovingTime:      40 * time.Minute,
+			RunDistance:     metresPerMile * 5,
+			RunMovingTime:   40 * time.Minute,
+			Elevation:       metresPerFoot * 100,
+			LongestDistance: metresPerMile * 5,
+			Plan:            &PlanProgress{Distance: metresPerMile * 20, LongRun: metresPerMile * 10},
+			ByType:          []TypeSummary{{Type: "Run", Count: 1, Distance: metresPerMile * 5}},
+		}},
+	}
+	b, err := json.Marshal(NewAPIUser(umt))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var actual struct {
+		Units string `json:"units"`
+		Weeks []struct {
+			DistanceKm           float64 `json:"distance_km"`
+			DistanceMi           float64 `json:"distance_mi"`
+			ElevationGainFt      float64 `json:"elevation_gain_ft"`
+			AveragePaceSPerMi    int64   `json:"average_pace_s_per_mi"`
+			LongestRunDistanceMi float64 `json:"longest_run_distance_mi"`
+			Plan                 struct {
+				DistanceMi float64 `json:"distance_mi"`
+				LongRunMi  float64 `json:"long_run_mi"`
+			} `json:"plan"`
+			ByType []struct {
+				DistanceMi float64 `json:"distance_mi"`
+			} `json:"by_type"`
+		} `json:"weeks"`
+	}
+	if err := json.Unmarshal(b, &actual); err != nil {
+		t.Fatal(err)
+	}
+	w := actual.Weeks[0]
+	// The metric fields are always there.
+	if actual.Units != "imperial" || w.DistanceKm != 8.04672 {
+		t.Errorf("Expected imperial units alongside metric, got %s", b)
+	}
+	if w.DistanceMi != 5 || w.ElevationGainFt != 100 || w.AveragePaceSPerMi != 480 || w.LongestRunDistanceMi != 5 {
+		t.Errorf("Expected the week in miles and feet, got %s", b)
+	}
+	if w.Plan.DistanceMi != 20 || w.Plan.LongRunMi != 10 || w.ByType[0].DistanceMi != 5 {
+		t.Errorf("Expected the plan and types in miles, got %s", b)
+	}
+}
+
+func TestHistoryOptionsParam(t *testing.T) {
+	day := func(s string) time.Time { return Must(time.Parse(dateFormat, s)) }
+	for _, tc := range []struct {
+		query    string
+		expected HistoryOptions
+		fail     bool
+	}{
+		{query: "", expected: HistoryOptions{WeekStart: DefaultWeekStart}},
+		{query: "week_start=monday", expected: HistoryOptions{WeekStart: time.Monday}},
+		{
+			query:    "from=2018-01-01&to=2018-03-31&week_start=sun",
+			expected: HistoryOptions{WeekStart: time.Sunday, From: day("2018-01-01"), To: day("2018-03-31")},
+		},
+		{query: "from=2018-01-01", expected: HistoryOptions{WeekStart: DefaultWeekStart, From: day("2018-01-01")}},
+		{
+			query:    "types=run,Walk",
+			expected: HistoryOptions{WeekStart: DefaultWeekStart, Types: ActivityTypeSet{"Run": true, "Walk": true}},
+		},
+		{query: "types=all", expected: HistoryOptions{WeekStart: DefaultWeekStart, Types: AllEndurance()}},
+		{query: "units=imperial", expected: HistoryOptions{WeekStart: DefaultWeekStart, Units: Imperial}},
+		{query: "units=miles", fail: true},
+		{query: "week_start=someday", fail: true},
+		{query: "types=run,swim", fail: true},
+		{query: "from=yesterday", fail: true},
+		{query: "from=2018-03-31&to=2018-01-01", fail: true},
+	} {
+		r := httptest.NewRequest("GET", "/?"+tc.query, nil)
+		opts, err := historyOptionsParam(r)
+		if tc.fail {
+			if err == nil {
+				t.Errorf("%q: expected an error, got %+v", tc.query, opts)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: %s", tc.query, err)
+			continue
+		}
+		if !reflect.DeepEqual(opts, tc.expected) {
+			t.Errorf("%q: expected %+v, got %+v", tc.query, tc.expected, opts)
+		}
+	}
+}
+
+func TestFilterActivities(t *testing.T) {
+	// Late on Friday in Sydney, which is still Friday in UTC.
+	friday := run(at("2018-03-02T12:30:00Z"), time.Hour, short)
+	friday.StartDateLocal = at("2018-03-02T23:30:00Z")
+	// Early on Saturday in Sydney, which is Friday in UTC.
+	sat := run(at("2018-03-02T13:30:00Z"), time.Hour, short)
+	sat.StartDateLocal = at("2018-03-03T00:30:00Z")
+	mon := run(monday.Add(afternoon), time.Hour, short)
+	acts := []*strava.ActivitySummary{friday, sat, mon}
+
+	for _, tc := range []struct {
+		message  string
+		opts     HistoryOptions
+		expected []*strava.ActivitySummary
+	}{
+		{"no range", HistoryOptions{}, acts},
+		{"from is inclusive", HistoryOptions{From: saturday}, []*strava.ActivitySummary{sat, mon}},
+		{"to is inclusive", HistoryOptions{To: saturday}, []*strava.ActivitySummary{friday, sat}},
+		{"single day", HistoryOptions{From: monday, To: monday}, []*strava.ActivitySummary{mon}},
+		{"empty range", HistoryOptions{From: tuesday}, nil},
+	} {
+		if actual := tc.opts.FilterActivities(acts); !reflect.DeepEqual(actual, tc.expected) {
+			t.Errorf("Case '%s': expected %v, got %v", tc.message, tc.expected, actual)
+		}
+	}
+}
+
+func TestAPIErrorJSON(t *testing.T) {
+	w := httptest.NewRecorder()
+	writeJSONError(w, 400, errors.New("bad week"))
+	if w.Code != 400 || w.Header().Get("Content-Type") != "application/json; charset=utf-8" {
+		t.Errorf("Unexpected response %d %v", w.Code, w.Header())
+	}
+	if expected := "{\"error\":\"bad week\"}\n"; w.Body.String() != expected {
+		t.Errorf("Expected %q, got %q", expected, w.Body.String())
+	}
+}
+
+func TestAPILeaderboardJSON(t *testing.T) {
+	lb := &Leaderboard{
+		LeaderboardOptions: LeaderboardOptions{
+			Period: NewPeriod(WeekPeriod, monday, DefaultWeekStart),
+			Metric: ByDistance,
+		},
+		Entries: []LeaderboardEntry{
+			{AthleteID: 1, Name: "james", Rank: 1, RunStats: RunStats{Distance: 12345, Time: time.Hour, Count: 2}, Streak: 2},
+			{AthleteID: 2, Name: "broken", Err: errors.New("datastore is down")},
+		},
+		Total:  RunStats{Distance: 12345, Time: time.Hour, Count: 2},
+		Ranked: 1,
+	}
+	b, err := json.Marshal(NewAPILeaderboard(lb))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `{"period":"week","start_date":"2018-03-03","end_date":"2018-03-09","metric":"distance","activity_types":["Run"],"units":"metric",` +
+		`"entries":[{"rank":1,"athlete_id":1,"name":"james","distance_km":12.345,"elapsed_time_s":3600,"run_count":2,"longest_streak_days":2},` +
+		`{"athlete_id":2,"name":"broken","distance_km":0,"elapsed_time_s":0,"run_count":0,"longest_streak_days":0,"error":"datastore is down"}],` +
+		`"total":{"distance_km":12.345,"elapsed_time_s":3600,"run_count":2},"average":{"distance_km":12.345,"elapsed_time_s":3600,"run_count":2}}`
+	if string(b) != expected {
+		t.Errorf("Expected %s, got %s", expected, b)
+	}
+}
@@ -0,0 +1,105 @@
+//go:build appengine
+
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+
+	strava "github.com/strava/go.strava"
+	"google.golang.org/appengine/v2"
+	aelog "google.golang.org/appengine/v2/log"
+	"google.golang.org/appengine/v2/taskqueue"
+	"google.golang.org/appengine/v2/urlfetch"
+)
+
+// The App Engine adapter is only built with the appengine build tag, which
+// app.yaml sets, so that everything else doesn't need the App Engine SDK.
+// cmd/appengine serves it.
+
+// AppEngineEnv runs the app on App Engine as cfg says, keeping everything in
+// the datastore and talking to Strava through urlfetch. app.yaml only serves
+// it over HTTPS. It sets strava.ClientId and strava.ClientSecret.
+func AppEngineEnv(cfg *Config) *Env {
+	strava.ClientId = cfg.StravaClientID
+	strava.ClientSecret = cfg.StravaClientSecret
+	return &Env{
+		Store:          DatastoreStore{},
+		Context:        appEngineContext,
+		HTTPClient:     urlfetch.Client,
+		Admin:          appEngineAdmin(cfg.AdminToken),
+		BaseURL:        cfg.BaseURL,
+		HTTPS:          !appengine.IsDevAppServer(),
+		VerifyToken:    cfg.StravaVerifyToken,
+		SubscriptionID: int64(cfg.StravaSubscriptionID),
+		SessionKey:     []byte(cfg.SessionKey),
+		Invited:        cfg.InvitedAthletes,
+		Events:         taskQueue{},
+	}
+}
+
+// appEngineAdmin lets cron jobs and the task queue into the admin pages,
+// since App Engine marks their requests with headers that it strips from
+// everyone else's. Anyone else needs the admin token, as with RequireToken.
+func appEngineAdmin(token string) func(http.Handler) http.Handler {
+	requireToken := RequireToken(token)
+	return func(h http.Handler) http.Handler {
+		withToken := requireToken(h)
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Header.Get("X-Appengine-Cron") == "true" || r.Header.Get("X-Appengine-Queuename") != "" {
+				h.ServeHTTP(w, r)
+				return
+			}
+			withToken.ServeHTTP(w, r)
+		})
+	}
+}
+
+// taskQueue adds webhook events to App Engine's default push queue, which
+// posts them back to /tasks/webhook and retries them if they fail.
+type taskQueue struct{}
+
+// eventWindow is how long webhook events wait in the task queue. Events about
+// the same thing that arrive in the same window are only handled once.
+const eventWindow = time.Minute
+
+func (taskQueue) Add(ctx context.Context, ev *WebhookEvent) error {
+	b, err := json.Marshal(ev)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	window := now.Truncate(eventWindow)
+	task := taskqueue.NewPOSTTask("/tasks/webhook", url.Values{"event": {string(b)}})
+	// The queue only takes one task with each name.
+	task.Name = fmt.Sprintf("%s-%d", ev.key(), window.Unix())
+	task.Delay = window.Add(eventWindow).Sub(now)
+	_, err = taskqueue.Add(ctx, task, "")
+	if err == taskqueue.ErrTaskAlreadyAdded {
+		return nil
+	}
+	return err
+}
+
+// appEngineContext makes the context for handling r. It comes from App
+// Engine, which the datastore and urlfetch need, and logs to the request's
+// logs.
+func appEngineContext(r *http.Request) context.Context {
+	return WithLogger(appengine.NewContext(r), appEngineLogger{})
+}
+
+// appEngineLogger writes to App Engine's request logs. It needs a context
+// from appengine.NewContext.
+type appEngineLogger struct{}
+
+func (appEngineLogger) Infof(ctx context.Context, format string, args ...interface{}) {
+	aelog.Infof(ctx, format, args...)
+}
+
+func (appEngineLogger) Errorf(ctx context.Context, format string, args ...interface{}) {
+	aelog.Errorf(ctx, format, args...)
+}
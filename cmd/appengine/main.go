@@ -0,0 +1,24 @@
+//go:build appengine
+
+// Command appengine serves the app on App Engine, which builds it with the
+// appengine build tag as app.yaml says. Its settings come from app.yaml's
+// env_variables. Everywhere else, see cmd/jaju-running.
+package main
+
+import (
+	"log"
+	"net/http"
+	"os"
+
+	handlers "github.com/soulplant/jaju-running"
+	"google.golang.org/appengine/v2"
+)
+
+func main() {
+	cfg, err := handlers.LoadConfig(os.LookupEnv)
+	if err != nil {
+		log.Fatal(err)
+	}
+	http.Handle("/", handlers.NewHandler(handlers.AppEngineEnv(cfg)))
+	appengine.Main()
+}
@@ -0,0 +1,132 @@
+//go:build !appengine
+
+// Command jaju-running serves the app with a plain net/http server, for
+// running it in a container or on a laptop rather than on App Engine.
+//
+// Each setting can be given as a flag, as the environment variable named
+// after it, or in a YAML config file named by -config, in that order of
+// precedence. Secrets can be read from files instead, with the settings
+// ending in _file. Users' activities and profiles are synced from
+// Strava in the background, the way cron.yaml does it on App Engine.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	handlers "github.com/soulplant/jaju-running"
+	strava "github.com/strava/go.strava"
+)
+
+// stravaTimeout is how long each attempt at a request to Strava may take.
+const stravaTimeout = 30 * time.Second
+
+func main() {
+	flag.String("config", "", "YAML file to read settings from ($CONFIG)")
+	for _, s := range handlers.Settings {
+		flag.String(s.Key(), "", fmt.Sprintf("%s ($%s)", s.Usage, s.Name))
+		if s.Secret {
+			flag.String(s.Key()+"_file", "", fmt.Sprintf("file to read %s from ($%s_FILE)", s.Key(), s.Name))
+		}
+	}
+	flag.Parse()
+	flags := map[string]string{}
+	flag.Visit(func(f *flag.Flag) {
+		flags[f.Name] = f.Value.String()
+	})
+	cfg, err := handlers.LoadConfig(func(name string) (string, bool) {
+		if v, ok := flags[strings.ToLower(name)]; ok {
+			return v, true
+		}
+		return os.LookupEnv(name)
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	strava.ClientId = cfg.StravaClientID
+	strava.ClientSecret = cfg.StravaClientSecret
+
+	store, err := openStore(cfg)
+	if err != nil {
+		log.Fatalf("Failed to open %s storage: %s", cfg.Storage, err)
+	}
+	// A slow or stuck request to Strava shouldn't hold up a sync for good.
+	client := &http.Client{Timeout: stravaTimeout}
+	env := &handlers.Env{
+		Store:          store,
+		HTTPClient:     func(context.Context) *http.Client { return client },
+		Admin:          handlers.RequireToken(cfg.AdminToken),
+		BaseURL:        cfg.BaseURL,
+		VerifyToken:    cfg.StravaVerifyToken,
+		SubscriptionID: int64(cfg.StravaSubscriptionID),
+		SessionKey:     []byte(cfg.SessionKey),
+		Invited:        cfg.InvitedAthletes,
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	go every(ctx, cfg.SyncEvery, "Sync", func(now time.Time) error {
+		return handlers.SyncAll(ctx, store, client, handlers.IncrementalSync, now)
+	})
+	go every(ctx, cfg.FullSyncEvery, "Full sync", func(now time.Time) error {
+		return handlers.SyncAll(ctx, store, client, handlers.FullSync, now)
+	})
+	go every(ctx, cfg.ProfilesEvery, "Profile refresh", func(now time.Time) error {
+		return handlers.RefreshAllProfiles(ctx, store, client, now)
+	})
+
+	srv := &http.Server{
+		Addr:              fmt.Sprintf(":%d", cfg.Port),
+		Handler:           handlers.NewHandler(env),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		srv.Shutdown(shutdownCtx) // nolint: errcheck
+	}()
+	log.Printf("Listening on %s", srv.Addr)
+	if err := srv.ListenAndServe(); err != http.ErrServerClosed {
+		log.Fatal(err)
+	}
+}
+
+// openStore opens the storage backend the config asks for.
+func openStore(cfg *handlers.Config) (handlers.Store, error) {
+	switch cfg.Storage {
+	case "sqlite":
+		return handlers.OpenSQLiteStore(cfg.DB)
+	case "memory":
+		return handlers.NewMemoryStore(), nil
+	}
+	return nil, fmt.Errorf("unknown storage %q", cfg.Storage)
+}
+
+// every runs job every interval until ctx is done, logging its failures
+// under name.
+func every(ctx context.Context, interval time.Duration, name string, job func(now time.Time) error) {
+	if interval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			if err := job(now); err != nil {
+				log.Printf("%s failed: %s", name, err)
+			}
+		}
+	}
+}
@@ -0,0 +1,270 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+// Config is how the app is set up. See Settings for what each field does.
+type Config struct {
+	Port                 int
+	StravaClientID       int
+	StravaClientSecret   string
+	StravaVerifyToken    string
+	StravaSubscriptionID int
+	BaseURL              string
+	Storage              string
+	DB                   string
+	AdminToken           string
+	SessionKey           string
+	InvitedAthletes      []int64
+	SyncEvery            time.Duration
+	FullSyncEvery        time.Duration
+	ProfilesEvery        time.Duration
+}
+
+// DefaultConfig is what's used for the settings that aren't given.
+var DefaultConfig = Config{
+	Port:          8080,
+	Storage:       "sqlite",
+	DB:            "jaju.db",
+	SyncEvery:     time.Hour,
+	FullSyncEvery: 24 * time.Hour,
+	ProfilesEvery: 24 * time.Hour,
+}
+
+// Setting is one thing that can be configured.
+type Setting struct {
+	// The environment variable it's read from. Its key in a config file,
+	// and its flag, are this in lower case.
+	Name  string
+	Usage string
+
+	// Whether the setting can be read from a file instead, named by the
+	// setting with _FILE after its name, so that it doesn't have to be
+	// written into the config or the environment.
+	Secret bool
+
+	set func(c *Config, v string) error
+}
+
+// Key is the setting's name in a config file and as a flag.
+func (s Setting) Key() string {
+	return strings.ToLower(s.Name)
+}
+
+// configFileSetting names the YAML file that settings are read from.
+const configFileSetting = "CONFIG"
+
+// Settings are the things that can be configured.
+var Settings = []Setting{
+	{Name: "PORT", Usage: "port for the standalone server to listen on", set: func(c *Config, v string) error {
+		return setInt(&c.Port, v)
+	}},
+	{Name: "STRAVA_CLIENT_ID", Usage: "the app's Strava API client ID", set: func(c *Config, v string) error {
+		return setInt(&c.StravaClientID, v)
+	}},
+	{Name: "STRAVA_CLIENT_SECRET", Usage: "the app's Strava API client secret", Secret: true, set: func(c *Config, v string) error {
+		c.StravaClientSecret = v
+		return nil
+	}},
+	{Name: "STRAVA_VERIFY_TOKEN", Usage: "a token of your choosing to give Strava when subscribing to its webhook events", Secret: true, set: func(c *Config, v string) error {
+		c.StravaVerifyToken = v
+		return nil
+	}},
+	{Name: "STRAVA_SUBSCRIPTION_ID", Usage: "the ID Strava gives the webhook subscription, without which webhook events are turned away", set: func(c *Config, v string) error {
+		return setInt(&c.StravaSubscriptionID, v)
+	}},
+	{Name: "BASE_URL", Usage: "where the app is served from, like https://example.com, which Strava sends users back to; by default it's worked out from each request", set: func(c *Config, v string) error {
+		c.BaseURL = strings.TrimSuffix(v, "/")
+		return nil
+	}},
+	{Name: "STORAGE", Usage: "where the standalone server keeps data: sqlite or memory", set: func(c *Config, v string) error {
+		c.Storage = v
+		return nil
+	}},
+	{Name: "DB", Usage: "the SQLite database file", set: func(c *Config, v string) error {
+		c.DB = v
+		return nil
+	}},
+	{Name: "ADMIN_TOKEN", Usage: "bearer token for the /admin/ and /tasks/ pages, which are off without one apart from App Engine's cron jobs and task queue", Secret: true, set: func(c *Config, v string) error {
+		c.AdminToken = v
+		return nil
+	}},
+	{Name: "SESSION_KEY", Usage: "a random string of at least 32 characters to sign login cookies with", Secret: true, set: func(c *Config, v string) error {
+		c.SessionKey = v
+		return nil
+	}},
+	{Name: "INVITED_ATHLETES", Usage: "comma separated Strava athlete IDs of the people who may join the group by connecting Strava", set: func(c *Config, v string) error {
+		return setIDs(&c.InvitedAthletes, v)
+	}},
+	{Name: "SYNC_EVERY", Usage: "how often the standalone server syncs new activities, or 0 not to", set: func(c *Config, v string) error {
+		return setDuration(&c.SyncEvery, v)
+	}},
+	{Name: "FULL_SYNC_EVERY", Usage: "how often the standalone server resyncs everything to pick up edits and deletions, or 0 not to", set: func(c *Config, v string) error {
+		return setDuration(&c.FullSyncEvery, v)
+	}},
+	{Name: "PROFILES_EVERY", Usage: "how often the standalone server refreshes users' Strava profiles, or 0 not to", set: func(c *Config, v string) error {
+		return setDuration(&c.ProfilesEvery, v)
+	}},
+}
+
+func setInt(dst *int, v string) error {
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		return errors.New("must be a whole number")
+	}
+	*dst = n
+	return nil
+}
+
+func setIDs(dst *[]int64, v string) error {
+	var ids []int64
+	for _, s := range strings.Split(v, ",") {
+		if s = strings.TrimSpace(s); s == "" {
+			continue
+		}
+		id, err := strconv.ParseInt(s, 10, 64)
+		if err != nil || id <= 0 {
+			return errors.New("must be a comma separated list of Strava athlete IDs")
+		}
+		ids = append(ids, id)
+	}
+	*dst = ids
+	return nil
+}
+
+func setDuration(dst *time.Duration, v string) error {
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		return errors.New("must be a duration like 1h30m")
+	}
+	*dst = d
+	return nil
+}
+
+// LoadConfig loads the config. lookup gets a setting by its Name, and
+// usually reads the environment, like os.LookupEnv. Settings that it
+// doesn't have are read from the YAML file named by CONFIG, if there is one,
+// and otherwise take their value from DefaultConfig. Secret settings can
+// instead be read from the file named by their _FILE setting, in which case
+// surrounding whitespace is trimmed. Everything wrong with the config is
+// reported at once.
+func LoadConfig(lookup func(string) (string, bool)) (*Config, error) {
+	file := map[string]string{}
+	if path, ok := lookup(configFileSetting); ok && path != "" {
+		var err error
+		if file, err = readConfigFile(path); err != nil {
+			return nil, err
+		}
+	}
+	get := func(name string) (string, bool) {
+		if v, ok := lookup(name); ok {
+			return v, true
+		}
+		v, ok := file[strings.ToLower(name)]
+		return v, ok
+	}
+
+	cfg := DefaultConfig
+	var errs []error
+	for _, s := range Settings {
+		v, ok := get(s.Name)
+		if s.Secret {
+			path, fromFile := get(s.Name + "_FILE")
+			if ok && fromFile {
+				errs = append(errs, fmt.Errorf("%s and %s_FILE can't both be set", s.Name, s.Name))
+				continue
+			}
+			if fromFile {
+				b, err := ioutil.ReadFile(path)
+				if err != nil {
+					errs = append(errs, fmt.Errorf("%s_FILE: %w", s.Name, err))
+					continue
+				}
+				v, ok = strings.TrimSpace(string(b)), true
+			}
+		}
+		if !ok {
+			continue
+		}
+		if err := s.set(&cfg, v); err != nil {
+			errs = append(errs, fmt.Errorf("%s %w, not %q", s.Name, err, v))
+		}
+	}
+	errs = append(errs, cfg.validate()...)
+	if len(errs) > 0 {
+		return nil, fmt.Errorf("invalid config: %w", errors.Join(errs...))
+	}
+	return &cfg, nil
+}
+
+// readConfigFile reads a YAML file of settings, keyed by their names in
+// lower case.
+func readConfigFile(path string) (map[string]string, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var settings map[string]string
+	if err := yaml.UnmarshalStrict(b, &settings); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	known := map[string]bool{}
+	for _, s := range Settings {
+		known[s.Key()] = true
+		if s.Secret {
+			known[s.Key()+"_file"] = true
+		}
+	}
+	for k := range settings {
+		if !known[k] {
+			return nil, fmt.Errorf("%s: unknown setting %q", path, k)
+		}
+	}
+	return settings, nil
+}
+
+// minSessionKeyLength is the shortest SESSION_KEY that's accepted, so that
+// login cookies can't be forged by guessing it.
+const minSessionKeyLength = 32
+
+// validate checks that the settings make sense together.
+func (c *Config) validate() []error {
+	var errs []error
+	if c.StravaClientID <= 0 {
+		errs = append(errs, errors.New("STRAVA_CLIENT_ID must be set"))
+	}
+	if c.StravaClientSecret == "" {
+		errs = append(errs, errors.New("STRAVA_CLIENT_SECRET or STRAVA_CLIENT_SECRET_FILE must be set"))
+	}
+	if len(c.SessionKey) < minSessionKeyLength {
+		errs = append(errs, fmt.Errorf("SESSION_KEY or SESSION_KEY_FILE must be set to at least %d characters", minSessionKeyLength))
+	}
+	if c.Port <= 0 || c.Port > 65535 {
+		errs = append(errs, fmt.Errorf("PORT must be between 1 and 65535, not %d", c.Port))
+	}
+	if c.BaseURL != "" {
+		u, err := url.Parse(c.BaseURL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			errs = append(errs, fmt.Errorf("BASE_URL must be an http or https URL, not %q", c.BaseURL))
+		}
+	}
+	if c.Storage != "sqlite" && c.Storage != "memory" {
+		errs = append(errs, fmt.Errorf("STORAGE must be sqlite or memory, not %q", c.Storage))
+	}
+	if c.Storage == "sqlite" && c.DB == "" {
+		errs = append(errs, errors.New("DB must be set to use sqlite"))
+	}
+	if c.SyncEvery < 0 || c.FullSyncEvery < 0 || c.ProfilesEvery < 0 {
+		errs = append(errs, errors.New("SYNC_EVERY, FULL_SYNC_EVERY and PROFILES_EVERY can't be negative"))
+	}
+	return errs
+}
@@ -0,0 +1,112 @@
+package handlers
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// lookupMap makes a LoadConfig lookup from a map of settings.
+func lookupMap(m map[string]string) func(string) (string, bool) {
+	return func(name string) (string, bool) {
+		v, ok := m[name]
+		return v, ok
+	}
+}
+
+func TestLoadConfig(t *testing.T) {
+	dir := t.TempDir()
+	secret := filepath.Join(dir, "secret")
+	if err := ioutil.WriteFile(secret, []byte("shh\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	file := filepath.Join(dir, "config.yaml")
+	yaml := "strava_client_id: 123\nport: 9000\nstorage: memory\nstrava_client_secret_file: " + secret + "\nsession_key: " + testSessionKey + "\n"
+	if err := ioutil.WriteFile(file, []byte(yaml), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	// The environment wins over the file.
+	cfg, err := LoadConfig(lookupMap(map[string]string{
+		"CONFIG":     file,
+		"PORT":       "8000",
+		"BASE_URL":   "https://example.com/",
+		"SYNC_EVERY": "30m",
+
+		"INVITED_ATHLETES": "12, 34",
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := DefaultConfig
+	expected.Port = 8000
+	expected.StravaClientID = 123
+	expected.StravaClientSecret = "shh"
+	expected.SessionKey = testSessionKey
+	expected.BaseURL = "https://example.com"
+	expected.Storage = "memory"
+	expected.SyncEvery = 30 * time.Minute
+	expected.InvitedAthletes = []int64{12, 34}
+	if !reflect.DeepEqual(cfg, &expected) {
+		t.Errorf("Expected %+v, got %+v", expected, cfg)
+	}
+
+	for _, tc := range []struct {
+		settings map[string]string
+		expected []string
+	}{
+		{map[string]string{}, []string{"STRAVA_CLIENT_ID must be set", "STRAVA_CLIENT_SECRET or STRAVA_CLIENT_SECRET_FILE must be set", "SESSION_KEY or SESSION_KEY_FILE must be set"}},
+		{map[string]string{"STRAVA_CLIENT_ID": "1", "STRAVA_CLIENT_SECRET": "s", "SESSION_KEY": "short"}, []string{"at least 32 characters"}},
+		{map[string]string{"STRAVA_CLIENT_ID": "abc", "STRAVA_CLIENT_SECRET": "s", "PORT": "0"}, []string{`STRAVA_CLIENT_ID must be a whole number, not "abc"`, "PORT must be between 1 and 65535"}},
+		{map[string]string{"STRAVA_CLIENT_ID": "1", "STRAVA_CLIENT_SECRET": "s", "STRAVA_CLIENT_SECRET_FILE": secret}, []string{"can't both be set"}},
+		{map[string]string{"STRAVA_CLIENT_ID": "1", "STRAVA_CLIENT_SECRET_FILE": filepath.Join(dir, "missing")}, []string{"STRAVA_CLIENT_SECRET_FILE: open"}},
+		{map[string]string{"STRAVA_CLIENT_ID": "1", "STRAVA_CLIENT_SECRET": "s", "BASE_URL": "example.com", "STORAGE": "postgres", "SYNC_EVERY": "-1h"}, []string{"BASE_URL must be", "STORAGE must be", "can't be negative"}},
+		{map[string]string{"STRAVA_CLIENT_ID": "1", "STRAVA_CLIENT_SECRET": "s", "INVITED_ATHLETES": "12,bob"}, []string{"INVITED_ATHLETES must be a comma separated list"}},
+		{map[string]string{"CONFIG": filepath.Join(dir, "missing.yaml")}, []string{"missing.yaml"}},
+	} {
+		_, err := LoadConfig(lookupMap(tc.settings))
+		if err == nil {
+			t.Errorf("%v: expected an error", tc.settings)
+			continue
+		}
+		for _, e := range tc.expected {
+			if !strings.Contains(err.Error(), e) {
+				t.Errorf("%v: expected %q in %q", tc.settings, e, err)
+			}
+		}
+	}
+
+	if err := ioutil.WriteFile(file, []byte("strava_secret: oops\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadConfig(lookupMap(map[string]string{"CONFIG": file})); err == nil || !strings.Contains(err.Error(), `unknown setting "strava_secret"`) {
+		t.Errorf("Expected an unknown setting, got %v", err)
+	}
+}
+
+func TestBaseURL(t *testing.T) {
+	plain := httptest.NewRequest("GET", "http://localhost:8080/", nil)
+	proxied := httptest.NewRequest("GET", "http://staging.example.com/", nil)
+	proxied.Header.Set("X-Forwarded-Proto", "https")
+	secure := httptest.NewRequest("GET", "https://example.com/", nil)
+	for _, tc := range []struct {
+		env      Env
+		r        *http.Request
+		expected string
+	}{
+		{Env{}, plain, "http://localhost:8080"},
+		{Env{}, proxied, "https://staging.example.com"},
+		{Env{}, secure, "https://example.com"},
+		{Env{HTTPS: true}, plain, "https://localhost:8080"},
+		{Env{BaseURL: "https://jaju.example.com"}, plain, "https://jaju.example.com"},
+	} {
+		if actual := tc.env.baseURL(tc.r); actual != tc.expected {
+			t.Errorf("%+v, %s: expected %s, got %s", tc.env, tc.r.URL, tc.expected, actual)
+		}
+	}
+}
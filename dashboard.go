@@ -0,0 +1,180 @@
+package handlers
+
+import (
+	"net/http"
+	"time"
+)
+
+// registerDashboardHandlers sets up the pages where users manage their own
+// data:
+//
+//	GET /me
+//	    The logged in user's own history, with forms for the others.
+//	POST /me/plan
+//	    Replaces the logged in user's training plan. Takes the same form
+//	    as /admin/plan, without the athlete_id.
+//	POST /me/api_token
+//	    Makes the logged in user a new API token, revoking their old one,
+//	    and shows it on their dashboard. It can't be seen again after that.
+//	POST /me/api_token/revoke
+//	    Revokes the logged in user's API token.
+//	POST /me/disconnect
+//	    Disconnects the logged in user, deleting everything kept about
+//	    them, and logs them out.
+//	POST /logout
+//	    Logs the user out.
+//
+// The POSTs have to carry the session's CSRF token.
+func registerDashboardHandlers(mux *http.ServeMux, env *Env) {
+	store := env.Store
+
+	// dashboard shows the user their own page, with their new API token if
+	// they've just made one.
+	dashboard := func(w http.ResponseWriter, r *http.Request, me *User, s *Session, apiToken string) {
+		opts, err := historyOptionsParam(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		args := mainTplArgs{Me: me, CSRFToken: csrfToken(env.SessionKey, s), APIToken: apiToken, Query: r.URL.Query()}
+		args.Umt = LoadUserHistory(env.context(r), store, []User{*me}, opts)
+		if err := dashboardTpl.Execute(w, args); err != nil {
+			handleError(w, err)
+			return
+		}
+	}
+
+	mux.HandleFunc("/me", func(w http.ResponseWriter, r *http.Request) {
+		me, s, err := env.member(r)
+		if err != nil {
+			env.denyPage(w, r, err)
+			return
+		}
+		dashboard(w, r, me, s, "")
+	})
+
+	mux.HandleFunc("/me/plan", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		ctx := env.context(r)
+		me, s, err := env.member(r)
+		if err != nil {
+			env.denyPage(w, r, err)
+			return
+		}
+		if err := env.checkCSRF(r, s); err != nil {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+		plan, err := readPlanForm(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := store.PutTrainingPlan(ctx, me.ID, plan); err != nil {
+			handleError(w, err)
+			return
+		}
+		http.Redirect(w, r, "/me", http.StatusSeeOther)
+	})
+
+	mux.HandleFunc("/me/api_token", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		ctx := env.context(r)
+		me, s, err := env.member(r)
+		if err != nil {
+			env.denyPage(w, r, err)
+			return
+		}
+		if err := env.checkCSRF(r, s); err != nil {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+		token, hash, err := newAPIToken(me.ID)
+		if err != nil {
+			handleError(w, err)
+			return
+		}
+		me, err = store.UpdateUser(ctx, me.ID, func(u *User) error {
+			u.APITokenHash, u.APITokenCreated = hash, time.Now()
+			return nil
+		})
+		if err != nil {
+			handleError(w, err)
+			return
+		}
+		dashboard(w, r, me, s, token)
+	})
+
+	mux.HandleFunc("/me/api_token/revoke", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		ctx := env.context(r)
+		me, s, err := env.member(r)
+		if err != nil {
+			env.denyPage(w, r, err)
+			return
+		}
+		if err := env.checkCSRF(r, s); err != nil {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+		_, err = store.UpdateUser(ctx, me.ID, func(u *User) error {
+			u.APITokenHash, u.APITokenCreated = "", time.Time{}
+			return nil
+		})
+		if err != nil {
+			handleError(w, err)
+			return
+		}
+		http.Redirect(w, r, "/me", http.StatusSeeOther)
+	})
+
+	mux.HandleFunc("/me/disconnect", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		ctx := env.context(r)
+		me, s, err := env.member(r)
+		if err != nil {
+			env.denyPage(w, r, err)
+			return
+		}
+		if err := env.checkCSRF(r, s); err != nil {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+		if err := DisconnectUser(env.oauthContext(ctx), store, env.client(ctx), me.ID, "member", time.Now()); err != nil {
+			handleError(w, err)
+			return
+		}
+		env.clearSession(w, r)
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+	})
+
+	mux.HandleFunc("/logout", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		_, s, err := env.member(r)
+		if err != nil {
+			env.denyPage(w, r, err)
+			return
+		}
+		if err := env.checkCSRF(r, s); err != nil {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+		env.clearSession(w, r)
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+	})
+}
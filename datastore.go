@@ -1,37 +1,221 @@
+//go:build appengine
+
 package handlers
 
 import (
 	"context"
+	"time"
 
 	strava "github.com/strava/go.strava"
-	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/v2/datastore"
 )
 
+// DatastoreStore is a Store that keeps everything in App Engine's datastore.
+// Each user is an entity keyed by their athlete id, with their activities,
+// sync state and training plan as its children. It needs a context from
+// appengine.NewContext.
+type DatastoreStore struct{}
+
 // userKey is a key based on strava's athlete id.
 func userKey(ctx context.Context, id int64) *datastore.Key {
 	return datastore.NewKey(ctx, "User", "", id, nil)
 }
 
-// RegisterNewUser saves a new user's Strava token and basic details in the datastore.
-func RegisterNewUser(ctx context.Context, auth *strava.AuthorizationResponse) (*User, error) {
-	user := User{
-		FirstName:   auth.Athlete.FirstName,
-		LastName:    auth.Athlete.LastName,
-		StravaToken: auth.AccessToken,
+func (DatastoreStore) GetUsers(ctx context.Context) ([]User, error) {
+	result := make([]User, 0)
+	keys, err := datastore.NewQuery("User").Order("FirstName").GetAll(ctx, &result)
+	if err != nil {
+		return nil, err
+	}
+	for i, k := range keys {
+		result[i].ID = k.IntID()
+	}
+	return result, nil
+}
+
+func (DatastoreStore) GetUser(ctx context.Context, id int64) (*User, error) {
+	var user User
+	err := datastore.Get(ctx, userKey(ctx, id), &user)
+	if err == datastore.ErrNoSuchEntity {
+		return nil, ErrNoSuchUser
 	}
-	_, err := datastore.Put(ctx, userKey(ctx, auth.Athlete.Id), &user)
 	if err != nil {
 		return nil, err
 	}
+	user.ID = id
 	return &user, nil
 }
 
-// GetUsers fetches all users from the datastore.
-func GetUsers(ctx context.Context) ([]User, error) {
-	result := make([]User, 0)
-	_, err := datastore.NewQuery("User").Order("FirstName").GetAll(ctx, &result)
+func (DatastoreStore) PutUser(ctx context.Context, u *User) error {
+	_, err := datastore.Put(ctx, userKey(ctx, u.ID), u)
+	return err
+}
+
+func (DatastoreStore) UpdateUser(ctx context.Context, id int64, update func(u *User) error) (*User, error) {
+	var user User
+	err := datastore.RunInTransaction(ctx, func(tc context.Context) error {
+		user = User{}
+		key := userKey(tc, id)
+		err := datastore.Get(tc, key, &user)
+		if err == datastore.ErrNoSuchEntity {
+			return ErrNoSuchUser
+		}
+		if err != nil {
+			return err
+		}
+		user.ID = id
+		if err := update(&user); err != nil {
+			return err
+		}
+		_, err = datastore.Put(tc, key, &user)
+		return err
+	}, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+func (DatastoreStore) DeleteUser(ctx context.Context, id int64) error {
+	// Everything kept about the user is under their key.
+	keys, err := datastore.NewQuery("").Ancestor(userKey(ctx, id)).KeysOnly().GetAll(ctx, nil)
+	if err != nil {
+		return err
+	}
+	for len(keys) > 0 {
+		n := len(keys)
+		if n > maxBatchSize {
+			n = maxBatchSize
+		}
+		if err := datastore.DeleteMulti(ctx, keys[:n]); err != nil {
+			return err
+		}
+		keys = keys[n:]
+	}
+	return nil
+}
+
+// activityKey is a key based on strava's activity id, under the owning user.
+func activityKey(ctx context.Context, user int64, id int64) *datastore.Key {
+	return datastore.NewKey(ctx, "Activity", "", id, userKey(ctx, user))
+}
+
+// maxBatchSize is the most entities datastore will accept in one batch call.
+const maxBatchSize = 500
+
+func (DatastoreStore) PutActivities(ctx context.Context, user int64, acts []*strava.ActivitySummary) error {
+	for len(acts) > 0 {
+		n := len(acts)
+		if n > maxBatchSize {
+			n = maxBatchSize
+		}
+		keys := make([]*datastore.Key, n)
+		entities := make([]*Activity, n)
+		for i, act := range acts[:n] {
+			keys[i] = activityKey(ctx, user, act.Id)
+			entities[i] = NewActivity(act)
+		}
+		if _, err := datastore.PutMulti(ctx, keys, entities); err != nil {
+			return err
+		}
+		acts = acts[n:]
+	}
+	return nil
+}
+
+func (DatastoreStore) DeleteActivities(ctx context.Context, user int64, ids []int64) error {
+	for len(ids) > 0 {
+		n := len(ids)
+		if n > maxBatchSize {
+			n = maxBatchSize
+		}
+		keys := make([]*datastore.Key, n)
+		for i, id := range ids[:n] {
+			keys[i] = activityKey(ctx, user, id)
+		}
+		if err := datastore.DeleteMulti(ctx, keys); err != nil {
+			return err
+		}
+		ids = ids[n:]
+	}
+	return nil
+}
+
+func (DatastoreStore) GetActivityIDs(ctx context.Context, user int64, after time.Time) ([]int64, error) {
+	keys, err := datastore.NewQuery("Activity").Ancestor(userKey(ctx, user)).Filter("StartDate >", after).Order("StartDate").KeysOnly().GetAll(ctx, nil)
 	if err != nil {
 		return nil, err
 	}
+	ids := make([]int64, len(keys))
+	for i, k := range keys {
+		ids[i] = k.IntID()
+	}
+	return ids, nil
+}
+
+func (DatastoreStore) GetActivities(ctx context.Context, user int64) ([]*strava.ActivitySummary, error) {
+	var acts []*Activity
+	keys, err := datastore.NewQuery("Activity").Ancestor(userKey(ctx, user)).Order("StartDate").GetAll(ctx, &acts)
+	if err != nil {
+		return nil, err
+	}
+	result := make([]*strava.ActivitySummary, len(acts))
+	for i, a := range acts {
+		result[i] = a.Summary(keys[i].IntID())
+	}
+	return result, nil
+}
+
+// syncStateKey is the key of the user's sync state.
+func syncStateKey(ctx context.Context, user int64) *datastore.Key {
+	return datastore.NewKey(ctx, "SyncState", "", 1, userKey(ctx, user))
+}
+
+func (DatastoreStore) GetSyncState(ctx context.Context, user int64) (*SyncState, error) {
+	var state SyncState
+	err := datastore.Get(ctx, syncStateKey(ctx, user), &state)
+	if err != nil && err != datastore.ErrNoSuchEntity {
+		return nil, err
+	}
+	return &state, nil
+}
+
+func (DatastoreStore) PutSyncState(ctx context.Context, user int64, state *SyncState) error {
+	_, err := datastore.Put(ctx, syncStateKey(ctx, user), state)
+	return err
+}
+
+// trainingPlanKey is the key of the user's training plan.
+func trainingPlanKey(ctx context.Context, user int64) *datastore.Key {
+	return datastore.NewKey(ctx, "TrainingPlan", "", 1, userKey(ctx, user))
+}
+
+func (DatastoreStore) GetTrainingPlan(ctx context.Context, user int64) (*TrainingPlan, error) {
+	var plan TrainingPlan
+	err := datastore.Get(ctx, trainingPlanKey(ctx, user), &plan)
+	if err == datastore.ErrNoSuchEntity {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &plan, nil
+}
+
+func (DatastoreStore) PutTrainingPlan(ctx context.Context, user int64, plan *TrainingPlan) error {
+	_, err := datastore.Put(ctx, trainingPlanKey(ctx, user), plan)
+	return err
+}
+
+func (DatastoreStore) AddAuditEntry(ctx context.Context, e *AuditEntry) error {
+	_, err := datastore.Put(ctx, datastore.NewIncompleteKey(ctx, "AuditEntry", nil), e)
+	return err
+}
+
+func (DatastoreStore) GetAuditLog(ctx context.Context) ([]AuditEntry, error) {
+	result := make([]AuditEntry, 0)
+	if _, err := datastore.NewQuery("AuditEntry").Order("Time").GetAll(ctx, &result); err != nil {
+		return nil, err
+	}
 	return result, nil
 }
@@ -0,0 +1,30 @@
+//go:build appengine
+
+package handlers
+
+import (
+	"os/exec"
+	"testing"
+
+	"google.golang.org/appengine/v2"
+	"google.golang.org/appengine/v2/aetest"
+)
+
+func TestDatastoreStore(t *testing.T) {
+	if _, err := exec.LookPath("dev_appserver.py"); err != nil {
+		t.Skip("needs the App Engine SDK")
+	}
+	inst, err := aetest.NewInstance(&aetest.Options{
+		StronglyConsistentDatastore: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer inst.Close() // nolint: errcheck
+	req, err := inst.NewRequest("GET", "/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testStore(t, appengine.NewContext(req), DatastoreStore{})
+}
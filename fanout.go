@@ -0,0 +1,63 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"sync"
+)
+
+// Result is the outcome of one call made by FanOut.
+type Result[R any] struct {
+	Value R
+	Err   error
+}
+
+// FanOut calls f on each of the inputs concurrently, with at most limit calls
+// in flight at once. A limit of zero or less means no limit. The results are
+// in the same order as the inputs.
+//
+// A call that panics produces an error instead of crashing the process. Once
+// ctx is done no new calls are started and the remaining inputs get ctx's
+// error; calls that are already running are passed ctx so they can stop
+// early. FanOut always waits for every call it started before returning.
+func FanOut[T, R any](ctx context.Context, limit int, inputs []T, f func(context.Context, T) (R, error)) []Result[R] {
+	if limit <= 0 || limit > len(inputs) {
+		limit = len(inputs)
+	}
+	results := make([]Result[R], len(inputs))
+	sem := make(chan struct{}, limit)
+	var wg sync.WaitGroup
+	for i, in := range inputs {
+		// Check first, as select doesn't prefer the done case when a slot
+		// is also free.
+		if err := ctx.Err(); err != nil {
+			results[i].Err = err
+			continue
+		}
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+			results[i].Err = ctx.Err()
+			continue
+		}
+		wg.Add(1)
+		go func(i int, in T) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			defer func() {
+				if r := recover(); r != nil {
+					results[i] = Result[R]{Err: fmt.Errorf("panic: %v", r)}
+				}
+			}()
+			// ctx may have finished while this call was waiting for a slot.
+			if err := ctx.Err(); err != nil {
+				results[i].Err = err
+				return
+			}
+			v, err := f(ctx, in)
+			results[i] = Result[R]{v, err}
+		}(i, in)
+	}
+	wg.Wait()
+	return results
+}
@@ -0,0 +1,111 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestFanOutOrder(t *testing.T) {
+	inputs := []int{5, 1, 4, 2, 3, 0}
+	results := FanOut(context.Background(), 2, inputs, func(ctx context.Context, n int) (int, error) {
+		// Finish in a different order to the one the inputs were given in.
+		time.Sleep(time.Duration(n) * time.Millisecond)
+		return -n, nil
+	})
+	var values []int
+	for _, r := range results {
+		if r.Err != nil {
+			t.Fatal(r.Err)
+		}
+		values = append(values, r.Value)
+	}
+	if expected := []int{-5, -1, -4, -2, -3, 0}; !reflect.DeepEqual(values, expected) {
+		t.Errorf("Expected %v, got %v", expected, values)
+	}
+}
+
+func TestFanOutLimit(t *testing.T) {
+	for _, limit := range []int{1, 3, 0} {
+		var running, most int32
+		FanOut(context.Background(), limit, make([]int, 10), func(ctx context.Context, _ int) (struct{}, error) {
+			n := atomic.AddInt32(&running, 1)
+			defer atomic.AddInt32(&running, -1)
+			for {
+				m := atomic.LoadInt32(&most)
+				if n <= m || atomic.CompareAndSwapInt32(&most, m, n) {
+					break
+				}
+			}
+			time.Sleep(5 * time.Millisecond)
+			return struct{}{}, nil
+		})
+		if limit > 0 && int(most) > limit {
+			t.Errorf("Limit %d: had %d calls running at once", limit, most)
+		}
+		if limit > 1 && most < 2 {
+			t.Errorf("Limit %d: expected calls to run concurrently", limit)
+		}
+	}
+}
+
+func TestFanOutErrorsAndPanics(t *testing.T) {
+	results := FanOut(context.Background(), 2, []string{"ok", "fail", "panic", "ok"}, func(ctx context.Context, s string) (string, error) {
+		switch s {
+		case "fail":
+			return "", errors.New("failed")
+		case "panic":
+			panic("oh no")
+		}
+		return s, nil
+	})
+	if results[0].Err != nil || results[0].Value != "ok" || results[3].Err != nil || results[3].Value != "ok" {
+		t.Errorf("Expected other calls to succeed, got %v", results)
+	}
+	if results[1].Err == nil || results[1].Err.Error() != "failed" {
+		t.Errorf("Expected an error, got %v", results[1])
+	}
+	if results[2].Err == nil || !strings.Contains(results[2].Err.Error(), "oh no") {
+		t.Errorf("Expected the panic to become an error, got %v", results[2])
+	}
+}
+
+func TestFanOutCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	var started int32
+	results := FanOut(ctx, 2, make([]int, 10), func(ctx context.Context, _ int) (int, error) {
+		if atomic.AddInt32(&started, 1) == 2 {
+			cancel()
+		}
+		<-ctx.Done()
+		return 0, ctx.Err()
+	})
+	if started != 2 {
+		t.Errorf("Expected no calls to start after cancelling, but %d started", started)
+	}
+	for i, r := range results {
+		if r.Err != context.Canceled {
+			t.Errorf("Result %d: expected %v, got %v", i, context.Canceled, r.Err)
+		}
+	}
+
+	results = FanOut(ctx, 0, []int{1}, func(ctx context.Context, n int) (int, error) {
+		t.Error("Didn't expect a call with an already cancelled context")
+		return n, nil
+	})
+	if results[0].Err != context.Canceled {
+		t.Errorf("Expected %v, got %v", context.Canceled, results[0].Err)
+	}
+}
+
+func TestFanOutEmpty(t *testing.T) {
+	if results := FanOut(context.Background(), 3, []int(nil), func(ctx context.Context, n int) (int, error) {
+		return n, nil
+	}); len(results) != 0 {
+		t.Errorf("Expected no results, got %v", results)
+	}
+}
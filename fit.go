@@ -0,0 +1,223 @@
+package handlers
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"time"
+
+	strava "github.com/strava/go.strava"
+)
+
+// FIT is Garmin's binary activity file format. Only as much of it is decoded
+// here as it takes to read the summary a device records for each session:
+// see the FIT SDK's protocol description and profile for the details.
+
+// fitEpoch is when FIT timestamps count from.
+var fitEpoch = time.Date(1989, 12, 31, 0, 0, 0, 0, time.UTC)
+
+// Global message numbers and fields from the FIT profile.
+const (
+	fitSessionMsg  = 18
+	fitActivityMsg = 34
+
+	// Session fields.
+	fitStartTime        = 2
+	fitSport            = 5
+	fitSubSport         = 6
+	fitTotalElapsedTime = 7 // milliseconds
+	fitTotalTimerTime   = 8 // milliseconds
+	fitTotalDistance    = 9 // centimetres
+	fitTotalAscent      = 22
+
+	// Activity fields.
+	fitLocalTimestamp = 5
+	fitTimestamp      = 253
+)
+
+// fitSports maps FIT sport and sub sport pairs to Strava activity types. A sub
+// sport of -1 matches any.
+var fitSports = []struct {
+	sport, subSport int
+	typ             strava.ActivityType
+}{
+	{1, 3, "TrailRun"},
+	{1, 58, "VirtualRun"},
+	{1, -1, strava.ActivityTypes.Run},
+	{2, -1, strava.ActivityTypes.Ride},
+	{11, -1, strava.ActivityTypes.Walk},
+	{17, -1, strava.ActivityTypes.Hike},
+}
+
+// fitTreadmill is the sub sport for running on a treadmill.
+const fitTreadmill = 1
+
+// fitField is a field in a FIT definition message.
+type fitField struct {
+	num, size int
+}
+
+// fitDefinition says how to read the data messages of a local message type.
+type fitDefinition struct {
+	global    int
+	order     binary.ByteOrder
+	fields    []fitField
+	extraSize int // developer fields, which are skipped
+}
+
+// parseFIT reads the first session in a FIT file.
+func parseFIT(r io.Reader) (*strava.ActivitySummary, error) {
+	br := bufio.NewReader(r)
+	header := make([]byte, 12)
+	if _, err := io.ReadFull(br, header); err != nil {
+		return nil, err
+	}
+	if string(header[8:12]) != ".FIT" || header[0] < 12 {
+		return nil, errors.New("not a FIT file")
+	}
+	if _, err := br.Discard(int(header[0]) - 12); err != nil {
+		return nil, err
+	}
+	data := io.LimitReader(br, int64(binary.LittleEndian.Uint32(header[4:8])))
+
+	defs := map[int]*fitDefinition{}
+	var session map[int]uint64
+	var activity map[int]uint64
+	for {
+		var h [1]byte
+		if _, err := io.ReadFull(data, h[:]); err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		local := int(h[0] & 0x0f)
+		switch {
+		case h[0]&0x80 != 0:
+			// A compressed timestamp header, which is always for data.
+			local = int(h[0]>>5) & 0x03
+		case h[0]&0x40 != 0:
+			def, err := readFITDefinition(data, h[0]&0x20 != 0)
+			if err != nil {
+				return nil, err
+			}
+			defs[local] = def
+			continue
+		}
+		def, ok := defs[local]
+		if !ok {
+			return nil, fmt.Errorf("data for undefined message type %d", local)
+		}
+		values, err := readFITData(data, def)
+		if err != nil {
+			return nil, err
+		}
+		if def.global == fitSessionMsg && session == nil {
+			session = values
+		}
+		if def.global == fitActivityMsg && activity == nil {
+			activity = values
+		}
+	}
+	if session == nil {
+		return nil, errors.New("no session")
+	}
+	return fitActivity(session, activity), nil
+}
+
+func readFITDefinition(r io.Reader, developer bool) (*fitDefinition, error) {
+	var h [5]byte
+	if _, err := io.ReadFull(r, h[:]); err != nil {
+		return nil, err
+	}
+	def := &fitDefinition{order: binary.LittleEndian}
+	if h[1] == 1 {
+		def.order = binary.BigEndian
+	}
+	def.global = int(def.order.Uint16(h[2:4]))
+	fields := make([]byte, 3*int(h[4]))
+	if _, err := io.ReadFull(r, fields); err != nil {
+		return nil, err
+	}
+	for i := 0; i < len(fields); i += 3 {
+		def.fields = append(def.fields, fitField{num: int(fields[i]), size: int(fields[i+1])})
+	}
+	if developer {
+		var n [1]byte
+		if _, err := io.ReadFull(r, n[:]); err != nil {
+			return nil, err
+		}
+		devFields := make([]byte, 3*int(n[0]))
+		if _, err := io.ReadFull(r, devFields); err != nil {
+			return nil, err
+		}
+		for i := 0; i < len(devFields); i += 3 {
+			def.extraSize += int(devFields[i+1])
+		}
+	}
+	return def, nil
+}
+
+// readFITData reads a data message, keeping the unsigned integer fields of up
+// to 4 bytes that aren't set to their invalid value.
+func readFITData(r io.Reader, def *fitDefinition) (map[int]uint64, error) {
+	values := map[int]uint64{}
+	for _, f := range def.fields {
+		b := make([]byte, f.size)
+		if _, err := io.ReadFull(r, b); err != nil {
+			return nil, err
+		}
+		var v, invalid uint64
+		switch f.size {
+		case 1:
+			v, invalid = uint64(b[0]), 0xff
+		case 2:
+			v, invalid = uint64(def.order.Uint16(b)), 0xffff
+		case 4:
+			v, invalid = uint64(def.order.Uint32(b)), 0xffffffff
+		default:
+			continue
+		}
+		if v != invalid {
+			values[f.num] = v
+		}
+	}
+	if _, err := io.CopyN(ioutil.Discard, r, int64(def.extraSize)); err != nil {
+		return nil, err
+	}
+	return values, nil
+}
+
+// fitActivity makes an activity from a session message, and the activity
+// message if there is one, which says what time zone the activity was in.
+func fitActivity(session, activity map[int]uint64) *strava.ActivitySummary {
+	act := &strava.ActivitySummary{
+		Type:               strava.ActivityTypes.Workout,
+		ElapsedTime:        int(session[fitTotalElapsedTime] / 1000),
+		MovingTime:         int(session[fitTotalTimerTime] / 1000),
+		Distance:           float64(session[fitTotalDistance]) / 100,
+		TotalElevationGain: float64(session[fitTotalAscent]),
+	}
+	if t, ok := session[fitStartTime]; ok {
+		act.StartDate = fitEpoch.Add(time.Duration(t) * time.Second)
+	}
+	sport, subSport := int(session[fitSport]), -2
+	if s, ok := session[fitSubSport]; ok {
+		subSport = int(s)
+	}
+	for _, s := range fitSports {
+		if s.sport == sport && (s.subSport == -1 || s.subSport == subSport) {
+			act.Type = s.typ
+			break
+		}
+	}
+	act.Trainer = subSport == fitTreadmill
+	local, hasLocal := activity[fitLocalTimestamp]
+	utc, hasUTC := activity[fitTimestamp]
+	if hasLocal && hasUTC && !act.StartDate.IsZero() {
+		act.StartDateLocal = act.StartDate.Add(time.Duration(int64(local)-int64(utc)) * time.Second)
+	}
+	return act
+}
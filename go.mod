@@ -0,0 +1,19 @@
+module github.com/soulplant/jaju-running
+
+go 1.22
+
+require (
+	github.com/mattn/go-sqlite3 v1.14.24
+	github.com/olekukonko/tablewriter v0.0.5
+	github.com/strava/go.strava v0.0.0-20180612235916-99ebe972ba16
+	golang.org/x/net v0.33.0
+	golang.org/x/oauth2 v0.24.0
+	google.golang.org/appengine/v2 v2.0.6
+	gopkg.in/yaml.v2 v2.4.0
+)
+
+require (
+	github.com/golang/protobuf v1.5.4 // indirect
+	github.com/mattn/go-runewidth v0.0.9 // indirect
+	google.golang.org/protobuf v1.33.0 // indirect
+)
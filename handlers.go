@@ -4,26 +4,112 @@ import (
 	"errors"
 	"fmt"
 	"net/http"
-	"os"
 	"sort"
-	"strconv"
-	"sync"
+	"strings"
 	"time"
 
 	"github.com/strava/go.strava"
+	"golang.org/x/oauth2"
 
 	"context"
-
-	"google.golang.org/appengine"
-	"google.golang.org/appengine/log"
-	"google.golang.org/appengine/urlfetch"
 )
 
-// User represents a Strava user who has authorised access to their data.
+// User represents a Strava user who has authorised access to their data, or
+// whose activities were imported from files instead.
 type User struct {
+	// The user's Strava athlete id, which identifies them in the Store.
+	ID int64
+
 	FirstName   string
 	LastName    string
 	StravaToken string
+
+	// Used to get a new StravaToken when it expires.
+	RefreshToken string
+
+	// When StravaToken expires. This is zero for tokens that were issued
+	// before Strava's access tokens started expiring.
+	TokenExpiry time.Time
+
+	// Links to the user's Strava profile picture, at 124x124 and 62x62
+	// pixels. Empty for users without one.
+	ProfilePicture       string `datastore:",noindex"`
+	ProfilePictureMedium string `datastore:",noindex"`
+
+	City    string
+	State   string
+	Country string
+
+	// "M", "F", or empty if the user hasn't said.
+	Sex string
+
+	// "meters" or "feet", for whether the user prefers metric or imperial
+	// units. Only Strava's full athlete profile includes it, so it's empty
+	// until their profile has been refreshed.
+	MeasurementPreference string
+
+	// When the user joined Strava, and last changed their profile there.
+	CreatedAt time.Time
+	UpdatedAt time.Time
+
+	// When the profile above was last copied from Strava.
+	ProfileRefreshed time.Time
+
+	// A hash of the user's API token, and when they made it. Empty if they
+	// don't have one.
+	APITokenHash    string `datastore:",noindex"`
+	APITokenCreated time.Time
+}
+
+// Token gets the user's Strava tokens.
+func (u *User) Token() *oauth2.Token {
+	return &oauth2.Token{
+		AccessToken:  u.StravaToken,
+		TokenType:    "Bearer",
+		RefreshToken: u.RefreshToken,
+		Expiry:       u.TokenExpiry,
+	}
+}
+
+// setToken replaces the user's Strava tokens.
+func (u *User) setToken(tok *oauth2.Token) {
+	u.StravaToken = tok.AccessToken
+	u.RefreshToken = tok.RefreshToken
+	u.TokenExpiry = tok.Expiry
+}
+
+// setProfile copies the user's details from their Strava profile. Details the
+// profile leaves out are kept.
+func (u *User) setProfile(a *strava.AthleteDetailed, now time.Time) {
+	u.FirstName = a.FirstName
+	u.LastName = a.LastName
+	u.ProfilePicture = pictureURL(a.Profile)
+	u.ProfilePictureMedium = pictureURL(a.ProfileMedium)
+	u.City = a.City
+	u.State = a.State
+	u.Country = a.Country
+	u.Sex = string(a.Gender)
+	if a.MeasurementPreference != "" {
+		u.MeasurementPreference = a.MeasurementPreference
+	}
+	u.CreatedAt = a.CreatedAt
+	u.UpdatedAt = a.UpdatedAt
+	u.ProfileRefreshed = now
+}
+
+// pictureURL returns the link to a Strava profile picture, or nothing for
+// athletes without one, whom Strava gives a relative link to a placeholder.
+func pictureURL(link string) string {
+	if !strings.HasPrefix(link, "https://") && !strings.HasPrefix(link, "http://") {
+		return ""
+	}
+	return link
+}
+
+// Connected says whether the user has given us access to their Strava data,
+// rather than having their activities imported.
+func (u *User) Connected() bool {
+	return u.StravaToken != "" || u.RefreshToken != ""
 }
 
 // WeekSummary summarises runs that occur in the same week.
@@ -31,7 +117,8 @@ type WeekSummary struct {
 	// The day this week starts on.
 	Date time.Time
 
-	// How many runs were done this week.
+	// How many runs were done this week. When the week counts more types of
+	// activity than runs, this and the totals below include all of them.
 	Count int
 
 	// Time spent running.
@@ -39,52 +126,192 @@ type WeekSummary struct {
 
 	// How much distance was covered.
 	Distance float64
+
+	// Time spent moving, which leaves out stops.
+	MovingTime time.Duration
+
+	// Total elevation gained, in metres.
+	Elevation float64
+
+	// The distance and elapsed time of the longest run of the week. Other
+	// types of activity don't count, even if they're counted in the totals.
+	LongestDistance float64
+	LongestTime     time.Duration
+
+	// The distance and moving time of just the week's runs, which the pace
+	// goes by.
+	RunDistance   float64
+	RunMovingTime time.Duration
+
+	// What was planned for this week, if the user has a training plan.
+	Plan *PlanProgress
+
+	// How this week's running compares with the weeks before it.
+	Workload Workload
+
+	// The week's activities broken down by type, in the order of
+	// EnduranceTypes. Types with no activities are left out.
+	ByType []TypeSummary
+
+	// How many activities the inclusion policy left out of this week.
+	Excluded int
+}
+
+// Pace is the average time taken to run a kilometre, going by the moving
+// time of the week's runs. It's 0 if there weren't any.
+func (w WeekSummary) Pace() time.Duration {
+	if w.RunDistance == 0 {
+		return 0
+	}
+	return time.Duration(float64(w.RunMovingTime) / (w.RunDistance / 1000))
+}
+
+// PercentComplete is how much of the week's planned distance has been run,
+// or 0 if nothing was planned.
+func (w WeekSummary) PercentComplete() float64 {
+	if w.Plan == nil || w.Plan.Distance == 0 {
+		return 0
+	}
+	return w.Distance / w.Plan.Distance * 100
 }
 
 // UserMarathonTracking is a history of weekly marathon training stats for a given user.
 type UserMarathonTracking struct {
+	// The user's Strava athlete ID, if known.
+	AthleteID int64
+
 	Name  string
 	Weeks []WeekSummary
+
+	// A link to the user's Strava profile picture, if they have one.
+	Picture string
+
+	// The units to show the history in.
+	Units Units
+
+	// The user's training plan, if they have one.
+	Plan *TrainingPlan
+
+	// The types of activity counted in Weeks.
+	Types ActivityTypeSet
+
+	// Why the user's activities couldn't be loaded, if they couldn't. Weeks
+	// may be missing or out of date when this is set.
+	Err error
+}
+
+// NeedsReconnect says whether the user has to authorise us on Strava again
+// before their activities can be loaded.
+func (umt *UserMarathonTracking) NeedsReconnect() bool {
+	return IsAuthError(umt.Err)
+}
+
+// DefaultWeekStart is the day weeks start on unless the request asks otherwise.
+const DefaultWeekStart = time.Saturday
+
+// WeekStart gets the closest date on or before this one that falls on the
+// given weekday. Days are counted on d's own wall clock, and the result is
+// midnight UTC on the matching calendar date so that weeks from different
+// time zones compare equal.
+func WeekStart(d time.Time, start time.Weekday) time.Time {
+	daysToGoBack := (int(d.Weekday()) - int(start) + 7) % 7
+	return time.Date(d.Year(), d.Month(), d.Day()-daysToGoBack, 0, 0, 0, 0, time.UTC)
+}
+
+// calendarDay gets midnight UTC on the date shown on d's own wall clock.
+func calendarDay(d time.Time) time.Time {
+	return time.Date(d.Year(), d.Month(), d.Day(), 0, 0, 0, 0, time.UTC)
 }
 
 // PreviousSaturday gets the Saturday before this date, unless the given date is a Saturday.
 func PreviousSaturday(d time.Time) time.Time {
-	daysToGoBack := int(d.Weekday()) + 1
-	if d.Weekday() == time.Saturday {
-		daysToGoBack = 0
+	return WeekStart(d, time.Saturday)
+}
+
+// LocalStartDate gets the time the activity started on the athlete's own clock.
+func LocalStartDate(act *strava.ActivitySummary) time.Time {
+	if !act.StartDateLocal.IsZero() {
+		return act.StartDateLocal
+	}
+	if loc, err := activityLocation(act.TimeZone); err == nil {
+		return act.StartDate.In(loc)
+	}
+	return act.StartDate
+}
+
+// activityLocation parses Strava's time zone format, e.g. "(GMT+10:00) Australia/Sydney".
+func activityLocation(tz string) (*time.Location, error) {
+	fields := strings.Fields(tz)
+	if len(fields) == 0 {
+		return nil, errors.New("no time zone")
+	}
+	return time.LoadLocation(fields[len(fields)-1])
+}
+
+// ParseWeekday parses a weekday name such as "monday" or "Mon".
+func ParseWeekday(s string) (time.Weekday, error) {
+	for d := time.Sunday; d <= time.Saturday; d++ {
+		name := d.String()
+		if strings.EqualFold(s, name) || strings.EqualFold(s, name[:3]) {
+			return d, nil
+		}
 	}
-	return d.Add(time.Duration(-daysToGoBack) * 24 * time.Hour).Truncate(24 * time.Hour)
+	return 0, fmt.Errorf("unknown weekday %q", s)
+}
+
+// ComputeWeeklySummaries summarises the input activities into the weekly marathon tracking stats,
+// with each week beginning on weekStart.
+// Only runs are counted. Output will be in chronological order.
+func ComputeWeeklySummaries(activities []*strava.ActivitySummary, weekStart time.Weekday) []WeekSummary {
+	return SummarizeWeeks(activities, weekStart, nil, InclusionPolicy{})
 }
 
-// ComputeWeeklySummaries summarises the input activities into the weekly marathon tracking stats.
-// Output will be in chronological order.
-func ComputeWeeklySummaries(activities []*strava.ActivitySummary) []WeekSummary {
-	var runs []*strava.ActivitySummary
+// SummarizeWeeks is like ComputeWeeklySummaries, but counts the activities
+// whose types are in types, broken down by type, as policy says to. Weeks
+// record how many activities policy left out, and are included even if it
+// left out all of them.
+func SummarizeWeeks(activities []*strava.ActivitySummary, weekStart time.Weekday, types ActivityTypeSet, policy InclusionPolicy) []WeekSummary {
+	var counted []*strava.ActivitySummary
 	for _, act := range activities {
-		if act.Type == strava.ActivityTypes.Run {
-			runs = append(runs, act)
+		if types.Includes(act.Type) {
+			counted = append(counted, act)
 		}
 	}
+	runs, excluded := policy.Apply(counted)
+	return countExcluded(summarizeWeeks(runs, weekStart, types), excluded, weekStart)
+}
+
+// summarizeWeeks summarises activities that have already been filtered.
+func summarizeWeeks(runs []*strava.ActivitySummary, weekStart time.Weekday, types ActivityTypeSet) []WeekSummary {
 	if len(runs) == 0 {
 		return nil
 	}
+	// Runs are bucketed by the local calendar day they started on, so sort
+	// them by their week first in case travel has made local and absolute
+	// start times disagree.
+	starts := make(map[*strava.ActivitySummary]time.Time, len(runs))
+	for _, run := range runs {
+		starts[run] = WeekStart(LocalStartDate(run), weekStart)
+	}
 	sort.Slice(runs, func(i, j int) bool {
+		if !starts[runs[i]].Equal(starts[runs[j]]) {
+			return starts[runs[i]].Before(starts[runs[j]])
+		}
 		return runs[i].StartDate.Before(runs[j].StartDate)
 	})
-	firstRunDate := runs[0].StartDate
-	curWeekStart := PreviousSaturday(firstRunDate)
+	curWeekStart := starts[runs[0]]
 
 	var allWeeks [][]*strava.ActivitySummary
 	var thisWeek []*strava.ActivitySummary
 
 	for _, run := range runs {
-		weekStart := PreviousSaturday(run.StartDate)
-		if curWeekStart == weekStart {
+		start := starts[run]
+		if curWeekStart == start {
 			thisWeek = append(thisWeek, run)
 		} else {
 			allWeeks = append(allWeeks, thisWeek)
 			thisWeek = []*strava.ActivitySummary{run}
-			curWeekStart = weekStart
+			curWeekStart = start
 		}
 	}
 	if thisWeek != nil {
@@ -92,269 +319,189 @@ func ComputeWeeklySummaries(activities []*strava.ActivitySummary) []WeekSummary
 	}
 	var result []WeekSummary
 	for _, w := range allWeeks {
-		var dist float64
-		for _, a := range w {
-			dist += a.Distance
+		sum := WeekSummary{
+			Date:  starts[w[0]],
+			Count: len(w),
 		}
-		elapsed := 0
 		for _, a := range w {
-			elapsed += a.ElapsedTime
-		}
-		sum := WeekSummary{
-			Date:     PreviousSaturday(w[0].StartDate),
-			Count:    len(w),
-			Distance: dist,
-			Time:     time.Duration(elapsed) * time.Second,
+			sum.Distance += a.Distance
+			sum.Time += time.Duration(a.ElapsedTime) * time.Second
+			sum.MovingTime += time.Duration(a.MovingTime) * time.Second
+			sum.Elevation += a.TotalElevationGain
+			if !isRun(a.Type) {
+				continue
+			}
+			sum.RunDistance += a.Distance
+			sum.RunMovingTime += time.Duration(a.MovingTime) * time.Second
+			if a.Distance > sum.LongestDistance {
+				sum.LongestDistance = a.Distance
+				sum.LongestTime = time.Duration(a.ElapsedTime) * time.Second
+			}
 		}
+		sum.ByType = summarizeTypes(w, types)
 		result = append(result, sum)
 	}
 	return result
 }
 
-// ActivityFetcher fetches activities from Strava for a given user.
-type ActivityFetcher interface {
-	FetchActivities(token string) ([]*strava.ActivitySummary, error)
-}
-
-func DoAsync(f func(interface{}) (interface{}, error), inputs []interface{}) ([]interface{}, error) {
-	var wg sync.WaitGroup
-	wg.Add(len(inputs))
-	result := make([]interface{}, len(inputs))
-	fail := make(chan error, len(inputs))
-	for i, in := range inputs {
-		go func(i int, in interface{}) {
-			defer wg.Done()
-			out, err := f(in)
-			if err != nil {
-				fail <- err
-				return
-			}
-			result[i] = out
-		}(i, in)
+// countExcluded records how many of excluded fall in each of weeks, adding
+// weeks for any that fall outside them. The result is in chronological order.
+func countExcluded(weeks []WeekSummary, excluded []*strava.ActivitySummary, weekStart time.Weekday) []WeekSummary {
+	if len(excluded) == 0 {
+		return weeks
 	}
-	wg.Wait()
-	close(fail)
-	err := <-fail
-	if err != nil {
-		return nil, err
+	byDate := make(map[time.Time]int, len(weeks))
+	for i, w := range weeks {
+		byDate[w.Date] = i
 	}
-	return result, nil
-}
-
-func FetchUsersActivity(users []User, fetcher ActivityFetcher) ([][]*strava.ActivitySummary, error) {
-	var cs []chan []*strava.ActivitySummary
-	for _, u := range users {
-		// Note, we give this capacity 1 so that we don't leak goroutines. When
-		// iterating over these channels later we don't guarantee that we read
-		// them all, so having capacity in the channel means that the goroutine
-		// can terminate and the channel itself can get gc'd.
-		// An alternative would be to read all the channels afterwards which
-		// would have the effect of unblocking the goroutines waiting for a
-		// chance to write.
-		c := make(chan []*strava.ActivitySummary, 1)
-		cs = append(cs, c)
-		go func(u User) {
-			defer close(c)
-			acts, err := fetcher.FetchActivities(u.StravaToken)
-			if err != nil {
-				return
-			}
-			c <- acts
-		}(u)
-	}
-	var result [][]*strava.ActivitySummary
-	for _, c := range cs {
-		val, ok := <-c
+	for _, act := range excluded {
+		date := WeekStart(LocalStartDate(act), weekStart)
+		i, ok := byDate[date]
 		if !ok {
-			return nil, errors.New("Failed")
+			weeks = append(weeks, WeekSummary{Date: date})
+			i = len(weeks) - 1
+			byDate[date] = i
 		}
-		result = append(result, val)
-	}
-	return result, nil
-}
-
-func FetchUsersActivity3(users []User, fetcher ActivityFetcher) ([][]*strava.ActivitySummary, error) {
-	var wg sync.WaitGroup
-	wg.Add(len(users))
-	fail := make(chan error, len(users))
-	var m sync.Map
-	for i, u := range users {
-		go func(i int, u User) {
-			defer wg.Done()
-			act, err := fetcher.FetchActivities(u.StravaToken)
-			if err != nil {
-				fail <- err
-				return
-			}
-			m.Store(i, act)
-		}(i, u)
-	}
-	wg.Wait()
-	close(fail)
-	err := <-fail
-	if err != nil {
-		return nil, err
+		weeks[i].Excluded++
 	}
-	r := make([][]*strava.ActivitySummary, len(users))
-	m.Range(func(key, value interface{}) bool {
-		r[key.(int)] = value.([]*strava.ActivitySummary)
-		return true
+	sort.SliceStable(weeks, func(i, j int) bool {
+		return weeks[i].Date.Before(weeks[j].Date)
 	})
-	return r, nil
+	return weeks
 }
 
-func FetchUsersActivity2(users []User, fetcher ActivityFetcher) ([][]*strava.ActivitySummary, error) {
-	var wg sync.WaitGroup
-	wg.Add(len(users))
+// HistoryOptions controls which activities make up a training history and
+// how they are summarised.
+type HistoryOptions struct {
+	// The day weeks start on.
+	WeekStart time.Weekday
 
-	type resp struct {
-		i    int
-		acts []*strava.ActivitySummary
-	}
-	fail := make(chan error, len(users))
-	rchan := make(chan resp, len(users))
-
-	for i, u := range users {
-		go func(i int, u User) {
-			defer wg.Done()
-			act, err := fetcher.FetchActivities(u.StravaToken)
-			if err != nil {
-				fail <- err
-				return
-			}
-			rchan <- resp{i, act}
-		}(i, u)
-	}
-	wg.Wait()
-	close(rchan)
-	select {
-	case err := <-fail:
-		return nil, err
-	default:
-	}
-	result := make([][]*strava.ActivitySummary, len(users))
-	for r := range rchan {
-		result[r.i] = r.acts
+	// The first and last days to include, going by the athlete's local
+	// calendar. A zero value leaves that end of the range open.
+	From, To time.Time
+
+	// The types of activity to count. Nil counts just runs.
+	Types ActivityTypeSet
+
+	// Which activities count, and how much.
+	Policy InclusionPolicy
+
+	// The units to show everyone's history in. Empty shows each user's in
+	// the units they prefer on Strava.
+	Units Units
+}
+
+// unitsFor gets the units to show the user's history in.
+func (o HistoryOptions) unitsFor(u *User) Units {
+	if o.Units != "" {
+		return o.Units
 	}
-	return result, nil
+	return PreferredUnits(u.MeasurementPreference)
 }
 
-func FetchUserHistory(ctx context.Context, users []User, fetcher ActivityFetcher) ([]*UserMarathonTracking, error) {
-	acts, err := FetchUsersActivity(users, fetcher)
-	if err != nil {
-		return nil, err
+// FilterActivities returns the activities that fall within the options' date range.
+func (o HistoryOptions) FilterActivities(acts []*strava.ActivitySummary) []*strava.ActivitySummary {
+	if o.From.IsZero() && o.To.IsZero() {
+		return acts
 	}
-	var result []*UserMarathonTracking
-	for i, act := range acts {
-		umt := &UserMarathonTracking{
-			Name:  users[i].FirstName,
-			Weeks: ComputeWeeklySummaries(act),
+	var result []*strava.ActivitySummary
+	for _, act := range acts {
+		if o.includes(calendarDay(LocalStartDate(act))) {
+			result = append(result, act)
 		}
-		result = append(result, umt)
 	}
-	return result, nil
+	return result
 }
 
-// FetchUserHistory fetches each user's marathon training history.
-func FetchUserHistory2(ctx context.Context, users []User, fetcher ActivityFetcher) ([]*UserMarathonTracking, error) {
-	results := make(chan *UserMarathonTracking)
-	defer func() {
-		close(results)
-	}()
-	for _, u := range users {
-		go func(u User) {
-			var result *UserMarathonTracking
-			defer func() {
-				results <- result
-			}()
-			acts, err := fetcher.FetchActivities(u.StravaToken)
-			if err != nil {
-				log.Errorf(ctx, "Failed to fetch activites: %s", err.Error())
-				return
-			}
-			mt := ComputeWeeklySummaries(acts)
-			name := u.FirstName
-
-			result = &UserMarathonTracking{
-				Name:  name,
-				Weeks: mt,
-			}
-		}(u)
+// FilterPlan returns a copy of plan with only the weeks that start within the
+// options' date range, or nil if there is no plan.
+func (o HistoryOptions) FilterPlan(plan *TrainingPlan) *TrainingPlan {
+	if plan == nil {
+		return nil
 	}
-
-	var err error
-	var mts []*UserMarathonTracking
-	for i := 0; i < len(users); i++ {
-		result := <-results
-		if result == nil {
-			err = errors.New("couldn't fetch marathon tracking data")
+	result := *plan
+	result.Weeks = nil
+	for _, w := range plan.Weeks {
+		if o.includes(w.Start) {
+			result.Weeks = append(result.Weeks, w)
 		}
-		mts = append(mts, result)
 	}
+	return &result
+}
 
-	if err != nil {
-		return nil, err
-	}
-	return mts, nil
+// includes says whether day is within the options' date range.
+func (o HistoryOptions) includes(day time.Time) bool {
+	return (o.From.IsZero() || !day.Before(o.From)) && (o.To.IsZero() || !day.After(o.To))
 }
 
-func init() {
-	stravaClientID, err := strconv.Atoi(os.Getenv("STRAVA_CLIENT_ID"))
-	if err != nil {
-		fmt.Printf("STRAVA_CLIENT_ID not set\n")
-		return
-	}
-	strava.ClientId = stravaClientID
-	stravaClientSecret := os.Getenv("STRAVA_CLIENT_SECRET")
-	if stravaClientSecret == "" {
-		panic(errors.New("STRAVA_CLIENT_SECRET not set"))
-	}
-	strava.ClientSecret = stravaClientSecret
+// ActivityFetcher fetches activities from Strava for a given user.
+type ActivityFetcher interface {
+	// FetchActivities fetches all of the user's activities that started
+	// after after and before before. A zero time leaves that end of the range
+	// open.
+	FetchActivities(ctx context.Context, ts oauth2.TokenSource, after, before time.Time) ([]*strava.ActivitySummary, error)
 
-	auth := strava.OAuthAuthenticator{
-		CallbackURL: "/oauth_callback",
-		RequestClientGenerator: func(r *http.Request) *http.Client {
-			return urlfetch.Client(appengine.NewContext(r))
-		},
-	}
-	http.HandleFunc(auth.CallbackURL, auth.HandlerFunc(func(auth *strava.AuthorizationResponse, w http.ResponseWriter, r *http.Request) {
-		ctx := appengine.NewContext(r)
-		_, err := RegisterNewUser(ctx, auth)
-		if err != nil {
-			handleError(w, err)
-			return
-		}
-		http.Redirect(w, r, "/", http.StatusFound)
-	}, func(err error, w http.ResponseWriter, r *http.Request) {
-		handleError(w, err)
-	}))
+	// FetchActivity fetches one of the user's activities, returning
+	// ErrNotFound if it has been deleted or made private.
+	FetchActivity(ctx context.Context, ts oauth2.TokenSource, id int64) (*strava.ActivitySummary, error)
+}
 
-	http.HandleFunc("/favicon.ico", func(w http.ResponseWriter, r *http.Request) {
-		w.Write([]byte("ok")) // nolint: errcheck
-	})
+// FetchParallelism is the most users whose activities are fetched from Strava at once.
+var FetchParallelism = 4
 
-	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-		ctx := appengine.NewContext(r)
-		users, err := GetUsers(ctx)
+// dateFormat is how dates are written in query parameters.
+const dateFormat = "2006-01-02"
+
+// historyOptionsParam reads the week_start, from, to, types, exclude,
+// trainer_percent and units query parameters. Weeks start on
+// DefaultWeekStart, the date range is open and every run is counted in full
+// unless the request says otherwise.
+func historyOptionsParam(r *http.Request) (HistoryOptions, error) {
+	opts := HistoryOptions{WeekStart: DefaultWeekStart}
+	if s := r.FormValue("week_start"); s != "" {
+		d, err := ParseWeekday(s)
+		if err != nil {
+			return opts, err
+		}
+		opts.WeekStart = d
+	}
+	if s := r.FormValue("types"); s != "" {
+		types, err := ParseActivityTypes(s)
 		if err != nil {
-			handleError(w, err)
-			return
+			return opts, err
 		}
-		umt, err := FetchUserHistory(ctx, users, stravaFetcher{urlfetch.Client(ctx)})
+		opts.Types = types
+	}
+	policy, err := ParseInclusionPolicy(r.FormValue("exclude"), r.FormValue("trainer_percent"))
+	if err != nil {
+		return opts, err
+	}
+	opts.Policy = policy
+	if s := r.FormValue("units"); s != "" {
+		units, err := ParseUnits(s)
 		if err != nil {
-			handleError(w, err)
-			return
+			return opts, err
+		}
+		opts.Units = units
+	}
+	for _, p := range []struct {
+		name string
+		dst  *time.Time
+	}{{"from", &opts.From}, {"to", &opts.To}} {
+		s := r.FormValue(p.name)
+		if s == "" {
+			continue
 		}
-		err = mainTpl.Execute(w, mainTplArgs{
-			Umt:         umt,
-			ClientID:    fmt.Sprintf("%d", stravaClientID),
-			RedirectURI: "https://jaju-running.appspot.com/oauth_callback",
-		})
+		d, err := time.Parse(dateFormat, s)
 		if err != nil {
-			handleError(w, err)
-			return
+			return opts, fmt.Errorf("%s must be a date like %s", p.name, dateFormat)
 		}
-	})
+		*p.dst = d
+	}
+	if !opts.From.IsZero() && !opts.To.IsZero() && opts.To.Before(opts.From) {
+		return opts, errors.New("to must not be before from")
+	}
+	return opts, nil
 }
 
 func handleError(w http.ResponseWriter, err error) {
@@ -0,0 +1,625 @@
+package handlers
+
+import (
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"encoding/csv"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	strava "github.com/strava/go.strava"
+)
+
+// importedIDBase is added to the start time of imported activities that don't
+// have a Strava ID to make one up. It is far above any real Strava ID, so
+// syncs can tell the activities apart and don't delete them for not being on
+// Strava.
+const importedIDBase = 1 << 62
+
+// isImportedID says whether id was made up for an imported activity.
+func isImportedID(id int64) bool {
+	return id >= importedIDBase
+}
+
+// sameStartWindow is how close together two activities have to start to be
+// taken for the same one, imported from a file and also synced from Strava.
+const sameStartWindow = time.Minute
+
+// importedCopies gets the ids of the activities in imported that have a made
+// up ID and start at the same time as one of the activities in synced that
+// came from Strava, which they are copies of.
+func importedCopies(imported, synced []*strava.ActivitySummary) []int64 {
+	var ids []int64
+	for _, a := range imported {
+		if !isImportedID(a.Id) {
+			continue
+		}
+		for _, b := range synced {
+			d := a.StartDate.Sub(b.StartDate)
+			if !isImportedID(b.Id) && d > -sameStartWindow && d < sameStartWindow {
+				ids = append(ids, a.Id)
+				break
+			}
+		}
+	}
+	return ids
+}
+
+// alreadyStored gets the ids of the activities in imported that are already
+// in stored: those with the same ID, which bulk exports keep from Strava, and
+// the copies importedCopies finds. Importing them again would either count
+// them twice or overwrite what was synced with the export's less detailed
+// copy, which doesn't say whether the activity was on a trainer, manual,
+// flagged or private.
+func alreadyStored(imported, stored []*strava.ActivitySummary) map[int64]bool {
+	ids := map[int64]bool{}
+	for _, a := range stored {
+		ids[a.Id] = true
+	}
+	result := map[int64]bool{}
+	for _, a := range imported {
+		if ids[a.Id] {
+			result[a.Id] = true
+		}
+	}
+	for _, id := range importedCopies(imported, stored) {
+		result[id] = true
+	}
+	return result
+}
+
+// ImportArchive reads the activities from a Strava bulk export, which is a zip
+// of activities.csv and the activity files it refers to. Files that aren't
+// listed in activities.csv are imported too, so a zip of just activity files
+// works as well. Activities that can't be read are skipped and reported in
+// problems rather than failing the whole import.
+func ImportArchive(r io.ReaderAt, size int64) (acts []*strava.ActivitySummary, problems []error, err error) {
+	zr, err := zip.NewReader(r, size)
+	if err != nil {
+		return nil, nil, err
+	}
+	files := map[string]*zip.File{}
+	var index *zip.File
+	for _, f := range zr.File {
+		if path.Base(f.Name) == "activities.csv" {
+			index = f
+		} else if isActivityFile(f.Name) {
+			files[f.Name] = f
+		}
+	}
+	if index != nil {
+		rc, err := index.Open()
+		if err != nil {
+			return nil, nil, err
+		}
+		rows, err := parseActivitiesCSV(rc)
+		rc.Close()
+		if err != nil {
+			return nil, nil, fmt.Errorf("activities.csv: %s", err)
+		}
+		for _, row := range rows {
+			act := &strava.ActivitySummary{}
+			if f, ok := files[row.filename]; ok {
+				delete(files, row.filename)
+				if fromFile, err := importZipFile(f); err != nil {
+					problems = append(problems, err)
+				} else {
+					act = fromFile
+				}
+			}
+			row.apply(act)
+			if act.StartDate.IsZero() {
+				problems = append(problems, fmt.Errorf("activity %d has no start date", row.id))
+				continue
+			}
+			acts = append(acts, act)
+		}
+	}
+	for _, f := range zr.File {
+		if _, ok := files[f.Name]; !ok {
+			continue
+		}
+		act, err := importZipFile(f)
+		if err != nil {
+			problems = append(problems, err)
+			continue
+		}
+		acts = append(acts, act)
+	}
+	return acts, problems, nil
+}
+
+func importZipFile(f *zip.File) (*strava.ActivitySummary, error) {
+	rc, err := f.Open()
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", f.Name, err)
+	}
+	defer rc.Close()
+	return ImportFile(f.Name, rc)
+}
+
+// isActivityFile says whether name looks like a GPX, TCX or FIT file,
+// possibly gzipped.
+func isActivityFile(name string) bool {
+	switch path.Ext(strings.TrimSuffix(strings.ToLower(name), ".gz")) {
+	case ".gpx", ".tcx", ".fit":
+		return true
+	}
+	return false
+}
+
+// ImportFile reads a single GPX, TCX or FIT activity file, choosing the format
+// by its extension. Files ending in .gz are decompressed first, as they are
+// in bulk exports. The activity's ID is made up from its start time.
+func ImportFile(name string, r io.Reader) (*strava.ActivitySummary, error) {
+	lower := strings.ToLower(name)
+	if strings.HasSuffix(lower, ".gz") {
+		gz, err := gzip.NewReader(r)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", name, err)
+		}
+		defer gz.Close()
+		r = gz
+		lower = strings.TrimSuffix(lower, ".gz")
+	}
+	var act *strava.ActivitySummary
+	var err error
+	switch path.Ext(lower) {
+	case ".gpx":
+		act, err = parseGPX(r)
+	case ".tcx":
+		act, err = parseTCX(r)
+	case ".fit":
+		act, err = parseFIT(r)
+	default:
+		return nil, fmt.Errorf("%s isn't a GPX, TCX or FIT file", name)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", name, err)
+	}
+	if act.StartDate.IsZero() {
+		return nil, fmt.Errorf("%s: no start time", name)
+	}
+	act.Id = importedIDBase + act.StartDate.Unix()
+	return act, nil
+}
+
+// trackPoint is a recorded position, which files may leave parts of out.
+type trackPoint struct {
+	time     time.Time
+	lat, lon float64
+	ele      *float64
+
+	// The distance from the start, if the file records it.
+	distance *float64
+}
+
+// summarizeTrack fills in act's start, times, distance and elevation gain
+// from a track.
+func summarizeTrack(act *strava.ActivitySummary, points []trackPoint) {
+	if len(points) == 0 {
+		return
+	}
+	act.StartDate = points[0].time
+	act.ElapsedTime = int(points[len(points)-1].time.Sub(points[0].time).Seconds())
+	var distance, moving float64
+	for i := 1; i < len(points); i++ {
+		p, q := points[i-1], points[i]
+		var d float64
+		if p.distance != nil && q.distance != nil {
+			d = *q.distance - *p.distance
+		} else {
+			d = haversine(p.lat, p.lon, q.lat, q.lon)
+		}
+		distance += d
+		if dt := q.time.Sub(p.time).Seconds(); dt > 0 && d/dt >= movingSpeed {
+			moving += dt
+		}
+		if p.ele != nil && q.ele != nil && *q.ele > *p.ele {
+			act.TotalElevationGain += *q.ele - *p.ele
+		}
+	}
+	act.Distance = distance
+	act.MovingTime = int(moving)
+}
+
+// movingSpeed is the slowest speed, in metres per second, that counts as
+// moving rather than stopped.
+const movingSpeed = 0.5
+
+// haversine is the distance in metres between two points on the Earth.
+func haversine(lat1, lon1, lat2, lon2 float64) float64 {
+	const earthRadius = 6371000
+	rad := func(deg float64) float64 { return deg * math.Pi / 180 }
+	dLat, dLon := rad(lat2-lat1), rad(lon2-lon1)
+	a := math.Sin(dLat/2)*math.Sin(dLat/2) +
+		math.Cos(rad(lat1))*math.Cos(rad(lat2))*math.Sin(dLon/2)*math.Sin(dLon/2)
+	return 2 * earthRadius * math.Asin(math.Sqrt(a))
+}
+
+// fileActivityType maps the activity type names used in GPX and TCX files,
+// including Strava's numeric codes, to Strava activity types. Files with no
+// type are taken to be runs.
+func fileActivityType(s string) strava.ActivityType {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "", "9", "run", "running":
+		return strava.ActivityTypes.Run
+	case "1", "ride", "biking", "cycling":
+		return strava.ActivityTypes.Ride
+	case "10", "walk", "walking":
+		return strava.ActivityTypes.Walk
+	case "4", "hike", "hiking":
+		return strava.ActivityTypes.Hike
+	}
+	return strava.ActivityType(s)
+}
+
+type gpxFile struct {
+	Tracks []struct {
+		Name     string `xml:"name"`
+		Type     string `xml:"type"`
+		Segments []struct {
+			Points []struct {
+				Lat  float64   `xml:"lat,attr"`
+				Lon  float64   `xml:"lon,attr"`
+				Ele  *float64  `xml:"ele"`
+				Time time.Time `xml:"time"`
+			} `xml:"trkpt"`
+		} `xml:"trkseg"`
+	} `xml:"trk"`
+}
+
+func parseGPX(r io.Reader) (*strava.ActivitySummary, error) {
+	var f gpxFile
+	if err := decodeXML(r, &f); err != nil {
+		return nil, err
+	}
+	if len(f.Tracks) == 0 {
+		return nil, errors.New("no track")
+	}
+	act := &strava.ActivitySummary{Name: f.Tracks[0].Name, Type: fileActivityType(f.Tracks[0].Type)}
+	var points []trackPoint
+	for _, t := range f.Tracks {
+		for _, s := range t.Segments {
+			for _, p := range s.Points {
+				points = append(points, trackPoint{time: p.Time, lat: p.Lat, lon: p.Lon, ele: p.Ele})
+			}
+		}
+	}
+	summarizeTrack(act, points)
+	return act, nil
+}
+
+type tcxFile struct {
+	Activities []struct {
+		Sport string    `xml:"Sport,attr"`
+		ID    time.Time `xml:"Id"`
+		Laps  []struct {
+			TotalTimeSeconds float64
+			DistanceMeters   float64
+			Points           []struct {
+				Time           time.Time
+				AltitudeMeters *float64
+				DistanceMeters *float64
+				Position       struct {
+					LatitudeDegrees  float64
+					LongitudeDegrees float64
+				}
+			} `xml:"Track>Trackpoint"`
+		} `xml:"Lap"`
+	} `xml:"Activities>Activity"`
+}
+
+func parseTCX(r io.Reader) (*strava.ActivitySummary, error) {
+	var f tcxFile
+	if err := decodeXML(r, &f); err != nil {
+		return nil, err
+	}
+	if len(f.Activities) == 0 {
+		return nil, errors.New("no activity")
+	}
+	a := f.Activities[0]
+	act := &strava.ActivitySummary{Type: fileActivityType(a.Sport)}
+	var points []trackPoint
+	var timer, distance float64
+	for _, lap := range a.Laps {
+		timer += lap.TotalTimeSeconds
+		distance += lap.DistanceMeters
+		for _, p := range lap.Points {
+			points = append(points, trackPoint{
+				time:     p.Time,
+				lat:      p.Position.LatitudeDegrees,
+				lon:      p.Position.LongitudeDegrees,
+				ele:      p.AltitudeMeters,
+				distance: p.DistanceMeters,
+			})
+		}
+	}
+	summarizeTrack(act, points)
+	// The laps' totals are what the device recorded, so they're better than
+	// anything worked out from the track.
+	if !a.ID.IsZero() {
+		act.StartDate = a.ID
+	}
+	if distance > 0 {
+		act.Distance = distance
+	}
+	if timer > 0 {
+		act.MovingTime = int(timer)
+	}
+	if act.ElapsedTime < act.MovingTime {
+		act.ElapsedTime = act.MovingTime
+	}
+	return act, nil
+}
+
+// decodeXML decodes an XML file into v. Strava's exports sometimes have
+// whitespace before the XML declaration, which the decoder doesn't allow.
+func decodeXML(r io.Reader, v interface{}) error {
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	return xml.Unmarshal(bytes.TrimSpace(b), v)
+}
+
+// exportRow is an activity from a bulk export's activities.csv.
+type exportRow struct {
+	id       int64
+	name     string
+	typ      string
+	start    time.Time
+	filename string
+
+	// The numbers are nil when the export leaves them blank.
+	elapsed, moving, distance, elevation *float64
+}
+
+// apply overwrites act with everything the row has.
+func (row exportRow) apply(act *strava.ActivitySummary) {
+	act.Id = row.id
+	if row.name != "" {
+		act.Name = row.name
+	}
+	if row.typ != "" {
+		act.Type = strava.ActivityType(strings.Replace(row.typ, " ", "", -1))
+	}
+	if !row.start.IsZero() {
+		act.StartDate = row.start
+	}
+	if row.elapsed != nil {
+		act.ElapsedTime = int(*row.elapsed)
+	}
+	if row.moving != nil {
+		act.MovingTime = int(*row.moving)
+	}
+	if row.distance != nil {
+		act.Distance = *row.distance
+	}
+	if row.elevation != nil {
+		act.TotalElevationGain = *row.elevation
+	}
+}
+
+// exportDateFormats are the ways bulk exports have written activity dates, in UTC.
+var exportDateFormats = []string{"Jan 2, 2006, 3:04:05 PM", "2006-01-02 15:04:05"}
+
+// parseActivitiesCSV reads a bulk export's activities.csv. The export has
+// grown columns over the years and repeats some names: when Distance appears
+// twice the first is in kilometres and the second in metres.
+func parseActivitiesCSV(r io.Reader) ([]exportRow, error) {
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = -1
+	records, err := cr.ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	if len(records) == 0 {
+		return nil, errors.New("empty file")
+	}
+	cols := map[string][]int{}
+	for i, name := range records[0] {
+		cols[name] = append(cols[name], i)
+	}
+	if len(cols["Activity ID"]) == 0 || len(cols["Activity Date"]) == 0 {
+		return nil, errors.New("missing the Activity ID or Activity Date column")
+	}
+	var result []exportRow
+	for n, rec := range records[1:] {
+		field := func(name string, i int) string {
+			if len(cols[name]) <= i || cols[name][i] >= len(rec) {
+				return ""
+			}
+			return strings.TrimSpace(rec[cols[name][i]])
+		}
+		number := func(name string, i int, scale float64) (*float64, error) {
+			s := field(name, i)
+			if s == "" {
+				return nil, nil
+			}
+			v, err := strconv.ParseFloat(strings.Replace(s, ",", "", -1), 64)
+			if err != nil {
+				return nil, fmt.Errorf("row %d: bad %s %q", n+2, name, s)
+			}
+			v *= scale
+			return &v, nil
+		}
+		row := exportRow{
+			name:     field("Activity Name", 0),
+			typ:      field("Activity Type", 0),
+			filename: field("Filename", 0),
+		}
+		if row.id, err = strconv.ParseInt(field("Activity ID", 0), 10, 64); err != nil {
+			return nil, fmt.Errorf("row %d: bad Activity ID", n+2)
+		}
+		if row.start, err = parseExportDate(field("Activity Date", 0)); err != nil {
+			return nil, fmt.Errorf("row %d: %s", n+2, err)
+		}
+		distanceCol, distanceScale := 0, 1000.0
+		if len(cols["Distance"]) > 1 {
+			distanceCol, distanceScale = 1, 1
+		}
+		for _, f := range []struct {
+			dst   **float64
+			name  string
+			i     int
+			scale float64
+		}{
+			{&row.elapsed, "Elapsed Time", 0, 1},
+			{&row.moving, "Moving Time", 0, 1},
+			{&row.distance, "Distance", distanceCol, distanceScale},
+			{&row.elevation, "Elevation Gain", 0, 1},
+		} {
+			if *f.dst, err = number(f.name, f.i, f.scale); err != nil {
+				return nil, err
+			}
+		}
+		result = append(result, row)
+	}
+	return result, nil
+}
+
+func parseExportDate(s string) (time.Time, error) {
+	for _, layout := range exportDateFormats {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("bad Activity Date %q", s)
+}
+
+// ReadImport reads the activities from an uploaded bulk export zip or single
+// activity file, choosing by the file's name.
+func ReadImport(name string, r io.ReaderAt, size int64) ([]*strava.ActivitySummary, []error, error) {
+	if strings.ToLower(path.Ext(name)) == ".zip" {
+		return ImportArchive(r, size)
+	}
+	act, err := ImportFile(name, io.NewSectionReader(r, 0, size))
+	if err != nil {
+		return nil, nil, err
+	}
+	return []*strava.ActivitySummary{act}, nil, nil
+}
+
+// importLocation gets the time zone that imported activities were done in:
+// the one named, or otherwise the one the user's latest activity in stored
+// was done in. It's nil if there's neither.
+func importLocation(name string, stored []*strava.ActivitySummary) (*time.Location, error) {
+	if name != "" {
+		loc, err := time.LoadLocation(name)
+		if err != nil {
+			return nil, fmt.Errorf("time_zone must be a time zone like Australia/Sydney, not %q", name)
+		}
+		return loc, nil
+	}
+	for i := len(stored) - 1; i >= 0; i-- {
+		if loc, err := activityLocation(stored[i].TimeZone); err == nil {
+			return loc, nil
+		}
+	}
+	return nil, nil
+}
+
+// localizeActivities sets the local start time and time zone of the
+// activities that don't record them, the way Strava does, taking them to have
+// been done in loc. GPX and TCX files and activities.csv only have UTC times,
+// which would put activities near midnight on the wrong day.
+func localizeActivities(acts []*strava.ActivitySummary, loc *time.Location) {
+	for _, act := range acts {
+		if !act.StartDateLocal.IsZero() {
+			continue
+		}
+		local := act.StartDate.In(loc)
+		act.StartDateLocal = time.Date(local.Year(), local.Month(), local.Day(),
+			local.Hour(), local.Minute(), local.Second(), local.Nanosecond(), time.UTC)
+		act.TimeZone = fmt.Sprintf("(GMT%s) %s", local.Format("-07:00"), loc)
+	}
+}
+
+// registerImportHandlers sets up importing activities from files:
+//
+//	POST /admin/import
+//	    Stores the activities in a Strava bulk export zip, or a single GPX,
+//	    TCX or FIT file, for a user. Takes a multipart form with the user's
+//	    Strava athlete_id, the file in file, and the user's name if they
+//	    haven't registered, in which case they're added without connecting
+//	    Strava. The activities are taken to have been done in the time_zone
+//	    given, like Australia/Sydney, or otherwise the one the user's latest
+//	    activity was done in. Activities that are already stored are left
+//	    as they are.
+func registerImportHandlers(mux *http.ServeMux, env *Env) {
+	store := env.Store
+	mux.Handle("/admin/import", env.admin(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		ctx := env.context(r)
+		id, err := strconv.ParseInt(r.FormValue("athlete_id"), 10, 64)
+		if err != nil || id <= 0 {
+			http.Error(w, "athlete_id must be a Strava athlete ID", http.StatusBadRequest)
+			return
+		}
+		f, fh, err := r.FormFile("file")
+		if err != nil {
+			http.Error(w, "file must be an uploaded file", http.StatusBadRequest)
+			return
+		}
+		defer f.Close()
+		acts, problems, err := ReadImport(fh.Filename, f, fh.Size)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		stored, err := store.GetActivities(ctx, id)
+		if err != nil {
+			handleError(w, err)
+			return
+		}
+		loc, err := importLocation(r.FormValue("time_zone"), stored)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		_, err = RegisterOfflineUser(ctx, store, id, r.FormValue("name"))
+		if err == errNoName {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err != nil {
+			handleError(w, err)
+			return
+		}
+		if loc != nil {
+			localizeActivities(acts, loc)
+		}
+		skip := alreadyStored(acts, stored)
+		var fresh []*strava.ActivitySummary
+		for _, act := range acts {
+			if !skip[act.Id] {
+				fresh = append(fresh, act)
+			}
+		}
+		if err := store.PutActivities(ctx, id, fresh); err != nil {
+			handleError(w, err)
+			return
+		}
+		fmt.Fprintf(w, "imported %d activities\n", len(fresh))
+		if skipped := len(acts) - len(fresh); skipped > 0 {
+			fmt.Fprintf(w, "skipped %d activities that were already stored\n", skipped)
+		}
+		for _, p := range problems {
+			fmt.Fprintf(w, "skipped %s\n", p)
+		}
+	}))
+}
@@ -0,0 +1,389 @@
+package handlers
+
+import (
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/binary"
+	"io/ioutil"
+	"math"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	strava "github.com/strava/go.strava"
+)
+
+// Roughly 1km due north of the first point, then 1km further.
+const gpxText = `
+<?xml version="1.0" encoding="UTF-8"?>
+<gpx creator="StravaGPX" version="1.1" xmlns="http://www.topografix.com/GPX/1/1">
+ <trk>
+  <name>Morning Run</name>
+  <type>9</type>
+  <trkseg>
+   <trkpt lat="-33.8700" lon="151.2000"><ele>10.0</ele><time>2018-03-02T21:00:00Z</time></trkpt>
+   <trkpt lat="-33.8610" lon="151.2000"><ele>25.0</ele><time>2018-03-02T21:05:00Z</time></trkpt>
+   <trkpt lat="-33.8610" lon="151.2000"><ele>20.0</ele><time>2018-03-02T21:10:00Z</time></trkpt>
+   <trkpt lat="-33.8520" lon="151.2000"><ele>30.0</ele><time>2018-03-02T21:15:00Z</time></trkpt>
+  </trkseg>
+ </trk>
+</gpx>`
+
+const tcxText = `<?xml version="1.0" encoding="UTF-8"?>
+<TrainingCenterDatabase xmlns="http://www.garmin.com/xmlschemas/TrainingCenterDatabase/v2">
+ <Activities>
+  <Activity Sport="Running">
+   <Id>2018-03-05T08:00:00Z</Id>
+   <Lap StartTime="2018-03-05T08:00:00Z">
+    <TotalTimeSeconds>1500</TotalTimeSeconds>
+    <DistanceMeters>5000</DistanceMeters>
+    <Track>
+     <Trackpoint><Time>2018-03-05T08:00:00Z</Time><AltitudeMeters>5</AltitudeMeters><DistanceMeters>0</DistanceMeters></Trackpoint>
+     <Trackpoint><Time>2018-03-05T08:30:00Z</Time><AltitudeMeters>45</AltitudeMeters><DistanceMeters>4990</DistanceMeters></Trackpoint>
+    </Track>
+   </Lap>
+  </Activity>
+ </Activities>
+</TrainingCenterDatabase>`
+
+// fitFile builds a FIT file with an activity message giving a UTC offset of
+// +11 hours and a session with the given fields.
+func fitFile(session map[byte]uint32) []byte {
+	var data bytes.Buffer
+	le := binary.LittleEndian
+	// Activity: a definition for local type 0, then its data.
+	data.Write([]byte{0x40, 0, 0})
+	binary.Write(&data, le, uint16(fitActivityMsg)) // nolint: errcheck
+	data.Write([]byte{2, fitTimestamp, 4, 0x86, fitLocalTimestamp, 4, 0x86})
+	data.Write([]byte{0x00})
+	binary.Write(&data, le, uint32(1000))          // nolint: errcheck
+	binary.Write(&data, le, uint32(1000+11*60*60)) // nolint: errcheck
+	// Session: a big endian definition for local type 1, then its data with
+	// a compressed timestamp header.
+	data.Write([]byte{0x41, 0, 1})
+	binary.Write(&data, binary.BigEndian, uint16(fitSessionMsg)) // nolint: errcheck
+	data.WriteByte(byte(len(session) + 1))
+	var nums []byte
+	for num := range session {
+		nums = append(nums, num)
+	}
+	for _, num := range nums {
+		data.Write([]byte{num, 4, 0x86})
+	}
+	data.Write([]byte{200, 2, 0x84}) // an unknown field
+	data.WriteByte(0x80 | 1<<5)
+	for _, num := range nums {
+		binary.Write(&data, binary.BigEndian, session[num]) // nolint: errcheck
+	}
+	data.Write([]byte{0xff, 0xff})
+
+	var f bytes.Buffer
+	f.Write([]byte{14, 0x10})
+	binary.Write(&f, le, uint16(2000))       // nolint: errcheck
+	binary.Write(&f, le, uint32(data.Len())) // nolint: errcheck
+	f.WriteString(".FIT")
+	f.Write([]byte{0, 0})
+	f.Write(data.Bytes())
+	f.Write([]byte{0, 0})
+	return f.Bytes()
+}
+
+// fitStart is 2018-03-06T19:00:00Z, in seconds since the FIT epoch.
+var fitStart = uint32(at("2018-03-06T19:00:00Z").Sub(fitEpoch).Seconds())
+
+func TestImportFile(t *testing.T) {
+	gpx, err := ImportFile("run.gpx", strings.NewReader(gpxText))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if gpx.Name != "Morning Run" || gpx.Type != strava.ActivityTypes.Run || !gpx.StartDate.Equal(at("2018-03-02T21:00:00Z")) {
+		t.Errorf("Unexpected GPX activity %+v", gpx)
+	}
+	if math.Abs(gpx.Distance-2001) > 5 || gpx.ElapsedTime != 900 || gpx.MovingTime != 600 || gpx.TotalElevationGain != 25 {
+		t.Errorf("Unexpected GPX totals: %v m, %d s, %d s moving, %v m up", gpx.Distance, gpx.ElapsedTime, gpx.MovingTime, gpx.TotalElevationGain)
+	}
+	if !isImportedID(gpx.Id) {
+		t.Errorf("Expected a made up ID, got %d", gpx.Id)
+	}
+
+	tcx, err := ImportFile("run.tcx", strings.NewReader("\n  "+tcxText))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tcx.Type != strava.ActivityTypes.Run || tcx.Distance != 5000 || tcx.MovingTime != 1500 || tcx.ElapsedTime != 1800 || tcx.TotalElevationGain != 40 {
+		t.Errorf("Unexpected TCX activity %+v", tcx)
+	}
+
+	var gz bytes.Buffer
+	zw := gzip.NewWriter(&gz)
+	zw.Write(fitFile(map[byte]uint32{ // nolint: errcheck
+		fitStartTime:        fitStart,
+		fitSport:            1,
+		fitTotalElapsedTime: 3700 * 1000,
+		fitTotalTimerTime:   3600 * 1000,
+		fitTotalDistance:    1234567,
+	}))
+	zw.Close()
+	fit, err := ImportFile("activities/123.fit.gz", &gz)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fit.Type != strava.ActivityTypes.Run || fit.Distance != 12345.67 || fit.ElapsedTime != 3700 || fit.MovingTime != 3600 {
+		t.Errorf("Unexpected FIT activity %+v", fit)
+	}
+	if !fit.StartDate.Equal(at("2018-03-06T19:00:00Z")) || !fit.StartDateLocal.Equal(at("2018-03-07T06:00:00Z")) {
+		t.Errorf("Unexpected FIT start %s, local %s", fit.StartDate, fit.StartDateLocal)
+	}
+
+	for name, text := range map[string]string{
+		"run.txt": gpxText,
+		"run.gpx": "<gpx></gpx>",
+		"run.tcx": "not xml",
+		"run.fit": "not a fit file",
+	} {
+		if _, err := ImportFile(name, strings.NewReader(text)); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
+
+func TestFITTypes(t *testing.T) {
+	for _, tc := range []struct {
+		sport, subSport uint32
+		typ             strava.ActivityType
+		trainer         bool
+	}{
+		{1, 0, strava.ActivityTypes.Run, false},
+		{1, 1, strava.ActivityTypes.Run, true},
+		{1, 3, "TrailRun", false},
+		{2, 0, strava.ActivityTypes.Ride, false},
+		{17, 0, strava.ActivityTypes.Hike, false},
+		{5, 0, strava.ActivityTypes.Workout, false},
+	} {
+		act, err := parseFIT(bytes.NewReader(fitFile(map[byte]uint32{
+			fitStartTime: fitStart,
+			fitSport:     tc.sport,
+			fitSubSport:  tc.subSport,
+		})))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if act.Type != tc.typ || act.Trainer != tc.trainer {
+			t.Errorf("Sport %d/%d: expected %s (trainer %v), got %s (trainer %v)", tc.sport, tc.subSport, tc.typ, tc.trainer, act.Type, act.Trainer)
+		}
+	}
+}
+
+// activitiesCSV is the start of a recent bulk export's activities.csv, which
+// has two Distance columns.
+const activitiesCSV = `Activity ID,Activity Date,Activity Name,Activity Type,Activity Description,Elapsed Time,Distance,Filename,Elapsed Time,Moving Time,Distance,Elevation Gain
+1001,"Mar 3, 2018, 8:00:00 AM",Parkrun,Run,,1500,5.00,activities/1001.gpx.gz,1500,1450,5003.2,20
+1002,"Mar 4, 2018, 7:00:00 PM",Treadmill,Virtual Run,,1800,6.00,,1800,1800,6000,
+`
+
+func TestImportArchive(t *testing.T) {
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	add := func(name string, b []byte) {
+		w, err := zw.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write(b) // nolint: errcheck
+	}
+	var gz bytes.Buffer
+	gw := gzip.NewWriter(&gz)
+	gw.Write([]byte(gpxText)) // nolint: errcheck
+	gw.Close()
+	add("activities.csv", []byte(activitiesCSV))
+	add("activities/1001.gpx.gz", gz.Bytes())
+	add("activities/9999.tcx", []byte(tcxText))
+	add("activities/broken.fit", []byte("nope"))
+	add("profile.csv", []byte("ignored"))
+	zw.Close()
+
+	acts, problems, err := ReadImport("export.zip", bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(acts) != 3 || len(problems) != 1 {
+		t.Fatalf("Expected 3 activities and 1 problem, got %+v and %v", acts, problems)
+	}
+	// The CSV's numbers win over the file's.
+	parkrun := acts[0]
+	if parkrun.Id != 1001 || parkrun.Name != "Parkrun" || parkrun.Distance != 5003.2 || parkrun.MovingTime != 1450 || parkrun.TotalElevationGain != 20 {
+		t.Errorf("Unexpected activity %+v", parkrun)
+	}
+	if !parkrun.StartDate.Equal(at("2018-03-03T08:00:00Z")) {
+		t.Errorf("Expected the CSV's start date, got %s", parkrun.StartDate)
+	}
+	// Activities without a file come from the CSV alone.
+	if treadmill := acts[1]; treadmill.Id != 1002 || treadmill.Type != "VirtualRun" || treadmill.Distance != 6000 || treadmill.TotalElevationGain != 0 {
+		t.Errorf("Unexpected activity %+v", treadmill)
+	}
+	// Files that aren't in the CSV are imported too.
+	if tcx := acts[2]; !isImportedID(tcx.Id) || tcx.Distance != 5000 {
+		t.Errorf("Unexpected activity %+v", tcx)
+	}
+	if !strings.Contains(problems[0].Error(), "broken.fit") {
+		t.Errorf("Expected the broken file to be reported, got %v", problems[0])
+	}
+
+	weeks := SummarizeWeeks(acts, DefaultWeekStart, AllEndurance(), InclusionPolicy{})
+	if len(weeks) != 1 || weeks[0].Count != 3 {
+		t.Errorf("Expected the imported activities to be summarised, got %+v", weeks)
+	}
+}
+
+func TestParseActivitiesCSV(t *testing.T) {
+	// Older exports have one Distance column, in kilometres, and ISO dates.
+	rows, err := parseActivitiesCSV(strings.NewReader("Activity ID,Activity Date,Activity Name,Activity Type,Elapsed Time,Distance\n" +
+		"7,2015-06-01 06:30:00,Old run,Run,3600,\"10,000.5\"\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	act := &strava.ActivitySummary{}
+	rows[0].apply(act)
+	if act.Id != 7 || act.Distance != 10000500 || act.ElapsedTime != 3600 || !act.StartDate.Equal(time.Date(2015, 6, 1, 6, 30, 0, 0, time.UTC)) {
+		t.Errorf("Unexpected activity %+v", act)
+	}
+
+	for _, text := range []string{
+		"",
+		"Activity Name\nrun\n",
+		"Activity ID,Activity Date\nabc,2015-06-01 06:30:00\n",
+		"Activity ID,Activity Date\n1,yesterday\n",
+		"Activity ID,Activity Date,Distance\n1,2015-06-01 06:30:00,far\n",
+	} {
+		if _, err := parseActivitiesCSV(strings.NewReader(text)); err == nil {
+			t.Errorf("%q: expected an error", text)
+		}
+	}
+}
+
+func TestLocalizeActivities(t *testing.T) {
+	// Starting at midnight on Saturday in Sydney, which is still Friday in UTC.
+	gpx, err := ImportFile("run.gpx", strings.NewReader(strings.Replace(gpxText, "2018-03-02T21:", "2018-03-02T13:", -1)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	fit, err := parseFIT(bytes.NewReader(fitFile(map[byte]uint32{fitStartTime: fitStart})))
+	if err != nil {
+		t.Fatal(err)
+	}
+	stored := []*strava.ActivitySummary{
+		{TimeZone: "(GMT+00:00) Europe/London"},
+		{TimeZone: "(GMT+11:00) Australia/Sydney"},
+		{},
+	}
+	loc, err := importLocation("", stored)
+	if err != nil || loc.String() != "Australia/Sydney" {
+		t.Fatalf("Expected the latest activity's time zone, got %v (%v)", loc, err)
+	}
+	localizeActivities([]*strava.ActivitySummary{gpx, fit}, loc)
+	if !gpx.StartDateLocal.Equal(at("2018-03-03T00:00:00Z")) || gpx.TimeZone != "(GMT+11:00) Australia/Sydney" {
+		t.Errorf("Unexpected local start %s in %q", gpx.StartDateLocal, gpx.TimeZone)
+	}
+	if weeks := ComputeWeeklySummaries([]*strava.ActivitySummary{gpx}, time.Saturday); len(weeks) != 1 || !weeks[0].Date.Equal(week1) {
+		t.Errorf("Expected the run in the week starting %s, got %+v", week1, weeks)
+	}
+	// FIT files record their own local time.
+	if !fit.StartDateLocal.Equal(at("2018-03-07T06:00:00Z")) || fit.TimeZone != "" {
+		t.Errorf("Expected the FIT file's own local time, got %s in %q", fit.StartDateLocal, fit.TimeZone)
+	}
+
+	if loc, err := importLocation("Europe/London", stored); err != nil || loc.String() != "Europe/London" {
+		t.Errorf("Expected the named time zone, got %v (%v)", loc, err)
+	}
+	if loc, err := importLocation("", nil); err != nil || loc != nil {
+		t.Errorf("Expected no time zone without any activities, got %v (%v)", loc, err)
+	}
+	if _, err := importLocation("Nowhere/Special", nil); err == nil {
+		t.Error("Expected an unknown time zone to be an error")
+	}
+}
+
+func TestUserConnected(t *testing.T) {
+	if (&User{FirstName: "offline"}).Connected() {
+		t.Error("Expected a user without tokens not to be connected")
+	}
+	if !(&User{RefreshToken: "r"}).Connected() {
+		t.Error("Expected a user with a refresh token to be connected")
+	}
+}
+
+func TestImportKeepsStoredActivities(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemoryStore()
+	if _, err := RegisterOfflineUser(ctx, store, 1, "alice"); err != nil {
+		t.Fatal(err)
+	}
+	// The parkrun was synced from Strava, which knows more about it than
+	// the export.
+	synced := run(at("2018-03-03T08:00:00Z"), 25*time.Minute, 5000)
+	synced.Id = 1001
+	synced.Name = "Parkrun PB"
+	synced.Trainer = true
+	synced.Private = true
+	if err := store.PutActivities(ctx, 1, []*strava.ActivitySummary{synced}); err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(NewHandler(&Env{Store: store, Admin: RequireToken("secret")}))
+	defer srv.Close()
+
+	var zipped bytes.Buffer
+	zw := zip.NewWriter(&zipped)
+	w, err := zw.Create("activities.csv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Write([]byte(activitiesCSV)) // nolint: errcheck
+	zw.Close()
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	mw.WriteField("athlete_id", "1")  // nolint: errcheck
+	mw.WriteField("time_zone", "UTC") // nolint: errcheck
+	fw, err := mw.CreateFormFile("file", "export.zip")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fw.Write(zipped.Bytes()) // nolint: errcheck
+	mw.Close()
+	req, err := http.NewRequest("POST", srv.URL+"/admin/import", &body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	req.Header.Set("Authorization", "Bearer secret")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := "imported 1 activities\nskipped 1 activities that were already stored\n"; string(b) != expected {
+		t.Errorf("Expected %q, got %q", expected, b)
+	}
+
+	acts, err := store.GetActivities(ctx, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(acts) != 2 {
+		t.Fatalf("Expected the parkrun and the treadmill run, got %+v", acts)
+	}
+	if parkrun := acts[0]; parkrun.Name != "Parkrun PB" || !parkrun.Trainer || !parkrun.Private || parkrun.ElapsedTime != synced.ElapsedTime {
+		t.Errorf("Expected the synced parkrun to be kept, got %+v", parkrun)
+	}
+	if treadmill := acts[1]; treadmill.Id != 1002 || treadmill.Name != "Treadmill" {
+		t.Errorf("Expected the treadmill run to be imported, got %+v", treadmill)
+	}
+}
@@ -0,0 +1,319 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	strava "github.com/strava/go.strava"
+)
+
+// PeriodKind is how long a leaderboard period is.
+type PeriodKind string
+
+const (
+	WeekPeriod  PeriodKind = "week"
+	MonthPeriod PeriodKind = "month"
+)
+
+// Period is a range of calendar days, from Start up to but not including End.
+type Period struct {
+	Kind       PeriodKind
+	Start, End time.Time
+}
+
+// NewPeriod returns the week or month that day falls in. Weeks start on weekStart.
+func NewPeriod(kind PeriodKind, day time.Time, weekStart time.Weekday) Period {
+	if kind == MonthPeriod {
+		start := time.Date(day.Year(), day.Month(), 1, 0, 0, 0, 0, time.UTC)
+		return Period{Kind: kind, Start: start, End: start.AddDate(0, 1, 0)}
+	}
+	start := WeekStart(day, weekStart)
+	return Period{Kind: WeekPeriod, Start: start, End: start.AddDate(0, 0, 7)}
+}
+
+// ParsePeriodKind parses "week" or "month".
+func ParsePeriodKind(s string) (PeriodKind, error) {
+	switch k := PeriodKind(strings.ToLower(s)); k {
+	case WeekPeriod, MonthPeriod:
+		return k, nil
+	}
+	return "", fmt.Errorf("period must be week or month, not %q", s)
+}
+
+// LastDay is the last day in the period.
+func (p Period) LastDay() time.Time {
+	return p.End.AddDate(0, 0, -1)
+}
+
+// contains says whether the calendar day d is in the period.
+func (p Period) contains(d time.Time) bool {
+	return !d.Before(p.Start) && d.Before(p.End)
+}
+
+// LeaderboardMetric is what runners are ranked by.
+type LeaderboardMetric string
+
+const (
+	ByDistance LeaderboardMetric = "distance"
+	ByTime     LeaderboardMetric = "time"
+	ByCount    LeaderboardMetric = "count"
+	ByStreak   LeaderboardMetric = "streak"
+)
+
+// ParseLeaderboardMetric parses the name of a metric, e.g. "distance".
+func ParseLeaderboardMetric(s string) (LeaderboardMetric, error) {
+	switch m := LeaderboardMetric(strings.ToLower(s)); m {
+	case ByDistance, ByTime, ByCount, ByStreak:
+		return m, nil
+	}
+	return "", fmt.Errorf("metric must be distance, time, count or streak, not %q", s)
+}
+
+// Runner is one user's activities, as input to a leaderboard.
+type Runner struct {
+	AthleteID  int64
+	Name       string
+	Activities []*strava.ActivitySummary
+
+	// Why the user's activities couldn't be loaded, if they couldn't.
+	Err error
+}
+
+// RunStats adds up some runs.
+type RunStats struct {
+	// Total distance run, in metres.
+	Distance float64
+
+	// Total elapsed time of the runs.
+	Time time.Duration
+
+	// How many runs were done.
+	Count int
+}
+
+func (s *RunStats) add(o RunStats) {
+	s.Distance += o.Distance
+	s.Time += o.Time
+	s.Count += o.Count
+}
+
+// LeaderboardEntry is one runner's place on the leaderboard.
+type LeaderboardEntry struct {
+	AthleteID int64
+	Name      string
+
+	// The runner's position, starting at 1. Runners who tie share a rank.
+	// Runners whose activities couldn't be loaded have no rank.
+	Rank int
+
+	RunStats
+
+	// The most days in a row the runner ran on during the period.
+	Streak int
+
+	Err error
+}
+
+// LeaderboardOptions says what a leaderboard covers.
+type LeaderboardOptions struct {
+	Period Period
+	Metric LeaderboardMetric
+
+	// The types of activity to count. Nil counts just runs.
+	Types ActivityTypeSet
+
+	// Which activities count, and how much.
+	Policy InclusionPolicy
+
+	// The units distances are shown in. Empty means metric.
+	Units Units
+}
+
+// Leaderboard ranks runners over a period.
+type Leaderboard struct {
+	LeaderboardOptions
+
+	// The runners in order of rank, followed by those with no rank.
+	Entries []LeaderboardEntry
+
+	// The whole group's running, and how many runners were ranked.
+	Total  RunStats
+	Ranked int
+}
+
+// AverageDistance is the average distance per ranked runner, in metres.
+func (lb *Leaderboard) AverageDistance() float64 {
+	if lb.Ranked == 0 {
+		return 0
+	}
+	return lb.Total.Distance / float64(lb.Ranked)
+}
+
+// AverageTime is the average time spent running per ranked runner.
+func (lb *Leaderboard) AverageTime() time.Duration {
+	if lb.Ranked == 0 {
+		return 0
+	}
+	return lb.Total.Time / time.Duration(lb.Ranked)
+}
+
+// AverageCount is the average number of runs per ranked runner.
+func (lb *Leaderboard) AverageCount() float64 {
+	if lb.Ranked == 0 {
+		return 0
+	}
+	return float64(lb.Total.Count) / float64(lb.Ranked)
+}
+
+// ComputeLeaderboard ranks runners by the options' metric over the activities
+// they did during its period.
+func ComputeLeaderboard(runners []Runner, opts LeaderboardOptions) *Leaderboard {
+	lb := &Leaderboard{LeaderboardOptions: opts}
+	metric := opts.Metric
+	for _, r := range runners {
+		e := LeaderboardEntry{AthleteID: r.AthleteID, Name: r.Name, Err: r.Err}
+		if r.Err == nil {
+			e.RunStats, e.Streak = periodStats(r.Activities, opts)
+			lb.Total.add(e.RunStats)
+			lb.Ranked++
+		}
+		lb.Entries = append(lb.Entries, e)
+	}
+	sort.SliceStable(lb.Entries, func(i, j int) bool {
+		a, b := lb.Entries[i], lb.Entries[j]
+		if (a.Err == nil) != (b.Err == nil) {
+			return a.Err == nil
+		}
+		if c := compareEntries(a, b, metric); c != 0 {
+			return c > 0
+		}
+		return a.Name < b.Name
+	})
+	for i := range lb.Entries {
+		e := &lb.Entries[i]
+		if e.Err != nil {
+			break
+		}
+		e.Rank = i + 1
+		if i > 0 && compareEntries(*e, lb.Entries[i-1], metric) == 0 {
+			e.Rank = lb.Entries[i-1].Rank
+		}
+	}
+	return lb
+}
+
+// compareEntries compares two entries by metric, returning a positive number
+// if a is ahead of b, negative if it's behind and 0 if they tie.
+func compareEntries(a, b LeaderboardEntry, metric LeaderboardMetric) float64 {
+	switch metric {
+	case ByTime:
+		return float64(a.Time - b.Time)
+	case ByCount:
+		return float64(a.Count - b.Count)
+	case ByStreak:
+		return float64(a.Streak - b.Streak)
+	}
+	return a.Distance - b.Distance
+}
+
+// periodStats adds up the activities that count under opts and started
+// during its period, by their local calendar day, and finds the longest
+// streak of days with one.
+func periodStats(activities []*strava.ActivitySummary, opts LeaderboardOptions) (RunStats, int) {
+	var stats RunStats
+	days := map[time.Time]bool{}
+	period := opts.Period
+	for _, act := range activities {
+		day := calendarDay(LocalStartDate(act))
+		if !opts.Types.Includes(act.Type) || !period.contains(day) || opts.Policy.Excludes(act) {
+			continue
+		}
+		act = opts.Policy.Weigh(act)
+		stats.add(RunStats{
+			Distance: act.Distance,
+			Time:     time.Duration(act.ElapsedTime) * time.Second,
+			Count:    1,
+		})
+		days[day] = true
+	}
+	streak, longest := 0, 0
+	for d := period.Start; d.Before(period.End); d = d.AddDate(0, 0, 1) {
+		streak++
+		if !days[d] {
+			streak = 0
+		}
+		if streak > longest {
+			longest = streak
+		}
+	}
+	return stats, longest
+}
+
+// LoadRunners loads every user's stored activities for a leaderboard. Users
+// whose activities couldn't be loaded have Err set. Users whose last sync
+// failed are ranked on the activities that were synced before it.
+func LoadRunners(ctx context.Context, store ActivityStore, users []User) []Runner {
+	results := FanOut(ctx, 0, indices(len(users)), func(ctx context.Context, i int) (Runner, error) {
+		acts, err := store.GetActivities(ctx, users[i].ID)
+		return Runner{Activities: acts}, err
+	})
+	result := make([]Runner, len(users))
+	for i, r := range results {
+		result[i] = r.Value
+		if r.Err != nil {
+			logErrorf(ctx, "Failed to load activities for %s: %s", users[i].FirstName, r.Err)
+			result[i].Err = r.Err
+		}
+		result[i].AthleteID = users[i].ID
+		result[i].Name = users[i].FirstName
+	}
+	return result
+}
+
+// leaderboardParams reads the period, date, week_start, metric, types,
+// exclude, trainer_percent and units query parameters. By default it ranks
+// runs by distance over the week containing now.
+func leaderboardParams(r *http.Request, now time.Time) (LeaderboardOptions, error) {
+	kind, weekStart, day := WeekPeriod, DefaultWeekStart, calendarDay(now)
+	opts := LeaderboardOptions{Metric: ByDistance}
+	var err error
+	if s := r.FormValue("period"); s != "" {
+		if kind, err = ParsePeriodKind(s); err != nil {
+			return opts, err
+		}
+	}
+	if s := r.FormValue("metric"); s != "" {
+		if opts.Metric, err = ParseLeaderboardMetric(s); err != nil {
+			return opts, err
+		}
+	}
+	if s := r.FormValue("types"); s != "" {
+		if opts.Types, err = ParseActivityTypes(s); err != nil {
+			return opts, err
+		}
+	}
+	if opts.Policy, err = ParseInclusionPolicy(r.FormValue("exclude"), r.FormValue("trainer_percent")); err != nil {
+		return opts, err
+	}
+	if s := r.FormValue("units"); s != "" {
+		if opts.Units, err = ParseUnits(s); err != nil {
+			return opts, err
+		}
+	}
+	if s := r.FormValue("week_start"); s != "" {
+		if weekStart, err = ParseWeekday(s); err != nil {
+			return opts, err
+		}
+	}
+	if s := r.FormValue("date"); s != "" {
+		if day, err = time.Parse(dateFormat, s); err != nil {
+			return opts, fmt.Errorf("date must be a date like %s", dateFormat)
+		}
+	}
+	opts.Period = NewPeriod(kind, day, weekStart)
+	return opts, nil
+}
@@ -0,0 +1,162 @@
+package handlers
+
+import (
+	"bytes"
+	"errors"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	strava "github.com/strava/go.strava"
+)
+
+func TestNewPeriod(t *testing.T) {
+	for _, tc := range []struct {
+		kind       PeriodKind
+		day        time.Time
+		start, end string
+	}{
+		{WeekPeriod, tuesday, "2018-03-03", "2018-03-10"},
+		{MonthPeriod, tuesday, "2018-03-01", "2018-04-01"},
+		{MonthPeriod, Must(time.Parse(dateFormat, "2018-12-31")), "2018-12-01", "2019-01-01"},
+	} {
+		p := NewPeriod(tc.kind, tc.day, DefaultWeekStart)
+		if p.Start.Format(dateFormat) != tc.start || p.End.Format(dateFormat) != tc.end {
+			t.Errorf("%s of %s: expected %s to %s, got %v", tc.kind, tc.day, tc.start, tc.end, p)
+		}
+	}
+}
+
+func TestLeaderboard(t *testing.T) {
+	week := NewPeriod(WeekPeriod, saturday, DefaultWeekStart)
+	runners := []Runner{
+		{AthleteID: 1, Name: "slow", Activities: []*strava.ActivitySummary{
+			run(saturday.Add(morning), time.Hour, short),
+			run(saturday.Add(24*time.Hour+morning), time.Hour, short),
+			run(monday.Add(morning), time.Hour, short),
+			// Outside the week.
+			run(nextSaturday.Add(morning), time.Hour, long),
+			ride(tuesday.Add(morning), time.Hour, long),
+		}},
+		{AthleteID: 2, Name: "broken", Err: errors.New("datastore is down")},
+		{AthleteID: 3, Name: "fast", Activities: []*strava.ActivitySummary{
+			run(saturday.Add(morning), 2*time.Hour, 2*long),
+		}},
+		{AthleteID: 4, Name: "lazy"},
+	}
+
+	lb := ComputeLeaderboard(runners, LeaderboardOptions{Period: week, Metric: ByDistance})
+	var names []string
+	for _, e := range lb.Entries {
+		names = append(names, e.Name)
+	}
+	if expected := []string{"fast", "slow", "lazy", "broken"}; !reflect.DeepEqual(names, expected) {
+		t.Errorf("Expected order %v, got %v", expected, names)
+	}
+	slow := lb.Entries[1]
+	if slow.Rank != 2 || slow.Count != 3 || slow.Distance != 3*short || slow.Time != 3*time.Hour || slow.Streak != 3 {
+		t.Errorf("Unexpected entry for slow: %+v", slow)
+	}
+	if lb.Entries[3].Rank != 0 {
+		t.Errorf("Expected the runner who couldn't be loaded to have no rank, got %+v", lb.Entries[3])
+	}
+	if expected := (RunStats{Distance: 3*short + 2*long, Time: 5 * time.Hour, Count: 4}); lb.Total != expected {
+		t.Errorf("Expected total %+v, got %+v", expected, lb.Total)
+	}
+	if lb.Ranked != 3 || lb.AverageTime() != 100*time.Minute || lb.AverageCount() != 4.0/3 {
+		t.Errorf("Unexpected averages: %v, %v over %d", lb.AverageTime(), lb.AverageCount(), lb.Ranked)
+	}
+
+	// Ties share a rank, and are in name order.
+	lb = ComputeLeaderboard(runners, LeaderboardOptions{Period: week, Metric: ByTime})
+	var ranks []int
+	for _, e := range lb.Entries {
+		ranks = append(ranks, e.Rank)
+	}
+	if expected := []int{1, 2, 3, 0}; !reflect.DeepEqual(ranks, expected) {
+		t.Errorf("Expected ranks %v, got %v", expected, ranks)
+	}
+	if lb.Entries[0].Name != "slow" {
+		t.Errorf("Expected slow to lead on time, got %+v", lb.Entries[0])
+	}
+	lb = ComputeLeaderboard(runners[2:], LeaderboardOptions{Period: week, Metric: ByCount})
+	if lb.Entries[0].Rank != 1 || lb.Entries[1].Name != "lazy" || lb.Entries[1].Rank != 2 {
+		t.Errorf("Unexpected ranking by count: %+v", lb.Entries)
+	}
+	lb = ComputeLeaderboard([]Runner{runners[0], runners[2], {Name: "also fast", Activities: runners[2].Activities}}, LeaderboardOptions{Period: week, Metric: ByStreak})
+	if lb.Entries[1].Name != "also fast" || lb.Entries[1].Rank != 2 || lb.Entries[2].Rank != 2 {
+		t.Errorf("Unexpected ranking by streak: %+v", lb.Entries)
+	}
+
+	// The HTML page shows everyone, including the group total.
+	buf := bytes.NewBuffer(nil)
+	lb = ComputeLeaderboard(runners, LeaderboardOptions{Period: week, Metric: ByDistance})
+	if err := leaderboardTpl.Execute(buf, leaderboardTplArgs{lb, url.Values{"week_start": {"monday"}, "exclude": {"trainer"}, "metric": {"time"}}}); err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range []string{"Week of 3 Mar 2018", "fast", "broken", "39.2KM"} {
+		if !strings.Contains(buf.String(), s) {
+			t.Errorf("Expected the page to contain %q, got %s", s, buf)
+		}
+	}
+	// Links only change one thing about the page.
+	for _, s := range []string{
+		`href="?exclude=trainer&amp;metric=distance&amp;week_start=monday"`,
+		`href="?exclude=trainer&amp;metric=time&amp;period=month&amp;week_start=monday"`,
+		`href="?exclude=trainer&amp;metric=time&amp;units=imperial&amp;week_start=monday"`,
+	} {
+		if !strings.Contains(buf.String(), s) {
+			t.Errorf("Expected the page to link to %s, got %s", s, buf)
+		}
+	}
+}
+
+func TestLeaderboardParams(t *testing.T) {
+	now := tuesday.Add(afternoon)
+	for _, tc := range []struct {
+		query string
+		opts  LeaderboardOptions
+		err   bool
+	}{
+		{"", LeaderboardOptions{Period: NewPeriod(WeekPeriod, now, DefaultWeekStart), Metric: ByDistance}, false},
+		{
+			"period=month&date=2018-02-14&metric=Streak&types=run,walk",
+			LeaderboardOptions{
+				Period: NewPeriod(MonthPeriod, Must(time.Parse(dateFormat, "2018-02-01")), DefaultWeekStart),
+				Metric: ByStreak,
+				Types:  ActivityTypeSet{"Run": true, "Walk": true},
+			},
+			false,
+		},
+		{"week_start=monday", LeaderboardOptions{Period: NewPeriod(WeekPeriod, monday, time.Monday), Metric: ByDistance}, false},
+		{"units=imperial", LeaderboardOptions{Period: NewPeriod(WeekPeriod, now, DefaultWeekStart), Metric: ByDistance, Units: Imperial}, false},
+		{"units=furlongs", LeaderboardOptions{}, true},
+		{"period=year", LeaderboardOptions{}, true},
+		{"metric=speed", LeaderboardOptions{}, true},
+		{
+			"exclude=manual&trainer_percent=50",
+			LeaderboardOptions{
+				Period: NewPeriod(WeekPeriod, now, DefaultWeekStart),
+				Metric: ByDistance,
+				Policy: InclusionPolicy{ExcludeManual: true, TrainerDiscount: 0.5},
+			},
+			false,
+		},
+		{"types=swim", LeaderboardOptions{}, true},
+		{"exclude=boring", LeaderboardOptions{}, true},
+		{"date=yesterday", LeaderboardOptions{}, true},
+	} {
+		r := httptest.NewRequest("GET", "/leaderboard?"+tc.query, nil)
+		opts, err := leaderboardParams(r, now)
+		if (err != nil) != tc.err {
+			t.Errorf("%q: unexpected error %v", tc.query, err)
+			continue
+		}
+		if !tc.err && !reflect.DeepEqual(opts, tc.opts) {
+			t.Errorf("%q: expected %+v, got %+v", tc.query, tc.opts, opts)
+		}
+	}
+}
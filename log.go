@@ -0,0 +1,47 @@
+package handlers
+
+import (
+	"context"
+	"log"
+)
+
+// Logger is where the app writes its logs.
+type Logger interface {
+	Infof(ctx context.Context, format string, args ...interface{})
+	Errorf(ctx context.Context, format string, args ...interface{})
+}
+
+type loggerKey struct{}
+
+// WithLogger makes logs written with ctx go to l.
+func WithLogger(ctx context.Context, l Logger) context.Context {
+	return context.WithValue(ctx, loggerKey{}, l)
+}
+
+// loggerFrom gets the logger set with WithLogger, or one that writes to the
+// standard logger if there isn't one.
+func loggerFrom(ctx context.Context) Logger {
+	if l, ok := ctx.Value(loggerKey{}).(Logger); ok {
+		return l
+	}
+	return stdLogger{}
+}
+
+func logInfof(ctx context.Context, format string, args ...interface{}) {
+	loggerFrom(ctx).Infof(ctx, format, args...)
+}
+
+func logErrorf(ctx context.Context, format string, args ...interface{}) {
+	loggerFrom(ctx).Errorf(ctx, format, args...)
+}
+
+// stdLogger writes to the standard logger.
+type stdLogger struct{}
+
+func (stdLogger) Infof(ctx context.Context, format string, args ...interface{}) {
+	log.Printf("INFO: "+format, args...)
+}
+
+func (stdLogger) Errorf(ctx context.Context, format string, args ...interface{}) {
+	log.Printf("ERROR: "+format, args...)
+}
@@ -0,0 +1,194 @@
+package handlers
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+// stravaScopes are the permissions asked for when users connect Strava:
+// their profile, including their preferred units, and all their activities,
+// including private ones so that the inclusion policy can decide whether to
+// count them.
+const stravaScopes = "read,activity:read_all,profile:read_all"
+
+// activityScopes are the scopes that let us see a user's activities, one of
+// which they have to grant.
+var activityScopes = []string{"activity:read", "activity:read_all"}
+
+// stateCookie holds the state that the OAuth callback has to come back with,
+// so that nobody can log someone else in with their own Strava code.
+const stateCookie = "oauth_state"
+
+// stateLength is how long users have to connect Strava once they've started.
+const stateLength = 10 * time.Minute
+
+var (
+	errBadState = errors.New("that login link has expired or wasn't made for you; please try again")
+	errDenied   = errors.New("you need to authorise the app on Strava to log in")
+
+	errNotInvited = errors.New("only members of the group can log in; ask an admin to invite you")
+
+	errNoActivityScope = errors.New(`Strava didn't share your activities with us. Please try again and leave "View data about your activities" ticked`)
+)
+
+// newState makes a random OAuth state.
+func newState() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// authorizeURL is where users go to give us access to their Strava data.
+func (e *Env) authorizeURL(r *http.Request, state string) string {
+	cfg := oauthConfig()
+	cfg.RedirectURL = e.baseURL(r) + "/oauth_callback"
+	return cfg.AuthCodeURL(state,
+		oauth2.SetAuthURLParam("scope", stravaScopes),
+		oauth2.SetAuthURLParam("approval_prompt", "auto"))
+}
+
+// checkState makes sure the callback came back with the state that was made
+// for this browser.
+func checkState(r *http.Request) error {
+	c, err := r.Cookie(stateCookie)
+	if err != nil || c.Value == "" {
+		return errBadState
+	}
+	if subtle.ConstantTimeCompare([]byte(r.FormValue("state")), []byte(c.Value)) != 1 {
+		return errBadState
+	}
+	return nil
+}
+
+// checkScopes makes sure the user granted a scope that lets us see their
+// activities. Strava lists the granted scopes, separated by commas.
+func checkScopes(granted string) error {
+	for _, s := range strings.Split(granted, ",") {
+		for _, needed := range activityScopes {
+			if s == needed {
+				return nil
+			}
+		}
+	}
+	return errNoActivityScope
+}
+
+// checkInvited makes sure the athlete may join the group, because they're in
+// it already or they've been invited. Otherwise anyone could see everyone's
+// training by connecting Strava.
+func (e *Env) checkInvited(ctx context.Context, id int64) error {
+	for _, invited := range e.Invited {
+		if invited == id {
+			return nil
+		}
+	}
+	_, err := e.Store.GetUser(ctx, id)
+	if err == ErrNoSuchUser {
+		return errNotInvited
+	}
+	return err
+}
+
+// setStateCookie remembers the state for the callback to check, or forgets
+// it if state is empty.
+func (e *Env) setStateCookie(w http.ResponseWriter, r *http.Request, state string) {
+	maxAge := int(stateLength / time.Second)
+	if state == "" {
+		maxAge = -1
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     stateCookie,
+		Value:    state,
+		Path:     "/",
+		MaxAge:   maxAge,
+		HttpOnly: true,
+		Secure:   strings.HasPrefix(e.baseURL(r), "https://"),
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// loginError shows the front page with why the user couldn't log in.
+func loginError(w http.ResponseWriter, status int, err error) {
+	w.WriteHeader(status)
+	if err := loginTpl.Execute(w, loginTplArgs{Error: err.Error()}); err != nil {
+		handleError(w, err)
+	}
+}
+
+// registerLoginHandlers sets up logging in with Strava:
+//
+//	GET /login
+//	    Sends the user to Strava to authorise the app, remembering a random
+//	    state in a cookie.
+//	GET /oauth_callback
+//	    Where Strava sends them back. Registers the user and logs them in if
+//	    the state matches, they let us see their activities, and they're
+//	    a member of the group or invited to join it.
+func registerLoginHandlers(mux *http.ServeMux, env *Env) {
+	store := env.Store
+
+	mux.HandleFunc("/login", func(w http.ResponseWriter, r *http.Request) {
+		state, err := newState()
+		if err != nil {
+			handleError(w, err)
+			return
+		}
+		env.setStateCookie(w, r, state)
+		http.Redirect(w, r, env.authorizeURL(r, state), http.StatusFound)
+	})
+
+	mux.HandleFunc("/oauth_callback", func(w http.ResponseWriter, r *http.Request) {
+		ctx := env.context(r)
+		if err := checkState(r); err != nil {
+			loginError(w, http.StatusBadRequest, err)
+			return
+		}
+		// The state can only be used once.
+		env.setStateCookie(w, r, "")
+		if r.FormValue("error") == "access_denied" {
+			loginError(w, http.StatusForbidden, errDenied)
+			return
+		}
+		if err := checkScopes(r.FormValue("scope")); err != nil {
+			loginError(w, http.StatusForbidden, err)
+			return
+		}
+		auth, err := ExchangeCode(env.oauthContext(ctx), r.FormValue("code"))
+		if err != nil {
+			handleError(w, err)
+			return
+		}
+		err = env.checkInvited(ctx, auth.Athlete.Id)
+		if err == errNotInvited {
+			loginError(w, http.StatusForbidden, err)
+			return
+		}
+		if err != nil {
+			handleError(w, err)
+			return
+		}
+		now := time.Now()
+		u, err := RegisterNewUser(ctx, store, auth, now)
+		if err != nil {
+			handleError(w, err)
+			return
+		}
+		s, err := NewSession(u.ID, now)
+		if err != nil {
+			handleError(w, err)
+			return
+		}
+		env.setSession(w, r, s)
+		http.Redirect(w, r, "/me", http.StatusFound)
+	})
+}
@@ -0,0 +1,161 @@
+package handlers
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestCheckScopes(t *testing.T) {
+	for _, tc := range []struct {
+		granted string
+		ok      bool
+	}{
+		{"read,activity:read_all,profile:read_all", true},
+		{"read,activity:read", true},
+		{"read,profile:read_all", false},
+		{"read", false},
+		{"", false},
+	} {
+		if err := checkScopes(tc.granted); (err == nil) != tc.ok {
+			t.Errorf("%q: expected ok=%v, got %v", tc.granted, tc.ok, err)
+		}
+	}
+}
+
+func TestLogin(t *testing.T) {
+	_, done := newFakeTokenServer(t)
+	defer done()
+	store := NewMemoryStore()
+	env := &Env{Store: store, SessionKey: []byte(testSessionKey)}
+	srv := httptest.NewServer(NewHandler(env))
+	defer srv.Close()
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+
+	resp, err := client.Get(srv.URL + "/login")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	loc, err := url.Parse(resp.Header.Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	state := loc.Query().Get("state")
+	if resp.StatusCode != http.StatusFound || state == "" || loc.Query().Get("scope") != stravaScopes {
+		t.Fatalf("Expected a redirect to Strava with a state and scopes, got %s %s", resp.Status, loc)
+	}
+	if loc.Query().Get("redirect_uri") != srv.URL+"/oauth_callback" {
+		t.Errorf("Unexpected redirect_uri in %s", loc)
+	}
+	cookies := resp.Cookies()
+	if len(cookies) != 1 || cookies[0].Name != stateCookie || cookies[0].Value != state {
+		t.Fatalf("Expected the state to be kept in a cookie, got %v", cookies)
+	}
+
+	callback := func(cookie string, q url.Values) (*http.Response, string) {
+		req, err := http.NewRequest("GET", srv.URL+"/oauth_callback?"+q.Encode(), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cookie != "" {
+			req.AddCookie(&http.Cookie{Name: stateCookie, Value: cookie})
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		b, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp, string(b)
+	}
+	good := url.Values{"code": {"good-code"}, "state": {state}, "scope": {"read,activity:read_all,profile:read_all"}}
+	with := func(key, value string) url.Values {
+		q := url.Values{}
+		for k, v := range good {
+			q[k] = v
+		}
+		if value == "" {
+			q.Del(key)
+		} else {
+			q.Set(key, value)
+		}
+		return q
+	}
+
+	// Callbacks that didn't start here are turned away.
+	for _, tc := range []struct {
+		name   string
+		cookie string
+		q      url.Values
+	}{
+		{"no state", state, with("state", "")},
+		{"wrong state", state, with("state", "someone-elses")},
+		{"no cookie", "", good},
+	} {
+		if resp, _ := callback(tc.cookie, tc.q); resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("%s: expected %d, got %s", tc.name, http.StatusBadRequest, resp.Status)
+		}
+	}
+
+	// So are users who don't let us see their activities.
+	resp, body := callback(state, with("scope", "read,profile:read_all"))
+	if resp.StatusCode != http.StatusForbidden || !strings.Contains(body, "View data about your activities") {
+		t.Errorf("Expected to be told to share activities, got %s %s", resp.Status, body)
+	}
+	resp, _ = callback(state, url.Values{"state": {state}, "error": {"access_denied"}})
+	if resp.StatusCode != http.StatusForbidden {
+		t.Errorf("Expected denying access to fail, got %s", resp.Status)
+	}
+
+	// And strangers who haven't been invited.
+	resp, body = callback(state, good)
+	if resp.StatusCode != http.StatusForbidden || !strings.Contains(body, "ask an admin to invite you") {
+		t.Errorf("Expected a stranger to be turned away, got %s %s", resp.Status, body)
+	}
+	for _, c := range resp.Cookies() {
+		if c.Name == sessionCookie {
+			t.Errorf("Expected a stranger not to be logged in, got %v", c)
+		}
+	}
+	if users, err := store.GetUsers(context.Background()); err != nil || len(users) != 0 {
+		t.Errorf("Expected nobody to be registered, got %v, %v", users, err)
+	}
+
+	env.Invited = []int64{1234}
+	resp, _ = callback(state, good)
+	if resp.StatusCode != http.StatusFound || resp.Header.Get("Location") != "/me" {
+		t.Fatalf("Expected to be logged in, got %s", resp.Status)
+	}
+	var session *http.Cookie
+	for _, c := range resp.Cookies() {
+		switch c.Name {
+		case sessionCookie:
+			session = c
+		case stateCookie:
+			if c.MaxAge >= 0 {
+				t.Errorf("Expected the state cookie to be cleared, got %v", c)
+			}
+		}
+	}
+	if session == nil {
+		t.Fatalf("Expected a session cookie, got %v", resp.Cookies())
+	}
+	if _, err := store.GetUser(context.Background(), 1234); err != nil {
+		t.Errorf("Expected the user to be registered, got %v", err)
+	}
+
+	// Members of the group can log in again once they're no longer
+	// invited.
+	env.Invited = nil
+	if resp, _ = callback(state, good); resp.StatusCode != http.StatusFound {
+		t.Errorf("Expected a member to log in again, got %s", resp.Status)
+	}
+}
@@ -0,0 +1,278 @@
+package handlers
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+// TrainingPlan is a user's plan for building up to a race. It is kept in the
+// UserStore.
+type TrainingPlan struct {
+	RaceName string
+	RaceDate time.Time
+
+	// The planned weeks in chronological order.
+	Weeks []PlanWeek
+}
+
+// PlanWeek is the training planned for one week.
+type PlanWeek struct {
+	// The first day of the week.
+	Start time.Time
+
+	// The total distance to run, in metres.
+	Distance float64
+
+	// The distance of the week's long run, in metres.
+	LongRun float64
+}
+
+// PlanProgress compares a week's training with what was planned for it.
+type PlanProgress struct {
+	// The planned total distance and long run distance, in metres.
+	Distance float64
+	LongRun  float64
+
+	// How many weeks after this one the race is. The race week itself is 0.
+	WeeksToRace int
+}
+
+// ApplyPlan fills in each week's planned training from plan, adding empty
+// weeks for planned weeks that have no runs yet. A plan week applies to the
+// summary of the week it starts in. The result is in chronological order.
+func ApplyPlan(weeks []WeekSummary, plan *TrainingPlan, weekStart time.Weekday) []WeekSummary {
+	if plan == nil {
+		return weeks
+	}
+	byDate := make(map[time.Time]int, len(weeks))
+	result := make([]WeekSummary, len(weeks))
+	for i, w := range weeks {
+		result[i] = w
+		byDate[w.Date] = i
+	}
+	raceWeek := WeekStart(plan.RaceDate, weekStart)
+	for _, p := range plan.Weeks {
+		date := WeekStart(p.Start, weekStart)
+		i, ok := byDate[date]
+		if !ok {
+			result = append(result, WeekSummary{Date: date})
+			i = len(result) - 1
+			byDate[date] = i
+		}
+		result[i].Plan = &PlanProgress{
+			Distance:    p.Distance,
+			LongRun:     p.LongRun,
+			WeeksToRace: int(raceWeek.Sub(date).Hours() / (7 * 24)),
+		}
+	}
+	sort.SliceStable(result, func(i, j int) bool {
+		return result[i].Date.Before(result[j].Date)
+	})
+	return result
+}
+
+// planYAML is the YAML form of a training plan, e.g.
+//
+//	race: Sydney Marathon
+//	race_date: 2018-09-16
+//	weeks:
+//	  - week_start: 2018-05-26
+//	    distance_km: 40
+//	    long_run_km: 16
+type planYAML struct {
+	Race     string `yaml:"race"`
+	RaceDate string `yaml:"race_date"`
+	Weeks    []struct {
+		WeekStart  string  `yaml:"week_start"`
+		DistanceKm float64 `yaml:"distance_km"`
+		LongRunKm  float64 `yaml:"long_run_km"`
+	} `yaml:"weeks"`
+}
+
+// ParsePlanYAML reads a training plan written in YAML. Like ParsePlanCSV, it
+// leaves checking the plan as a whole to ReadPlan.
+func ParsePlanYAML(r io.Reader) (*TrainingPlan, error) {
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	var py planYAML
+	if err := yaml.UnmarshalStrict(b, &py); err != nil {
+		return nil, err
+	}
+	plan := &TrainingPlan{RaceName: py.Race}
+	if py.RaceDate != "" {
+		if plan.RaceDate, err = time.Parse(dateFormat, py.RaceDate); err != nil {
+			return nil, fmt.Errorf("race_date must be a date like %s", dateFormat)
+		}
+	}
+	for i, w := range py.Weeks {
+		pw, err := newPlanWeek(w.WeekStart, w.DistanceKm, w.LongRunKm)
+		if err != nil {
+			return nil, fmt.Errorf("week %d: %s", i+1, err)
+		}
+		plan.Weeks = append(plan.Weeks, pw)
+	}
+	return plan, nil
+}
+
+// ParsePlanCSV reads the weeks of a training plan from CSV with the columns
+// week_start, distance_km and long_run_km, in that order, after a header
+// row. CSV has no room for the race, so the caller has to fill it in.
+func ParsePlanCSV(r io.Reader) (*TrainingPlan, error) {
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = 3
+	cr.TrimLeadingSpace = true
+	records, err := cr.ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	if len(records) == 0 || !strings.EqualFold(records[0][0], "week_start") {
+		return nil, errors.New("expected a header row of week_start,distance_km,long_run_km")
+	}
+	plan := &TrainingPlan{}
+	for i, rec := range records[1:] {
+		dist, err := strconv.ParseFloat(rec[1], 64)
+		if err != nil {
+			return nil, fmt.Errorf("row %d: bad distance_km %q", i+2, rec[1])
+		}
+		longRun, err := strconv.ParseFloat(rec[2], 64)
+		if err != nil {
+			return nil, fmt.Errorf("row %d: bad long_run_km %q", i+2, rec[2])
+		}
+		pw, err := newPlanWeek(rec[0], dist, longRun)
+		if err != nil {
+			return nil, fmt.Errorf("row %d: %s", i+2, err)
+		}
+		plan.Weeks = append(plan.Weeks, pw)
+	}
+	return plan, nil
+}
+
+// newPlanWeek makes a plan week from its text form, with distances in kilometres.
+func newPlanWeek(start string, distanceKm, longRunKm float64) (PlanWeek, error) {
+	d, err := time.Parse(dateFormat, start)
+	if err != nil {
+		return PlanWeek{}, fmt.Errorf("week_start must be a date like %s", dateFormat)
+	}
+	if distanceKm < 0 || longRunKm < 0 || longRunKm > distanceKm {
+		return PlanWeek{}, fmt.Errorf("long run of %gkm doesn't fit in %gkm", longRunKm, distanceKm)
+	}
+	return PlanWeek{Start: d, Distance: distanceKm * 1000, LongRun: longRunKm * 1000}, nil
+}
+
+// validate checks the plan is complete and its weeks are in order and end by race day.
+func (p *TrainingPlan) validate() error {
+	if p.RaceDate.IsZero() {
+		return errors.New("the plan has no race date")
+	}
+	if len(p.Weeks) == 0 {
+		return errors.New("the plan has no weeks")
+	}
+	for i, w := range p.Weeks {
+		if i > 0 && !w.Start.After(p.Weeks[i-1].Start) {
+			return fmt.Errorf("week %d doesn't start after the week before it", i+1)
+		}
+		if w.Start.After(p.RaceDate) {
+			return fmt.Errorf("week %d starts after race day", i+1)
+		}
+	}
+	return nil
+}
+
+// ReadPlan reads a training plan from a file, choosing CSV or YAML by the
+// file's extension. race and raceDate fill in the race when they are set,
+// which they have to be for CSV.
+func ReadPlan(name string, r io.Reader, race string, raceDate time.Time) (*TrainingPlan, error) {
+	var plan *TrainingPlan
+	var err error
+	switch strings.ToLower(path.Ext(name)) {
+	case ".csv":
+		plan, err = ParsePlanCSV(r)
+	case ".yaml", ".yml":
+		plan, err = ParsePlanYAML(r)
+	default:
+		return nil, fmt.Errorf("%s isn't a .csv or .yaml file", name)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if race != "" {
+		plan.RaceName = race
+	}
+	if !raceDate.IsZero() {
+		plan.RaceDate = raceDate
+	}
+	return plan, plan.validate()
+}
+
+// readPlanForm reads a training plan uploaded as the plan file of a
+// multipart form, with optional race and race_date fields that override the
+// plan's own.
+func readPlanForm(r *http.Request) (*TrainingPlan, error) {
+	var raceDate time.Time
+	if s := r.FormValue("race_date"); s != "" {
+		var err error
+		if raceDate, err = time.Parse(dateFormat, s); err != nil {
+			return nil, fmt.Errorf("race_date must be a date like %s", dateFormat)
+		}
+	}
+	f, fh, err := r.FormFile("plan")
+	if err != nil {
+		return nil, errors.New("plan must be an uploaded file")
+	}
+	defer f.Close()
+	return ReadPlan(fh.Filename, f, r.FormValue("race"), raceDate)
+}
+
+// registerPlanHandlers sets up importing training plans:
+//
+//	POST /admin/plan
+//	    Replaces a user's training plan. Takes a multipart form with the
+//	    user's athlete_id, the plan as a .csv or .yaml file in plan, and
+//	    optionally race and race_date, which override the plan's own.
+func registerPlanHandlers(mux *http.ServeMux, env *Env) {
+	users := env.Store
+	mux.Handle("/admin/plan", env.admin(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		ctx := env.context(r)
+		id, err := strconv.ParseInt(r.FormValue("athlete_id"), 10, 64)
+		if err != nil {
+			http.Error(w, "athlete_id must be a Strava athlete ID", http.StatusBadRequest)
+			return
+		}
+		plan, err := readPlanForm(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		_, err = users.GetUser(ctx, id)
+		if err == ErrNoSuchUser {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			handleError(w, err)
+			return
+		}
+		if err := users.PutTrainingPlan(ctx, id, plan); err != nil {
+			handleError(w, err)
+			return
+		}
+		w.Write([]byte("ok")) // nolint: errcheck
+	}))
+}
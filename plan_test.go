@@ -0,0 +1,112 @@
+package handlers
+
+import (
+	"math"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	strava "github.com/strava/go.strava"
+)
+
+const planYAMLText = `
+race: Sydney Marathon
+race_date: 2018-03-17
+weeks:
+  - week_start: 2018-03-03
+    distance_km: 20
+    long_run_km: 10
+  - week_start: 2018-03-10
+    distance_km: 30
+    long_run_km: 16
+`
+
+const planCSVText = `week_start,distance_km,long_run_km
+2018-03-03,20,10
+2018-03-10,30,16
+`
+
+var raceDay = Must(time.Parse(dateFormat, "2018-03-17"))
+
+var expectedPlanWeeks = []PlanWeek{
+	{Start: week1, Distance: 20000, LongRun: 10000},
+	{Start: week2, Distance: 30000, LongRun: 16000},
+}
+
+func TestReadPlan(t *testing.T) {
+	plan, err := ReadPlan("plan.yaml", strings.NewReader(planYAMLText), "", time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := &TrainingPlan{RaceName: "Sydney Marathon", RaceDate: raceDay, Weeks: expectedPlanWeeks}
+	if !reflect.DeepEqual(plan, expected) {
+		t.Errorf("YAML: expected %+v, got %+v", expected, plan)
+	}
+
+	plan, err = ReadPlan("plan.CSV", strings.NewReader(planCSVText), "Sydney Marathon", raceDay)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(plan, expected) {
+		t.Errorf("CSV: expected %+v, got %+v", expected, plan)
+	}
+}
+
+func TestReadPlanErrors(t *testing.T) {
+	for _, tc := range []struct {
+		message  string
+		name     string
+		text     string
+		raceDate time.Time
+	}{
+		{"unknown format", "plan.txt", planCSVText, raceDay},
+		{"CSV without race date", "plan.csv", planCSVText, time.Time{}},
+		{"CSV without header", "plan.csv", "2018-03-03,20,10\n", raceDay},
+		{"CSV bad distance", "plan.csv", "week_start,distance_km,long_run_km\n2018-03-03,far,10\n", raceDay},
+		{"CSV missing column", "plan.csv", "week_start,distance_km,long_run_km\n2018-03-03,20\n", raceDay},
+		{"no weeks", "plan.csv", "week_start,distance_km,long_run_km\n", raceDay},
+		{"bad date", "plan.csv", "week_start,distance_km,long_run_km\n3/3/2018,20,10\n", raceDay},
+		{"long run longer than week", "plan.csv", "week_start,distance_km,long_run_km\n2018-03-03,10,20\n", raceDay},
+		{"weeks out of order", "plan.csv", "week_start,distance_km,long_run_km\n2018-03-10,20,10\n2018-03-03,20,10\n", raceDay},
+		{"week after race", "plan.csv", "week_start,distance_km,long_run_km\n2018-03-24,20,10\n", raceDay},
+		{"YAML unknown field", "plan.yml", planYAMLText + "pace: fast\n", time.Time{}},
+	} {
+		if _, err := ReadPlan(tc.name, strings.NewReader(tc.text), "", tc.raceDate); err == nil {
+			t.Errorf("Case '%s': expected an error", tc.message)
+		}
+	}
+}
+
+func TestApplyPlan(t *testing.T) {
+	plan := &TrainingPlan{RaceDate: raceDay, Weeks: expectedPlanWeeks}
+	weeks := ComputeWeeklySummaries([]*strava.ActivitySummary{
+		run(saturday.Add(morning), time.Hour, short),
+		run(monday.Add(morning), time.Hour, short),
+	}, DefaultWeekStart)
+
+	actual := ApplyPlan(weeks, plan, DefaultWeekStart)
+	if len(actual) != 2 {
+		t.Fatalf("expected 2 weeks, got %+v", actual)
+	}
+	if expected := (&PlanProgress{Distance: 20000, LongRun: 10000, WeeksToRace: 2}); !reflect.DeepEqual(actual[0].Plan, expected) {
+		t.Errorf("week 1: expected %+v, got %+v", expected, actual[0].Plan)
+	}
+	if pc := actual[0].PercentComplete(); math.Round(pc) != 56 {
+		t.Errorf("week 1: expected 56%% complete, got %v", pc)
+	}
+	// Nothing was run in the second week, but it's still in the plan.
+	if actual[1].Date != week2 || actual[1].Count != 0 || actual[1].Plan.WeeksToRace != 1 {
+		t.Errorf("week 2: expected an empty planned week, got %+v", actual[1])
+	}
+
+	if actual := ApplyPlan(weeks, nil, DefaultWeekStart); !reflect.DeepEqual(actual, weeks) {
+		t.Errorf("no plan: expected %+v, got %+v", weeks, actual)
+	}
+
+	// Filtering the plan leaves out weeks outside the range.
+	actual = ApplyPlan(weeks, HistoryOptions{To: monday}.FilterPlan(plan), DefaultWeekStart)
+	if len(actual) != 1 || actual[0].Plan == nil {
+		t.Errorf("filtered: expected just the first week, got %+v", actual)
+	}
+}
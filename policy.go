@@ -0,0 +1,97 @@
+package handlers
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	strava "github.com/strava/go.strava"
+)
+
+// InclusionPolicy decides which activities count towards summaries, and how
+// much. The zero policy counts every activity in full.
+type InclusionPolicy struct {
+	// Leave out activities that were entered by hand rather than recorded.
+	ExcludeManual bool
+
+	// Leave out activities that other athletes have flagged.
+	ExcludeFlagged bool
+
+	// Leave out activities that are only visible to the athlete.
+	ExcludePrivate bool
+
+	// Leave out activities done on a trainer, e.g. a treadmill.
+	ExcludeTrainer bool
+
+	// The share of the distance and time of a trainer activity that doesn't
+	// count, from 0 to 1. Trainer activities still count as one activity.
+	TrainerDiscount float64
+}
+
+// Excludes says whether the policy leaves act out entirely.
+func (p InclusionPolicy) Excludes(act *strava.ActivitySummary) bool {
+	return p.ExcludeManual && act.Manual ||
+		p.ExcludeFlagged && act.Flagged ||
+		p.ExcludePrivate && act.Private ||
+		p.ExcludeTrainer && act.Trainer
+}
+
+// Weigh returns act as it counts under the policy. Discounted activities are
+// copied rather than changed.
+func (p InclusionPolicy) Weigh(act *strava.ActivitySummary) *strava.ActivitySummary {
+	if !act.Trainer || p.TrainerDiscount == 0 {
+		return act
+	}
+	scale := 1 - p.TrainerDiscount
+	weighed := *act
+	weighed.Distance *= scale
+	weighed.TotalElevationGain *= scale
+	weighed.ElapsedTime = int(float64(act.ElapsedTime) * scale)
+	weighed.MovingTime = int(float64(act.MovingTime) * scale)
+	return &weighed
+}
+
+// Apply splits activities into those that count under the policy, weighed,
+// and those it leaves out.
+func (p InclusionPolicy) Apply(activities []*strava.ActivitySummary) (included, excluded []*strava.ActivitySummary) {
+	for _, act := range activities {
+		if p.Excludes(act) {
+			excluded = append(excluded, act)
+		} else {
+			included = append(included, p.Weigh(act))
+		}
+	}
+	return included, excluded
+}
+
+// ParseInclusionPolicy reads a policy from a comma separated list of the
+// kinds of activity to exclude, some of manual, flagged, private and trainer,
+// and the percentage of a trainer activity's distance and time that counts.
+// Either may be empty.
+func ParseInclusionPolicy(exclude, trainerPercent string) (InclusionPolicy, error) {
+	var p InclusionPolicy
+	if exclude != "" {
+		for _, name := range strings.Split(exclude, ",") {
+			switch strings.ToLower(strings.TrimSpace(name)) {
+			case "manual":
+				p.ExcludeManual = true
+			case "flagged":
+				p.ExcludeFlagged = true
+			case "private":
+				p.ExcludePrivate = true
+			case "trainer":
+				p.ExcludeTrainer = true
+			default:
+				return p, fmt.Errorf("exclude must list manual, flagged, private or trainer, not %q", name)
+			}
+		}
+	}
+	if trainerPercent != "" {
+		pc, err := strconv.ParseFloat(trainerPercent, 64)
+		if err != nil || !(pc >= 0 && pc <= 100) {
+			return p, fmt.Errorf("trainer_percent must be a number from 0 to 100, not %q", trainerPercent)
+		}
+		p.TrainerDiscount = 1 - pc/100
+	}
+	return p, nil
+}
@@ -0,0 +1,83 @@
+package handlers
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	strava "github.com/strava/go.strava"
+)
+
+func TestInclusionPolicy(t *testing.T) {
+	manual := run(saturday.Add(morning), time.Hour, long)
+	manual.Manual = true
+	flagged := run(monday.Add(morning), time.Hour, long)
+	flagged.Flagged = true
+	treadmill := run(tuesday.Add(morning), time.Hour, short)
+	treadmill.Trainer = true
+	treadmill.MovingTime = int((50 * time.Minute).Seconds())
+	// Only manual activities the week after.
+	later := run(nextSaturday.Add(morning), time.Hour, long)
+	later.Manual = true
+	outdoor := run(saturday.Add(afternoon), 30*time.Minute, short)
+	acts := []*strava.ActivitySummary{manual, flagged, treadmill, later, outdoor}
+
+	policy := InclusionPolicy{ExcludeManual: true, ExcludeFlagged: true, TrainerDiscount: 0.5}
+	weeks := SummarizeWeeks(acts, DefaultWeekStart, nil, policy)
+	if len(weeks) != 2 {
+		t.Fatalf("Expected two weeks, got %+v", weeks)
+	}
+	if w := weeks[0]; w.Count != 2 || w.Excluded != 2 || w.Distance != short*1.5 || w.Time != time.Hour || w.MovingTime != 25*time.Minute {
+		t.Errorf("Expected the treadmill run to count for half, got %+v", w)
+	}
+	if w := weeks[1]; w.Date != week2 || w.Count != 0 || w.Excluded != 1 {
+		t.Errorf("Expected a week with only excluded activities, got %+v", w)
+	}
+	if treadmill.Distance != short {
+		t.Errorf("Expected weighing not to change the original activity, got %+v", treadmill)
+	}
+
+	// The zero policy counts everything.
+	weeks = SummarizeWeeks(acts, DefaultWeekStart, nil, InclusionPolicy{})
+	if weeks[0].Count != 4 || weeks[0].Excluded != 0 {
+		t.Errorf("Expected everything to count, got %+v", weeks[0])
+	}
+
+	// And so does the leaderboard.
+	lb := ComputeLeaderboard([]Runner{{Name: "james", Activities: acts}}, LeaderboardOptions{
+		Period: NewPeriod(WeekPeriod, saturday, DefaultWeekStart),
+		Metric: ByDistance,
+		Policy: InclusionPolicy{ExcludeTrainer: true, ExcludePrivate: true},
+	})
+	if e := lb.Entries[0]; e.Count != 3 || e.Distance != 2*long+short {
+		t.Errorf("Expected the treadmill run to be left out, got %+v", e)
+	}
+
+	umt := &UserMarathonTracking{Name: "james", Weeks: SummarizeWeeks(acts, DefaultWeekStart, nil, policy)}
+	if table := makeTable(umt); !strings.Contains(table, "EXCLUDED") {
+		t.Errorf("Expected an excluded column, got %s", table)
+	}
+}
+
+func TestParseInclusionPolicy(t *testing.T) {
+	for _, tc := range []struct {
+		exclude, trainer string
+		expected         InclusionPolicy
+	}{
+		{"", "", InclusionPolicy{}},
+		{"Manual, flagged,private,trainer", "", InclusionPolicy{ExcludeManual: true, ExcludeFlagged: true, ExcludePrivate: true, ExcludeTrainer: true}},
+		{"", "75", InclusionPolicy{TrainerDiscount: 0.25}},
+		{"", "100", InclusionPolicy{}},
+	} {
+		actual, err := ParseInclusionPolicy(tc.exclude, tc.trainer)
+		if err != nil || !reflect.DeepEqual(actual, tc.expected) {
+			t.Errorf("%q, %q: expected %+v, got %+v (%v)", tc.exclude, tc.trainer, tc.expected, actual, err)
+		}
+	}
+	for _, tc := range [][2]string{{"commute", ""}, {"", "lots"}, {"", "150"}, {"", "-1"}, {"", "NaN"}} {
+		if _, err := ParseInclusionPolicy(tc[0], tc[1]); err == nil {
+			t.Errorf("%q, %q: expected an error", tc[0], tc[1])
+		}
+	}
+}
@@ -0,0 +1,66 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	strava "github.com/strava/go.strava"
+	"golang.org/x/oauth2"
+)
+
+// AthleteFetcher fetches a user's own profile from Strava.
+type AthleteFetcher interface {
+	FetchAthlete(ctx context.Context, ts oauth2.TokenSource) (*strava.AthleteDetailed, error)
+}
+
+// RefreshAllProfiles copies every user's profile from Strava, sending
+// requests and refreshing tokens with client.
+func RefreshAllProfiles(ctx context.Context, store UserStore, client *http.Client, now time.Time) error {
+	users, err := store.GetUsers(ctx)
+	if err != nil {
+		return err
+	}
+	ctx = context.WithValue(ctx, oauth2.HTTPClient, client)
+	return RefreshProfiles(ctx, store, users, newStravaFetcher(client), now)
+}
+
+// RefreshProfiles brings each user's profile up to date with Strava, so that
+// changes to their name, picture or preferred units show up. Users who
+// haven't connected Strava are skipped, and a failure for one user doesn't
+// stop the others from being refreshed.
+func RefreshProfiles(ctx context.Context, store UserStore, users []User, fetcher AthleteFetcher, now time.Time) error {
+	results := FanOut(ctx, FetchParallelism, indices(len(users)), func(ctx context.Context, i int) (bool, error) {
+		u := &users[i]
+		if !u.Connected() {
+			return false, nil
+		}
+		a, err := fetcher.FetchAthlete(ctx, UserTokenSource(ctx, store, u))
+		if err != nil {
+			return false, err
+		}
+		// Only the profile is saved, since u may be out of date by now,
+		// and its token may have been replaced.
+		_, err = store.UpdateUser(ctx, u.ID, func(stored *User) error {
+			stored.setProfile(a, now)
+			return nil
+		})
+		return true, err
+	})
+	failed := 0
+	for i, r := range results {
+		if r.Err != nil {
+			logErrorf(ctx, "Failed to refresh profile for %s: %s", users[i].FirstName, r.Err)
+			failed++
+			continue
+		}
+		if r.Value {
+			logInfof(ctx, "Refreshed profile for %s", users[i].FirstName)
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("failed to refresh %d of %d profiles", failed, len(users))
+	}
+	return nil
+}
@@ -0,0 +1,102 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+
+	strava "github.com/strava/go.strava"
+	"golang.org/x/oauth2"
+)
+
+// stubAthleteFetcher returns the profile for each access token.
+type stubAthleteFetcher map[string]*strava.AthleteDetailed
+
+func (sf stubAthleteFetcher) FetchAthlete(ctx context.Context, ts oauth2.TokenSource) (*strava.AthleteDetailed, error) {
+	tok, err := ts.Token()
+	if err != nil {
+		return nil, err
+	}
+	a, ok := sf[tok.AccessToken]
+	if !ok {
+		return nil, errors.New("not found")
+	}
+	return a, nil
+}
+
+func TestRefreshProfiles(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemoryStore()
+	for _, auth := range []*Authorization{
+		makeAuth("a", "alice", "k", 1),
+		makeAuth("b", "bob", "k", 2),
+	} {
+		if _, err := RegisterNewUser(ctx, store, auth, monday); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := RegisterOfflineUser(ctx, store, 3, "carol"); err != nil {
+		t.Fatal(err)
+	}
+
+	alice := makeAuth("a", "Alice", "Smith", 1).Athlete
+	alice.ProfileMedium = "https://example.com/medium.jpg"
+	alice.City = "Melbourne"
+	alice.MeasurementPreference = "feet"
+	alice.UpdatedAt = saturday
+	f := stubAthleteFetcher{"a": &alice}
+
+	users, err := store.GetUsers(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Alice's token is refreshed after the users were read, which the
+	// refresh mustn't undo.
+	if _, err := store.UpdateUser(ctx, 1, func(u *User) error {
+		u.RefreshToken = "r"
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	// Bob's profile can't be fetched, which doesn't stop Alice's from being
+	// refreshed, and Carol has nothing to fetch.
+	if err := RefreshProfiles(ctx, store, users, f, nextSaturday); err == nil {
+		t.Error("Expected an error for the user with an unknown token")
+	}
+	expected := &User{
+		ID:                    1,
+		FirstName:             "Alice",
+		LastName:              "Smith",
+		StravaToken:           "a",
+		RefreshToken:          "r",
+		ProfilePictureMedium:  "https://example.com/medium.jpg",
+		City:                  "Melbourne",
+		MeasurementPreference: "feet",
+		UpdatedAt:             saturday,
+		ProfileRefreshed:      nextSaturday,
+	}
+	if u, _ := store.GetUser(ctx, 1); !reflect.DeepEqual(u, expected) {
+		t.Errorf("Expected %+v, got %+v", expected, u)
+	}
+	if u, _ := store.GetUser(ctx, 2); u.FirstName != "bob" || !u.ProfileRefreshed.Equal(monday) {
+		t.Errorf("Expected Bob's profile to be unchanged, got %+v", u)
+	}
+
+	users, err = store.GetUsers(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	umt := LoadUserHistory(ctx, store, users, HistoryOptions{WeekStart: DefaultWeekStart})
+	if umt[0].Picture != "https://example.com/medium.jpg" || umt[1].Picture != "" {
+		t.Errorf("Expected only Alice to have a picture, got %q and %q", umt[0].Picture, umt[1].Picture)
+	}
+	// Each user's history is in the units they prefer unless others are asked for.
+	if umt[0].Units != Imperial || umt[1].Units != Metric {
+		t.Errorf("Expected Alice in imperial and Bob in metric, got %s and %s", umt[0].Units, umt[1].Units)
+	}
+	umt = LoadUserHistory(ctx, store, users, HistoryOptions{WeekStart: DefaultWeekStart, Units: Metric})
+	if umt[0].Units != Metric {
+		t.Errorf("Expected Alice in metric when asked for, got %s", umt[0].Units)
+	}
+}
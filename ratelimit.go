@@ -0,0 +1,287 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Strava counts requests in two windows: one that resets every 15 minutes on
+// the quarter hour, and one that resets every day at midnight UTC.
+const (
+	shortWindow = 15 * time.Minute
+	longWindow  = 24 * time.Hour
+)
+
+// slowdownAt is the fraction of a window's budget after which requests are
+// spread out over the rest of the window instead of being sent straight away.
+const slowdownAt = 0.8
+
+// ErrRateLimited means a request wasn't sent because Strava's rate limit
+// would have made it wait too long.
+var ErrRateLimited = errors.New("strava rate limit reached")
+
+// RateLimiter tracks how much of Strava's request budget has been used, as
+// reported in the X-RateLimit-Limit and X-RateLimit-Usage response headers.
+// A single RateLimiter should be shared by every request made with our
+// client ID, as that's what Strava's limits apply to.
+type RateLimiter struct {
+	// MaxWait is the longest a request will be delayed before giving up with
+	// ErrRateLimited.
+	MaxWait time.Duration
+
+	now   func() time.Time
+	sleep func(ctx context.Context, d time.Duration) error
+
+	mu       sync.Mutex
+	windows  [2]rateWindow
+	lastSent time.Time
+}
+
+// rateWindow is the usage of one of Strava's rate limit windows.
+type rateWindow struct {
+	length time.Duration
+	limit  int
+	usage  int
+	start  time.Time
+}
+
+// NewRateLimiter creates a RateLimiter that doesn't know Strava's limits until
+// it sees its first response.
+func NewRateLimiter() *RateLimiter {
+	return &RateLimiter{
+		MaxWait: 2 * time.Minute,
+		now:     time.Now,
+		sleep:   sleepContext,
+		windows: [2]rateWindow{{length: shortWindow}, {length: longWindow}},
+	}
+}
+
+// sleepContext sleeps for d, or until ctx is done.
+func sleepContext(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Wait blocks until a request can be sent without exceeding Strava's limits
+// and counts the request against them.
+func (l *RateLimiter) Wait(ctx context.Context) error {
+	for {
+		l.mu.Lock()
+		d := l.delay()
+		if d == 0 {
+			l.lastSent = l.now()
+			for i := range l.windows {
+				l.windows[i].usage++
+			}
+		}
+		l.mu.Unlock()
+		if d == 0 {
+			return nil
+		}
+		if d > l.MaxWait {
+			return fmt.Errorf("%w: would have to wait %s", ErrRateLimited, d)
+		}
+		if err := l.sleep(ctx, d); err != nil {
+			return err
+		}
+	}
+}
+
+// delay works out how long the next request has to wait. It must be called
+// with mu held.
+func (l *RateLimiter) delay() time.Duration {
+	now := l.now()
+	var longest time.Duration
+	for i := range l.windows {
+		w := &l.windows[i]
+		start := now.Truncate(w.length)
+		if !start.Equal(w.start) {
+			// The window has reset since we last heard from Strava.
+			w.start, w.usage = start, 0
+		}
+		if w.limit == 0 {
+			continue
+		}
+		left := w.start.Add(w.length).Sub(now)
+		var d time.Duration
+		switch {
+		case w.usage >= w.limit:
+			d = left
+		case float64(w.usage) >= slowdownAt*float64(w.limit):
+			// Space the remaining requests out over the rest of the window.
+			gap := left / time.Duration(w.limit-w.usage+1)
+			d = l.lastSent.Add(gap).Sub(now)
+		}
+		if d > longest {
+			longest = d
+		}
+	}
+	return longest
+}
+
+// Update records the limits and usage reported in a Strava response.
+func (l *RateLimiter) Update(h http.Header) {
+	limits, ok := parseRateHeader(h.Get("X-RateLimit-Limit"))
+	if !ok {
+		return
+	}
+	usage, ok := parseRateHeader(h.Get("X-RateLimit-Usage"))
+	if !ok {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := l.now()
+	for i := range l.windows {
+		w := &l.windows[i]
+		w.start = now.Truncate(w.length)
+		w.limit = limits[i]
+		w.usage = usage[i]
+	}
+}
+
+// parseRateHeader parses a pair of 15 minute and daily values such as "600,30000".
+func parseRateHeader(s string) ([2]int, bool) {
+	var result [2]int
+	parts := strings.Split(s, ",")
+	if len(parts) != len(result) {
+		return result, false
+	}
+	for i, p := range parts {
+		n, err := strconv.Atoi(strings.TrimSpace(p))
+		if err != nil {
+			return result, false
+		}
+		result[i] = n
+	}
+	return result, true
+}
+
+// RateLimitTransport is an http.RoundTripper for Strava's API that waits for
+// its RateLimiter before each request, and retries requests that fail with
+// 429 or 5xx statuses using exponential backoff with jitter.
+type RateLimitTransport struct {
+	Base    http.RoundTripper
+	Limiter *RateLimiter
+
+	// MaxRetries is how many times a failed request is retried.
+	MaxRetries int
+
+	// BaseBackoff is roughly how long the first retry waits. Each later
+	// retry waits about twice as long as the one before, up to MaxBackoff.
+	BaseBackoff time.Duration
+	MaxBackoff  time.Duration
+
+	// Timeout is how long each attempt may take, including reading its
+	// response, if it's set. Waiting for the Limiter and backing off don't
+	// count towards it.
+	Timeout time.Duration
+}
+
+// NewRateLimitTransport wraps base so that its requests respect limiter.
+func NewRateLimitTransport(base http.RoundTripper, limiter *RateLimiter) *RateLimitTransport {
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	return &RateLimitTransport{
+		Base:        base,
+		Limiter:     limiter,
+		MaxRetries:  4,
+		BaseBackoff: 500 * time.Millisecond,
+		MaxBackoff:  30 * time.Second,
+	}
+}
+
+// RoundTrip implements http.RoundTripper.
+func (t *RateLimitTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	ctx := req.Context()
+	for attempt := 0; ; attempt++ {
+		if err := t.Limiter.Wait(ctx); err != nil {
+			return nil, err
+		}
+		resp, err := t.send(req)
+		if err != nil {
+			return nil, err
+		}
+		t.Limiter.Update(resp.Header)
+		if !shouldRetry(resp.StatusCode) || attempt >= t.MaxRetries {
+			return resp, nil
+		}
+		if req.Body != nil && req.GetBody == nil {
+			// The body has been used up, so the request can't be sent again.
+			return resp, nil
+		}
+		io.Copy(ioutil.Discard, resp.Body) // nolint: errcheck
+		resp.Body.Close()                  // nolint: errcheck
+		if err := t.Limiter.sleep(ctx, t.backoff(attempt)); err != nil {
+			return nil, err
+		}
+		if req.GetBody != nil {
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, err
+			}
+			req = req.Clone(ctx)
+			req.Body = body
+		}
+	}
+}
+
+// send makes one attempt at req, giving up after Timeout.
+func (t *RateLimitTransport) send(req *http.Request) (*http.Response, error) {
+	if t.Timeout <= 0 {
+		return t.Base.RoundTrip(req)
+	}
+	ctx, cancel := context.WithTimeout(req.Context(), t.Timeout)
+	resp, err := t.Base.RoundTrip(req.WithContext(ctx))
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	resp.Body = cancelOnClose{resp.Body, cancel}
+	return resp, nil
+}
+
+// cancelOnClose is a response body that cancels its request's context once
+// it's closed.
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (b cancelOnClose) Close() error {
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
+}
+
+// shouldRetry says whether a response with this status might succeed if the
+// request is sent again.
+func shouldRetry(status int) bool {
+	return status == http.StatusTooManyRequests || status >= 500
+}
+
+// backoff is how long to wait before retrying after the given attempt. Half
+// of it is random so that clients that failed together don't retry together.
+func (t *RateLimitTransport) backoff(attempt int) time.Duration {
+	d := t.BaseBackoff << uint(attempt)
+	if d > t.MaxBackoff || d <= 0 {
+		d = t.MaxBackoff
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
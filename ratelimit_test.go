@@ -0,0 +1,279 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeClock is a clock that only moves when something sleeps.
+type fakeClock struct {
+	mu     sync.Mutex
+	t      time.Time
+	sleeps []time.Duration
+}
+
+func (c *fakeClock) now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.t
+}
+
+func (c *fakeClock) sleep(ctx context.Context, d time.Duration) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.sleeps = append(c.sleeps, d)
+	c.t = c.t.Add(d)
+	return ctx.Err()
+}
+
+// newFakeLimiter creates a rate limiter that uses clock.
+func newFakeLimiter(clock *fakeClock) *RateLimiter {
+	l := NewRateLimiter()
+	l.now = clock.now
+	l.sleep = clock.sleep
+	return l
+}
+
+// fakeStrava simulates Strava's rate limiting using a fake clock.
+type fakeStrava struct {
+	clock        *fakeClock
+	shortLimit   int
+	dailyLimit   int
+	dailyUsage   int
+	mu           sync.Mutex
+	shortUsage   int
+	windowStart  time.Time
+	limited      int
+	requests     int
+	failuresLeft int
+}
+
+func (f *fakeStrava) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	now := f.clock.now()
+	if start := now.Truncate(shortWindow); !start.Equal(f.windowStart) {
+		f.windowStart, f.shortUsage = start, 0
+	}
+	f.requests++
+	f.shortUsage++
+	f.dailyUsage++
+	w.Header().Set("X-RateLimit-Limit", fmt.Sprintf("%d,%d", f.shortLimit, f.dailyLimit))
+	w.Header().Set("X-RateLimit-Usage", fmt.Sprintf("%d,%d", f.shortUsage, f.dailyUsage))
+	if f.shortUsage > f.shortLimit || f.dailyUsage > f.dailyLimit {
+		f.limited++
+		http.Error(w, `{"message": "Rate Limit Exceeded"}`, http.StatusTooManyRequests)
+		return
+	}
+	if f.failuresLeft > 0 {
+		f.failuresLeft--
+		http.Error(w, `{"message": "Server Error"}`, http.StatusServiceUnavailable)
+		return
+	}
+	w.Write([]byte("[]")) // nolint: errcheck
+}
+
+// rateLimitStart is a time part way through a 15 minute window.
+var rateLimitStart = Must(time.Parse(time.RFC3339, "2018-03-03T08:05:00Z"))
+
+func newRateLimitedClient(limiter *RateLimiter) *http.Client {
+	t := NewRateLimitTransport(nil, limiter)
+	t.BaseBackoff = time.Second
+	return &http.Client{Transport: t}
+}
+
+func TestRateLimitSpreadsRequests(t *testing.T) {
+	clock := &fakeClock{t: rateLimitStart}
+	f := &fakeStrava{clock: clock, shortLimit: 10, dailyLimit: 1000}
+	server := httptest.NewServer(f)
+	defer server.Close()
+	limiter := newFakeLimiter(clock)
+	limiter.MaxWait = time.Hour
+	client := newRateLimitedClient(limiter)
+
+	for i := 0; i < 25; i++ {
+		resp, err := client.Get(server.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close() // nolint: errcheck
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("Request %d: got status %d", i, resp.StatusCode)
+		}
+	}
+	if f.limited != 0 {
+		t.Errorf("Expected the limit never to be hit, but it was hit %d times", f.limited)
+	}
+	if f.requests != 25 {
+		t.Errorf("Expected 25 requests, got %d", f.requests)
+	}
+	// 25 requests at 10 per window need at least two window resets.
+	if elapsed := clock.now().Sub(rateLimitStart); elapsed < 20*time.Minute {
+		t.Errorf("Expected requests to be spread over at least 20 minutes, took %s", elapsed)
+	}
+	// Requests were spread out before the limit was reached, not just held
+	// until the window reset.
+	if len(clock.sleeps) <= 2 {
+		t.Errorf("Expected requests to be paced, got sleeps %v", clock.sleeps)
+	}
+}
+
+func TestRateLimitGivesUp(t *testing.T) {
+	clock := &fakeClock{t: rateLimitStart}
+	f := &fakeStrava{clock: clock, shortLimit: 600, dailyLimit: 1000, dailyUsage: 999}
+	server := httptest.NewServer(f)
+	defer server.Close()
+	limiter := newFakeLimiter(clock)
+	client := newRateLimitedClient(limiter)
+
+	resp, err := client.Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close() // nolint: errcheck
+
+	// The daily limit has been used up, and it won't reset for hours.
+	_, err = client.Get(server.URL)
+	if !errors.Is(err, ErrRateLimited) {
+		t.Errorf("Expected %v, got %v", ErrRateLimited, err)
+	}
+	if f.requests != 1 {
+		t.Errorf("Expected the second request not to be sent, but got %d requests", f.requests)
+	}
+}
+
+func TestRateLimitRetries(t *testing.T) {
+	clock := &fakeClock{t: rateLimitStart}
+	f := &fakeStrava{clock: clock, shortLimit: 600, dailyLimit: 30000, failuresLeft: 3}
+	server := httptest.NewServer(f)
+	defer server.Close()
+	client := newRateLimitedClient(newFakeLimiter(clock))
+
+	resp, err := client.Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close() // nolint: errcheck
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("Expected the request to succeed eventually, got %d", resp.StatusCode)
+	}
+	if f.requests != 4 || len(clock.sleeps) != 3 {
+		t.Fatalf("Expected 3 retries, got %d requests and sleeps %v", f.requests, clock.sleeps)
+	}
+	for i, d := range clock.sleeps {
+		max := time.Second << uint(i)
+		if d < max/2 || d > max {
+			t.Errorf("Retry %d: expected a backoff between %s and %s, got %s", i, max/2, max, d)
+		}
+	}
+
+	// Permanent failures give up after MaxRetries.
+	f.failuresLeft = 100
+	f.requests = 0
+	resp, err = client.Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close() // nolint: errcheck
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("Expected the last failure to be returned, got %d", resp.StatusCode)
+	}
+	if f.requests != 5 {
+		t.Errorf("Expected 1 request and 4 retries, got %d requests", f.requests)
+	}
+}
+
+func TestRateLimitRetryAfter429(t *testing.T) {
+	clock := &fakeClock{t: rateLimitStart}
+	// Someone else has used up this window's budget.
+	f := &fakeStrava{clock: clock, shortLimit: 5, dailyLimit: 30000}
+	f.windowStart = rateLimitStart.Truncate(shortWindow)
+	f.shortUsage = 5
+	server := httptest.NewServer(f)
+	defer server.Close()
+	limiter := newFakeLimiter(clock)
+	limiter.MaxWait = time.Hour
+	client := newRateLimitedClient(limiter)
+
+	resp, err := client.Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close() // nolint: errcheck
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("Expected the request to succeed once the window reset, got %d", resp.StatusCode)
+	}
+	if f.limited != 1 {
+		t.Errorf("Expected exactly one rate limited response, got %d", f.limited)
+	}
+	if now := clock.now(); now.Before(rateLimitStart.Truncate(shortWindow).Add(shortWindow)) {
+		t.Errorf("Expected to wait for the window to reset, but it's only %s", now)
+	}
+}
+
+func TestRateLimitTimeout(t *testing.T) {
+	clock := &fakeClock{t: rateLimitStart}
+	f := &fakeStrava{clock: clock, shortLimit: 600, dailyLimit: 30000, failuresLeft: 1}
+	server := httptest.NewServer(f)
+	defer server.Close()
+	limiter := newFakeLimiter(clock)
+	// Backing off takes longer than each attempt may.
+	limiter.sleep = func(ctx context.Context, d time.Duration) error {
+		time.Sleep(100 * time.Millisecond)
+		return ctx.Err()
+	}
+	transport := NewRateLimitTransport(nil, limiter)
+	transport.Timeout = 50 * time.Millisecond
+	client := &http.Client{Transport: transport}
+
+	resp, err := client.Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close() // nolint: errcheck
+	if err != nil || string(b) != "[]" {
+		t.Errorf("Expected to read the response, got %q, %v", b, err)
+	}
+	if resp.StatusCode != http.StatusOK || f.requests != 2 {
+		t.Errorf("Expected the retry to succeed, got %d after %d requests", resp.StatusCode, f.requests)
+	}
+
+	// But a slow attempt is given up on.
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-time.After(time.Second):
+		}
+	}))
+	defer slow.Close()
+	if _, err := client.Get(slow.URL); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Expected %v, got %v", context.DeadlineExceeded, err)
+	}
+}
+
+func TestParseRateHeader(t *testing.T) {
+	for _, tc := range []struct {
+		input    string
+		expected [2]int
+		ok       bool
+	}{
+		{"600,30000", [2]int{600, 30000}, true},
+		{"314, 27536", [2]int{314, 27536}, true},
+		{"", [2]int{}, false},
+		{"600", [2]int{}, false},
+		{"a,b", [2]int{}, false},
+	} {
+		v, ok := parseRateHeader(tc.input)
+		if ok != tc.ok || (ok && v != tc.expected) {
+			t.Errorf("%q: expected %v %v, got %v %v", tc.input, tc.expected, tc.ok, v, ok)
+		}
+	}
+}
@@ -0,0 +1,212 @@
+package handlers
+
+import (
+	"context"
+	"crypto/subtle"
+	"net/http"
+	"strings"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+// Env is what the handlers need from the platform the app runs on.
+type Env struct {
+	// Store keeps the users and their activities.
+	Store Store
+
+	// Context makes the context for handling a request. It defaults to the
+	// request's own context.
+	Context func(r *http.Request) context.Context
+
+	// HTTPClient makes the client used to talk to Strava while handling a
+	// request with ctx. It defaults to http.DefaultClient.
+	HTTPClient func(ctx context.Context) *http.Client
+
+	// Admin wraps the /admin/ and /tasks/ handlers to keep everyone else
+	// out. If it's nil something in front of the app has to do that.
+	Admin func(http.Handler) http.Handler
+
+	// BaseURL is where the app is served from, like https://example.com,
+	// which Strava sends users back to after they connect. If it's empty
+	// it's worked out from each request.
+	BaseURL string
+
+	// HTTPS says that the app is only served over HTTPS, for working out
+	// the BaseURL when something in front of the app handles TLS without
+	// saying so.
+	HTTPS bool
+
+	// VerifyToken is the token given to Strava when subscribing to its
+	// webhook events. The webhook can't be subscribed to without one.
+	VerifyToken string
+
+	// SubscriptionID is the ID Strava gave the webhook subscription. Events
+	// for any other subscription are turned away, so the webhook takes no
+	// events without it.
+	SubscriptionID int64
+
+	// Events holds webhook events until they can be handled. It defaults to
+	// handling them in the background of this process.
+	Events EventQueue
+
+	// SessionKey signs the cookies that keep users logged in. Nobody can
+	// log in without one.
+	SessionKey []byte
+
+	// Invited are the Strava athlete ids of the people who may join the
+	// group by connecting Strava. Members of the group, who are the users in
+	// the Store, can always log in, so admins can also let people in by
+	// importing their activities.
+	Invited []int64
+}
+
+func (e *Env) context(r *http.Request) context.Context {
+	if e.Context == nil {
+		return r.Context()
+	}
+	return e.Context(r)
+}
+
+func (e *Env) client(ctx context.Context) *http.Client {
+	if e.HTTPClient == nil {
+		return http.DefaultClient
+	}
+	return e.HTTPClient(ctx)
+}
+
+func (e *Env) admin(h http.HandlerFunc) http.Handler {
+	if e.Admin == nil {
+		return h
+	}
+	return e.Admin(h)
+}
+
+// baseURL gets where the app is served from, going by r if BaseURL isn't set.
+func (e *Env) baseURL(r *http.Request) string {
+	if e.BaseURL != "" {
+		return e.BaseURL
+	}
+	scheme := "http"
+	if e.HTTPS || r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https" {
+		scheme = "https"
+	}
+	return scheme + "://" + r.Host
+}
+
+// oauthContext makes OAuth token requests made with ctx use the Env's HTTP client.
+func (e *Env) oauthContext(ctx context.Context) context.Context {
+	return context.WithValue(ctx, oauth2.HTTPClient, e.client(ctx))
+}
+
+// NewHandler makes the app's HTTP handler. strava.ClientId and
+// strava.ClientSecret have to be set first.
+func NewHandler(env *Env) http.Handler {
+	mux := http.NewServeMux()
+	store := env.Store
+
+	registerLoginHandlers(mux, env)
+	registerAPIHandlers(mux, env)
+	registerPlanHandlers(mux, env)
+	registerImportHandlers(mux, env)
+	registerWebhookHandlers(mux, env)
+	registerDashboardHandlers(mux, env)
+	registerAccountHandlers(mux, env)
+
+	mux.HandleFunc("/favicon.ico", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok")) // nolint: errcheck
+	})
+
+	// Triggered by cron, see cron.yaml.
+	mux.Handle("/tasks/sync", env.admin(func(w http.ResponseWriter, r *http.Request) {
+		ctx := env.context(r)
+		mode := IncrementalSync
+		if r.FormValue("full") != "" {
+			mode = FullSync
+		}
+		if err := SyncAll(ctx, store, env.client(ctx), mode, time.Now()); err != nil {
+			handleError(w, err)
+			return
+		}
+		w.Write([]byte("ok")) // nolint: errcheck
+	}))
+
+	mux.Handle("/tasks/profiles", env.admin(func(w http.ResponseWriter, r *http.Request) {
+		ctx := env.context(r)
+		if err := RefreshAllProfiles(ctx, store, env.client(ctx), time.Now()); err != nil {
+			handleError(w, err)
+			return
+		}
+		w.Write([]byte("ok")) // nolint: errcheck
+	}))
+
+	mux.HandleFunc("/leaderboard", func(w http.ResponseWriter, r *http.Request) {
+		ctx := env.context(r)
+		if _, _, err := env.member(r); err != nil {
+			env.denyPage(w, r, err)
+			return
+		}
+		opts, err := leaderboardParams(r, time.Now())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		users, err := store.GetUsers(ctx)
+		if err != nil {
+			handleError(w, err)
+			return
+		}
+		lb := ComputeLeaderboard(LoadRunners(ctx, store, users), opts)
+		if err := leaderboardTpl.Execute(w, leaderboardTplArgs{lb, r.URL.Query()}); err != nil {
+			handleError(w, err)
+			return
+		}
+	})
+
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		ctx := env.context(r)
+		me, s, err := env.member(r)
+		if err == errNotLoggedIn {
+			if err := loginTpl.Execute(w, loginTplArgs{}); err != nil {
+				handleError(w, err)
+			}
+			return
+		}
+		if err != nil {
+			handleError(w, err)
+			return
+		}
+		args := mainTplArgs{Me: me, CSRFToken: csrfToken(env.SessionKey, s), Query: r.URL.Query()}
+		opts, err := historyOptionsParam(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		users, err := store.GetUsers(ctx)
+		if err != nil {
+			handleError(w, err)
+			return
+		}
+		args.Umt = LoadUserHistory(ctx, store, users, opts)
+		if err := mainTpl.Execute(w, args); err != nil {
+			handleError(w, err)
+			return
+		}
+	})
+	return mux
+}
+
+// RequireToken makes an Env.Admin that only lets through requests with token
+// as a bearer token. If token is empty nobody is let through.
+func RequireToken(token string) func(http.Handler) http.Handler {
+	return func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			given := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+			if token == "" || subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1 {
+				http.Error(w, "forbidden", http.StatusForbidden)
+				return
+			}
+			h.ServeHTTP(w, r)
+		})
+	}
+}
@@ -0,0 +1,157 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	strava "github.com/strava/go.strava"
+)
+
+func TestNewHandler(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemoryStore()
+	if _, err := RegisterNewUser(ctx, store, makeAuth("a", "alice", "k", 1), time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	act := run(saturday.Add(morning), 20*time.Minute, short)
+	act.Id = 1
+	if err := store.PutActivities(ctx, 1, []*strava.ActivitySummary{act}); err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(NewHandler(&Env{Store: store, Admin: RequireToken("secret"), SessionKey: []byte(testSessionKey)}))
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL + "/api/v1/users/1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("Expected the API to need a login, got %s", resp.Status)
+	}
+
+	client, s := loggedIn(t, 1)
+	resp, err = client.Get(srv.URL + "/api/v1/users/1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var user APIUser
+	if err := json.NewDecoder(resp.Body).Decode(&user); err != nil {
+		t.Fatal(err)
+	}
+	if user.Name != "alice" || len(user.Weeks) != 1 || user.Weeks[0].RunCount != 1 {
+		t.Errorf("Expected alice's run, got %+v", user)
+	}
+
+	// Scripts use an API token instead, which members make on their
+	// dashboard.
+	api := func(auth string) int {
+		req, err := http.NewRequest("GET", srv.URL+"/api/v1/users/1", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Authorization", auth)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	csrf := url.Values{csrfField: {csrfToken([]byte(testSessionKey), s)}}
+	makeToken := func() string {
+		resp, err := client.PostForm(srv.URL+"/me/api_token", csrf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		b, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		m := regexp.MustCompile(`<pre>(1\.[\w-]+)</pre>`).FindSubmatch(b)
+		if resp.StatusCode != http.StatusOK || m == nil {
+			t.Fatalf("Expected a new API token, got %s %s", resp.Status, b)
+		}
+		return string(m[1])
+	}
+	resp, err = client.PostForm(srv.URL+"/me/api_token", url.Values{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Errorf("Expected making a token without the CSRF token to fail, got %s", resp.Status)
+	}
+	first := makeToken()
+	for _, tc := range []struct {
+		auth     string
+		expected int
+	}{
+		{"Bearer " + first, http.StatusOK},
+		{"Bearer 2" + strings.TrimPrefix(first, "1"), http.StatusUnauthorized},
+		{"Bearer " + first + "x", http.StatusUnauthorized},
+		{"Basic YWxpY2U6c2VjcmV0", http.StatusUnauthorized},
+	} {
+		if status := api(tc.auth); status != tc.expected {
+			t.Errorf("With %q expected %d, got %d", tc.auth, tc.expected, status)
+		}
+	}
+	// Making a new token revokes the old one.
+	second := makeToken()
+	if api("Bearer "+first) != http.StatusUnauthorized || api("Bearer "+second) != http.StatusOK {
+		t.Error("Expected only the new token to work")
+	}
+	if u, err := store.GetUser(ctx, 1); err != nil || u.APITokenHash != hashAPIToken(second) {
+		t.Errorf("Expected only the token's hash to be stored, got %+v, %v", u, err)
+	}
+	resp, err = client.PostForm(srv.URL+"/me/api_token/revoke", csrf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusSeeOther || api("Bearer "+second) != http.StatusUnauthorized {
+		t.Errorf("Expected the token to be revoked, got %s", resp.Status)
+	}
+
+	resp, err = client.Get(srv.URL + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("Expected the main page, got %s", resp.Status)
+	}
+
+	for _, token := range []string{"", "wrong", "secret"} {
+		req, err := http.NewRequest("POST", srv.URL+"/admin/plan", strings.NewReader(""))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		// With the right token the request gets through to complain about the form.
+		expected := http.StatusForbidden
+		if token == "secret" {
+			expected = http.StatusBadRequest
+		}
+		if resp.StatusCode != expected {
+			t.Errorf("With token %q expected %d, got %s", token, expected, resp.Status)
+		}
+	}
+}
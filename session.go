@@ -0,0 +1,260 @@
+package handlers
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Users log in by connecting Strava. The OAuth callback then gives them a
+// session cookie carrying their athlete id, signed with Env.SessionKey so
+// that it can't be forged, and nothing about the session is stored.
+
+// Session is a logged in user.
+type Session struct {
+	AthleteID int64
+	Expires   time.Time
+
+	// Random, so that each login has its own CSRF token.
+	Nonce string
+}
+
+// SessionLength is how long users stay logged in.
+const SessionLength = 30 * 24 * time.Hour
+
+// sessionCookie is the name of the cookie that holds the session.
+const sessionCookie = "session"
+
+// csrfField and csrfHeader are where state-changing requests from a session
+// carry its CSRF token.
+const (
+	csrfField  = "csrf_token"
+	csrfHeader = "X-CSRF-Token"
+)
+
+// Scripts can't log in with Strava, so the API also takes an API token in
+// an "Authorization: Bearer <token>" header. Members make theirs from /me,
+// which replaces any token they had before, and can revoke it there. The
+// token is their athlete id and a random secret, and only its hash is
+// stored.
+
+// errNotLoggedIn is returned for requests without a valid session.
+var errNotLoggedIn = errors.New("not logged in")
+
+// errBadCSRFToken is returned for state-changing requests whose CSRF token
+// doesn't match their session.
+var errBadCSRFToken = errors.New("missing or wrong CSRF token")
+
+// NewSession starts a session for the user that lasts SessionLength from now.
+func NewSession(athleteID int64, now time.Time) (*Session, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return nil, err
+	}
+	return &Session{AthleteID: athleteID, Expires: now.Add(SessionLength), Nonce: hex.EncodeToString(b)}, nil
+}
+
+// sign makes an HMAC of the parts with key.
+func sign(key []byte, parts ...string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(strings.Join(parts, "|"))) // nolint: errcheck
+	return mac.Sum(nil)
+}
+
+// encodeSession makes the value of a session cookie, which is the session's
+// fields followed by their signature.
+func encodeSession(key []byte, s *Session) string {
+	payload := fmt.Sprintf("%d|%d|%s", s.AthleteID, s.Expires.Unix(), s.Nonce)
+	return base64.RawURLEncoding.EncodeToString([]byte(payload)) + "." +
+		base64.RawURLEncoding.EncodeToString(sign(key, "session", payload))
+}
+
+// decodeSession checks a session cookie's signature and that it hasn't
+// expired. Sessions can't be decoded without a key.
+func decodeSession(key []byte, value string, now time.Time) (*Session, error) {
+	if len(key) == 0 {
+		return nil, errNotLoggedIn
+	}
+	parts := strings.Split(value, ".")
+	if len(parts) != 2 {
+		return nil, errNotLoggedIn
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, errNotLoggedIn
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil || !hmac.Equal(sig, sign(key, "session", string(payload))) {
+		return nil, errNotLoggedIn
+	}
+	fields := strings.Split(string(payload), "|")
+	if len(fields) != 3 {
+		return nil, errNotLoggedIn
+	}
+	id, err := strconv.ParseInt(fields[0], 10, 64)
+	if err != nil {
+		return nil, errNotLoggedIn
+	}
+	expires, err := strconv.ParseInt(fields[1], 10, 64)
+	if err != nil {
+		return nil, errNotLoggedIn
+	}
+	s := &Session{AthleteID: id, Expires: time.Unix(expires, 0), Nonce: fields[2]}
+	if !now.Before(s.Expires) {
+		return nil, errNotLoggedIn
+	}
+	return s, nil
+}
+
+// csrfToken is the token that state-changing requests from the session have
+// to carry, so that other sites can't make them on the user's behalf.
+func csrfToken(key []byte, s *Session) string {
+	return base64.RawURLEncoding.EncodeToString(sign(key, "csrf", s.Nonce))
+}
+
+// newAPIToken makes a new API token for the athlete, and the hash of it to
+// store in User.APITokenHash.
+func newAPIToken(athleteID int64) (token, hash string, err error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", "", err
+	}
+	token = strconv.FormatInt(athleteID, 10) + "." + base64.RawURLEncoding.EncodeToString(b)
+	return token, hashAPIToken(token), nil
+}
+
+// hashAPIToken is what's stored of an API token.
+func hashAPIToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// apiTokenAthlete gets the athlete id an API token says it's for. Only the
+// user's stored hash can say whether the token is really theirs.
+func apiTokenAthlete(token string) (int64, error) {
+	parts := strings.SplitN(token, ".", 2)
+	if len(parts) != 2 || parts[1] == "" {
+		return 0, errNotLoggedIn
+	}
+	id, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return 0, errNotLoggedIn
+	}
+	return id, nil
+}
+
+// setSession logs the user in by setting their session cookie.
+func (e *Env) setSession(w http.ResponseWriter, r *http.Request, s *Session) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookie,
+		Value:    encodeSession(e.SessionKey, s),
+		Path:     "/",
+		Expires:  s.Expires,
+		HttpOnly: true,
+		Secure:   strings.HasPrefix(e.baseURL(r), "https://"),
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// clearSession logs the user out.
+func (e *Env) clearSession(w http.ResponseWriter, r *http.Request) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookie,
+		Path:     "/",
+		MaxAge:   -1,
+		HttpOnly: true,
+		Secure:   strings.HasPrefix(e.baseURL(r), "https://"),
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// member gets the logged in user and their session. Only users who are in
+// the Store are members of the group, so someone whose user has been
+// deleted is logged out. People only get into the Store by being invited,
+// see checkInvited.
+func (e *Env) member(r *http.Request) (*User, *Session, error) {
+	c, err := r.Cookie(sessionCookie)
+	if err != nil {
+		return nil, nil, errNotLoggedIn
+	}
+	s, err := decodeSession(e.SessionKey, c.Value, time.Now())
+	if err != nil {
+		return nil, nil, err
+	}
+	u, err := e.groupUser(r, s.AthleteID)
+	if err != nil {
+		return nil, nil, err
+	}
+	return u, s, nil
+}
+
+// apiMember gets the member making an API request, from its API token if it
+// has one and otherwise from its session.
+func (e *Env) apiMember(r *http.Request) (*User, error) {
+	auth := r.Header.Get("Authorization")
+	if auth == "" {
+		u, _, err := e.member(r)
+		return u, err
+	}
+	if !strings.HasPrefix(auth, "Bearer ") {
+		return nil, errNotLoggedIn
+	}
+	token := strings.TrimPrefix(auth, "Bearer ")
+	id, err := apiTokenAthlete(token)
+	if err != nil {
+		return nil, err
+	}
+	u, err := e.groupUser(r, id)
+	if err != nil {
+		return nil, err
+	}
+	if u.APITokenHash == "" || subtle.ConstantTimeCompare([]byte(hashAPIToken(token)), []byte(u.APITokenHash)) != 1 {
+		return nil, errNotLoggedIn
+	}
+	return u, nil
+}
+
+// groupUser gets the athlete's user, who isn't logged in unless they're in
+// the group.
+func (e *Env) groupUser(r *http.Request, id int64) (*User, error) {
+	u, err := e.Store.GetUser(e.context(r), id)
+	if err == ErrNoSuchUser {
+		return nil, errNotLoggedIn
+	}
+	if err != nil {
+		return nil, err
+	}
+	return u, nil
+}
+
+// checkCSRF makes sure a state-changing request carries its session's CSRF
+// token, in the X-CSRF-Token header or the csrf_token form field.
+func (e *Env) checkCSRF(r *http.Request, s *Session) error {
+	given := r.Header.Get(csrfHeader)
+	if given == "" {
+		given = r.PostFormValue(csrfField)
+	}
+	if subtle.ConstantTimeCompare([]byte(given), []byte(csrfToken(e.SessionKey, s))) != 1 {
+		return errBadCSRFToken
+	}
+	return nil
+}
+
+// denyPage answers a request for a page that only members can see, sending
+// people who aren't logged in to the front page to log in.
+func (e *Env) denyPage(w http.ResponseWriter, r *http.Request, err error) {
+	if err == errNotLoggedIn {
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
+	}
+	handleError(w, err)
+}
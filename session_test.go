@@ -0,0 +1,224 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testSessionKey = "0123456789abcdef0123456789abcdef"
+
+// cookieTransport sends a cookie with every request.
+type cookieTransport struct {
+	cookie *http.Cookie
+}
+
+func (t cookieTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	r = r.Clone(r.Context())
+	r.AddCookie(t.cookie)
+	return http.DefaultTransport.RoundTrip(r)
+}
+
+// loggedIn makes a client that's logged in as the given athlete, and doesn't
+// follow redirects.
+func loggedIn(t *testing.T, id int64) (*http.Client, *Session) {
+	s, err := NewSession(id, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &http.Client{
+		Transport: cookieTransport{&http.Cookie{Name: sessionCookie, Value: encodeSession([]byte(testSessionKey), s)}},
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}, s
+}
+
+func TestSession(t *testing.T) {
+	key := []byte(testSessionKey)
+	now := saturday
+	s, err := NewSession(1234, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	value := encodeSession(key, s)
+	decoded, err := decodeSession(key, value, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decoded.AthleteID != 1234 || decoded.Nonce != s.Nonce || !decoded.Expires.Equal(s.Expires) {
+		t.Errorf("Expected %+v, got %+v", s, decoded)
+	}
+
+	forged := *s
+	forged.AthleteID = 1
+	parts := strings.Split(value, ".")
+	for _, tc := range []struct {
+		name  string
+		key   []byte
+		value string
+		now   time.Time
+	}{
+		{"expired", key, value, now.Add(SessionLength)},
+		{"wrong key", []byte("another key that is long enough.."), value, now},
+		{"no key", nil, value, now},
+		{"forged", key, strings.Split(encodeSession(key, &forged), ".")[0] + "." + parts[1], now},
+		{"unsigned", key, parts[0], now},
+		{"garbage", key, "not.a session", now},
+	} {
+		if _, err := decodeSession(tc.key, tc.value, tc.now); err != errNotLoggedIn {
+			t.Errorf("%s: expected not to be logged in, got %v", tc.name, err)
+		}
+	}
+
+	// Every login has its own CSRF token.
+	other, err := NewSession(1234, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if csrfToken(key, s) == csrfToken(key, other) {
+		t.Error("Expected different logins to have different CSRF tokens")
+	}
+}
+
+func TestAPIToken(t *testing.T) {
+	token, hash, err := newAPIToken(1234)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hash != hashAPIToken(token) || strings.Contains(hash, token) {
+		t.Errorf("Expected %q to be the hash of %q", hash, token)
+	}
+	if id, err := apiTokenAthlete(token); err != nil || id != 1234 {
+		t.Errorf("Expected 1234, got %d, %v", id, err)
+	}
+	other, _, err := newAPIToken(1234)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if other == token {
+		t.Error("Expected each API token to be different")
+	}
+	for _, value := range []string{"1234", "1234.", "bob.secret", ""} {
+		if _, err := apiTokenAthlete(value); err != errNotLoggedIn {
+			t.Errorf("%q: expected not to be logged in, got %v", value, err)
+		}
+	}
+}
+
+// planForm makes a multipart form uploading a training plan.
+func planForm(t *testing.T, csrf string) (string, *bytes.Buffer) {
+	body := bytes.NewBuffer(nil)
+	mw := multipart.NewWriter(body)
+	if csrf != "" {
+		if err := mw.WriteField(csrfField, csrf); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := mw.WriteField("race_date", "2018-03-17"); err != nil {
+		t.Fatal(err)
+	}
+	fw, err := mw.CreateFormFile("plan", "plan.csv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fw.Write([]byte(planCSVText)); err != nil {
+		t.Fatal(err)
+	}
+	if err := mw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return mw.FormDataContentType(), body
+}
+
+func TestDashboard(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemoryStore()
+	if _, err := RegisterNewUser(ctx, store, makeAuth("a", "alice", "k", 1), time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(NewHandler(&Env{Store: store, SessionKey: []byte(testSessionKey)}))
+	defer srv.Close()
+	get := func(client *http.Client, path string) (*http.Response, string) {
+		resp, err := client.Get(srv.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		b, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp, string(b)
+	}
+
+	// People who aren't logged in only see how to log in.
+	anon := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+	if _, body := get(anon, "/"); !strings.Contains(body, "Connect with Strava") || strings.Contains(body, "alice") {
+		t.Errorf("Expected the login page, got %s", body)
+	}
+	for _, path := range []string{"/me", "/leaderboard"} {
+		if resp, _ := get(anon, path); resp.StatusCode != http.StatusSeeOther || resp.Header.Get("Location") != "/" {
+			t.Errorf("%s: expected a redirect to log in, got %s", path, resp.Status)
+		}
+	}
+	// Nor does anyone whose user isn't in the group.
+	stranger, _ := loggedIn(t, 2)
+	if _, body := get(stranger, "/"); !strings.Contains(body, "Connect with Strava") {
+		t.Errorf("Expected the login page for a stranger, got %s", body)
+	}
+
+	client, s := loggedIn(t, 1)
+	token := csrfToken([]byte(testSessionKey), s)
+	if _, body := get(client, "/"); !strings.Contains(body, "alice") || !strings.Contains(body, token) {
+		t.Errorf("Expected the group page with a logout form, got %s", body)
+	}
+	if resp, body := get(client, "/me"); resp.StatusCode != http.StatusOK || !strings.Contains(body, "Logged in as alice") {
+		t.Errorf("Expected alice's dashboard, got %s %s", resp.Status, body)
+	}
+
+	// State-changing requests need the CSRF token.
+	for _, csrf := range []string{"", "wrong", token} {
+		contentType, body := planForm(t, csrf)
+		resp, err := client.Post(srv.URL+"/me/plan", contentType, body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		expected := http.StatusForbidden
+		if csrf == token {
+			expected = http.StatusSeeOther
+		}
+		if resp.StatusCode != expected {
+			t.Errorf("With CSRF token %q expected %d, got %s", csrf, expected, resp.Status)
+		}
+	}
+	if plan, err := store.GetTrainingPlan(ctx, 1); err != nil || plan == nil || len(plan.Weeks) != 2 {
+		t.Errorf("Expected alice's plan to be uploaded, got %+v, %v", plan, err)
+	}
+
+	resp, err := client.PostForm(srv.URL+"/logout", url.Values{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Errorf("Expected logging out without the CSRF token to fail, got %s", resp.Status)
+	}
+	resp, err = client.PostForm(srv.URL+"/logout", url.Values{csrfField: {token}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	cookies := resp.Cookies()
+	if resp.StatusCode != http.StatusSeeOther || len(cookies) != 1 || cookies[0].Name != sessionCookie || cookies[0].MaxAge >= 0 {
+		t.Errorf("Expected the session cookie to be cleared, got %s %v", resp.Status, cookies)
+	}
+}
@@ -0,0 +1,316 @@
+//go:build !appengine
+
+package handlers
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+	strava "github.com/strava/go.strava"
+)
+
+// SQLiteStore is a Store that keeps everything in a SQLite database, for
+// running the app on your own server. Like the datastore, it saves each
+// thing as a whole, as JSON, with columns only for what it's looked up by,
+// so adding a field doesn't need the schema to change.
+type SQLiteStore struct {
+	db *sql.DB
+}
+
+// sqliteSchema creates the tables if they don't exist yet.
+const sqliteSchema = `
+CREATE TABLE IF NOT EXISTS users (
+	id INTEGER PRIMARY KEY,
+	first_name TEXT NOT NULL,
+	data TEXT NOT NULL
+);
+CREATE TABLE IF NOT EXISTS activities (
+	user_id INTEGER NOT NULL,
+	id INTEGER NOT NULL,
+	start_date INTEGER NOT NULL,
+	data TEXT NOT NULL,
+	PRIMARY KEY (user_id, id)
+);
+CREATE INDEX IF NOT EXISTS activities_by_start ON activities (user_id, start_date);
+CREATE TABLE IF NOT EXISTS sync_states (
+	user_id INTEGER PRIMARY KEY,
+	data TEXT NOT NULL
+);
+CREATE TABLE IF NOT EXISTS training_plans (
+	user_id INTEGER PRIMARY KEY,
+	data TEXT NOT NULL
+);
+CREATE TABLE IF NOT EXISTS audit_log (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	data TEXT NOT NULL
+);
+`
+
+// OpenSQLiteStore opens the SQLite database at path, creating it if it
+// doesn't exist.
+func OpenSQLiteStore(path string) (*SQLiteStore, error) {
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		return nil, err
+	}
+	// SQLite only allows one writer at a time, and an in-memory database
+	// only lasts as long as its connection.
+	db.SetMaxOpenConns(1)
+	if _, err := db.Exec(sqliteSchema); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &SQLiteStore{db: db}, nil
+}
+
+// Close closes the database.
+func (s *SQLiteStore) Close() error {
+	return s.db.Close()
+}
+
+func (s *SQLiteStore) GetUsers(ctx context.Context) ([]User, error) {
+	rows, err := s.db.QueryContext(ctx, "SELECT id, data FROM users ORDER BY first_name, id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	result := make([]User, 0)
+	for rows.Next() {
+		var u User
+		if err := scanJSON(rows, &u.ID, &u); err != nil {
+			return nil, err
+		}
+		result = append(result, u)
+	}
+	return result, rows.Err()
+}
+
+func (s *SQLiteStore) GetUser(ctx context.Context, id int64) (*User, error) {
+	var u User
+	err := s.getJSON(ctx, "SELECT data FROM users WHERE id = ?", id, &u)
+	if err == sql.ErrNoRows {
+		return nil, ErrNoSuchUser
+	}
+	if err != nil {
+		return nil, err
+	}
+	u.ID = id
+	return &u, nil
+}
+
+func (s *SQLiteStore) PutUser(ctx context.Context, u *User) error {
+	data, err := json.Marshal(u)
+	if err != nil {
+		return err
+	}
+	_, err = s.db.ExecContext(ctx, "INSERT OR REPLACE INTO users (id, first_name, data) VALUES (?, ?, ?)", u.ID, u.FirstName, data)
+	return err
+}
+
+func (s *SQLiteStore) UpdateUser(ctx context.Context, id int64, update func(u *User) error) (*User, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback() // nolint: errcheck
+	var data []byte
+	err = tx.QueryRowContext(ctx, "SELECT data FROM users WHERE id = ?", id).Scan(&data)
+	if err == sql.ErrNoRows {
+		return nil, ErrNoSuchUser
+	}
+	if err != nil {
+		return nil, err
+	}
+	var u User
+	if err := json.Unmarshal(data, &u); err != nil {
+		return nil, err
+	}
+	u.ID = id
+	if err := update(&u); err != nil {
+		return nil, err
+	}
+	if data, err = json.Marshal(&u); err != nil {
+		return nil, err
+	}
+	if _, err := tx.ExecContext(ctx, "UPDATE users SET first_name = ?, data = ? WHERE id = ?", u.FirstName, data, id); err != nil {
+		return nil, err
+	}
+	return &u, tx.Commit()
+}
+
+func (s *SQLiteStore) DeleteUser(ctx context.Context, id int64) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback() // nolint: errcheck
+	for _, stmt := range []string{
+		"DELETE FROM activities WHERE user_id = ?",
+		"DELETE FROM sync_states WHERE user_id = ?",
+		"DELETE FROM training_plans WHERE user_id = ?",
+		"DELETE FROM users WHERE id = ?",
+	} {
+		if _, err := tx.ExecContext(ctx, stmt, id); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (s *SQLiteStore) GetTrainingPlan(ctx context.Context, user int64) (*TrainingPlan, error) {
+	var plan TrainingPlan
+	err := s.getJSON(ctx, "SELECT data FROM training_plans WHERE user_id = ?", user, &plan)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &plan, nil
+}
+
+func (s *SQLiteStore) PutTrainingPlan(ctx context.Context, user int64, plan *TrainingPlan) error {
+	return s.putJSON(ctx, "INSERT OR REPLACE INTO training_plans (user_id, data) VALUES (?, ?)", user, plan)
+}
+
+func (s *SQLiteStore) PutActivities(ctx context.Context, user int64, acts []*strava.ActivitySummary) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback() // nolint: errcheck
+	for _, act := range acts {
+		data, err := json.Marshal(NewActivity(act))
+		if err != nil {
+			return err
+		}
+		_, err = tx.ExecContext(ctx, "INSERT OR REPLACE INTO activities (user_id, id, start_date, data) VALUES (?, ?, ?, ?)",
+			user, act.Id, act.StartDate.UnixNano(), data)
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (s *SQLiteStore) DeleteActivities(ctx context.Context, user int64, ids []int64) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback() // nolint: errcheck
+	for _, id := range ids {
+		if _, err := tx.ExecContext(ctx, "DELETE FROM activities WHERE user_id = ? AND id = ?", user, id); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (s *SQLiteStore) GetActivityIDs(ctx context.Context, user int64, after time.Time) ([]int64, error) {
+	rows, err := s.db.QueryContext(ctx, "SELECT id FROM activities WHERE user_id = ? AND start_date > ? ORDER BY start_date, id",
+		user, after.UnixNano())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var ids []int64
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+func (s *SQLiteStore) GetActivities(ctx context.Context, user int64) ([]*strava.ActivitySummary, error) {
+	rows, err := s.db.QueryContext(ctx, "SELECT id, data FROM activities WHERE user_id = ? ORDER BY start_date, id", user)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	result := make([]*strava.ActivitySummary, 0)
+	for rows.Next() {
+		var id int64
+		var a Activity
+		if err := scanJSON(rows, &id, &a); err != nil {
+			return nil, err
+		}
+		result = append(result, a.Summary(id))
+	}
+	return result, rows.Err()
+}
+
+func (s *SQLiteStore) GetSyncState(ctx context.Context, user int64) (*SyncState, error) {
+	var state SyncState
+	err := s.getJSON(ctx, "SELECT data FROM sync_states WHERE user_id = ?", user, &state)
+	if err != nil && err != sql.ErrNoRows {
+		return nil, err
+	}
+	return &state, nil
+}
+
+func (s *SQLiteStore) PutSyncState(ctx context.Context, user int64, state *SyncState) error {
+	return s.putJSON(ctx, "INSERT OR REPLACE INTO sync_states (user_id, data) VALUES (?, ?)", user, state)
+}
+
+func (s *SQLiteStore) AddAuditEntry(ctx context.Context, e *AuditEntry) error {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	_, err = s.db.ExecContext(ctx, "INSERT INTO audit_log (data) VALUES (?)", data)
+	return err
+}
+
+func (s *SQLiteStore) GetAuditLog(ctx context.Context) ([]AuditEntry, error) {
+	rows, err := s.db.QueryContext(ctx, "SELECT id, data FROM audit_log ORDER BY id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	result := make([]AuditEntry, 0)
+	for rows.Next() {
+		var id int64
+		var e AuditEntry
+		if err := scanJSON(rows, &id, &e); err != nil {
+			return nil, err
+		}
+		result = append(result, e)
+	}
+	return result, rows.Err()
+}
+
+// getJSON runs a query for the data column of the row with the given id,
+// and decodes it into v.
+func (s *SQLiteStore) getJSON(ctx context.Context, query string, id int64, v interface{}) error {
+	var data []byte
+	if err := s.db.QueryRowContext(ctx, query, id).Scan(&data); err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// putJSON runs a statement that saves v, as JSON, for the given id.
+func (s *SQLiteStore) putJSON(ctx context.Context, stmt string, id int64, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	_, err = s.db.ExecContext(ctx, stmt, id, data)
+	return err
+}
+
+// scanJSON reads a row's id and data columns, decoding data into v.
+func scanJSON(rows *sql.Rows, id *int64, v interface{}) error {
+	var data []byte
+	if err := rows.Scan(id, &data); err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
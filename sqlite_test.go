@@ -0,0 +1,18 @@
+//go:build !appengine
+
+package handlers
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+)
+
+func TestSQLiteStore(t *testing.T) {
+	s, err := OpenSQLiteStore(filepath.Join(t.TempDir(), "jaju.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close() // nolint: errcheck
+	testStore(t, context.Background(), s)
+}
@@ -0,0 +1,363 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	strava "github.com/strava/go.strava"
+	"golang.org/x/oauth2"
+)
+
+// ErrNoSuchUser is returned when there's no user with a given athlete id.
+var ErrNoSuchUser = errors.New("no such user")
+
+// UserStore keeps the users and their training plans. Users are identified by
+// their Strava athlete id.
+type UserStore interface {
+	// GetUsers fetches all users in order of first name.
+	GetUsers(ctx context.Context) ([]User, error)
+
+	// GetUser fetches the user with the given athlete id, returning
+	// ErrNoSuchUser if they haven't registered.
+	GetUser(ctx context.Context, id int64) (*User, error)
+
+	// PutUser adds or replaces the user with u.ID.
+	PutUser(ctx context.Context, u *User) error
+
+	// UpdateUser changes the user with the given athlete id, reading them
+	// and writing them back atomically, so that jobs changing different
+	// things about the same user at once don't undo each other's changes.
+	// It returns the changed user, or ErrNoSuchUser if they haven't
+	// registered. Nothing is written if update fails.
+	UpdateUser(ctx context.Context, id int64, update func(u *User) error) (*User, error)
+
+	// GetTrainingPlan fetches the user's training plan, or nil if they
+	// don't have one.
+	GetTrainingPlan(ctx context.Context, user int64) (*TrainingPlan, error)
+
+	// PutTrainingPlan saves the user's training plan, replacing any they had.
+	PutTrainingPlan(ctx context.Context, user int64, plan *TrainingPlan) error
+}
+
+// ActivityStore keeps each user's activities and how far they have been
+// synced from Strava.
+type ActivityStore interface {
+	// PutActivities upserts the given activities for the user.
+	PutActivities(ctx context.Context, user int64, acts []*strava.ActivitySummary) error
+
+	// DeleteActivities deletes the user's stored activities with the given ids.
+	DeleteActivities(ctx context.Context, user int64, ids []int64) error
+
+	// GetActivityIDs fetches the ids of the user's stored activities that
+	// started after after, in chronological order.
+	GetActivityIDs(ctx context.Context, user int64, after time.Time) ([]int64, error)
+
+	// GetActivities fetches all of the user's stored activities in
+	// chronological order.
+	GetActivities(ctx context.Context, user int64) ([]*strava.ActivitySummary, error)
+
+	// GetSyncState fetches the user's sync state, which is empty if they
+	// have never been synced.
+	GetSyncState(ctx context.Context, user int64) (*SyncState, error)
+
+	// PutSyncState saves the user's sync state.
+	PutSyncState(ctx context.Context, user int64, state *SyncState) error
+}
+
+// AuditLog keeps a record of what's been done to members' accounts.
+type AuditLog interface {
+	// AddAuditEntry adds e to the log.
+	AddAuditEntry(ctx context.Context, e *AuditEntry) error
+
+	// GetAuditLog fetches every entry in the log, oldest first.
+	GetAuditLog(ctx context.Context) ([]AuditEntry, error)
+}
+
+// Store is everything the app keeps.
+type Store interface {
+	UserStore
+	ActivityStore
+	AuditLog
+
+	// DeleteUser deletes the user with the given athlete id and everything
+	// kept about them: their training plan, activities and sync state.
+	// Deleting a user who isn't there does nothing.
+	DeleteUser(ctx context.Context, id int64) error
+}
+
+// RegisterNewUser saves a user's Strava tokens and profile when they
+// authorise us. Someone who has registered before, or whose activities were
+// imported, keeps their data and has their tokens replaced.
+func RegisterNewUser(ctx context.Context, users UserStore, auth *Authorization, now time.Time) (*User, error) {
+	register := func(u *User) {
+		u.setProfile(&auth.Athlete, now)
+		u.setToken(auth.Token)
+	}
+	user, err := users.UpdateUser(ctx, auth.Athlete.Id, func(u *User) error {
+		register(u)
+		return nil
+	})
+	if err == ErrNoSuchUser {
+		user = &User{ID: auth.Athlete.Id}
+		register(user)
+		err = users.PutUser(ctx, user)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+// errNoName is returned when a user who hasn't registered is imported without a name.
+var errNoName = errors.New("a new user needs a name")
+
+// RegisterOfflineUser makes sure there's a user with the given Strava athlete
+// id to import activities for, creating one called firstName if there isn't.
+// The user can connect Strava later and keep the imported activities.
+func RegisterOfflineUser(ctx context.Context, users UserStore, id int64, firstName string) (*User, error) {
+	u, err := users.GetUser(ctx, id)
+	if err != ErrNoSuchUser {
+		return u, err
+	}
+	if firstName == "" {
+		return nil, errNoName
+	}
+	u = &User{ID: id, FirstName: firstName}
+	if err := users.PutUser(ctx, u); err != nil {
+		return nil, err
+	}
+	return u, nil
+}
+
+// UserTokenSource supplies the user's Strava access token, refreshing it when
+// it is about to expire and saving the new token in users and u. Only the
+// token is saved, so that the rest of u can't overwrite newer changes.
+// Refreshes use the HTTP client from ctx as described by oauth2.HTTPClient.
+func UserTokenSource(ctx context.Context, users UserStore, u *User) oauth2.TokenSource {
+	return newTokenSource(ctx, u.Token(), func(tok *oauth2.Token) error {
+		u.setToken(tok)
+		_, err := users.UpdateUser(ctx, u.ID, func(stored *User) error {
+			stored.setToken(tok)
+			return nil
+		})
+		return err
+	})
+}
+
+// SyncState records how far a user's activities have been synced from Strava.
+type SyncState struct {
+	// The start time of the newest activity that has been synced.
+	LastActivityStart time.Time
+
+	// When the user's history was last fully refetched.
+	LastFullSync time.Time
+
+	// Why the last sync failed, or empty if it succeeded.
+	LastError string
+
+	// Whether the last sync failed because Strava rejected the user's token.
+	Unauthorized bool
+}
+
+// Err gets the reason the last sync failed, or nil if it succeeded.
+func (s *SyncState) Err() error {
+	if s.Unauthorized {
+		return fmt.Errorf("%s: %w", s.LastError, ErrUnauthorized)
+	}
+	if s.LastError != "" {
+		return errors.New(s.LastError)
+	}
+	return nil
+}
+
+// setErr records the reason a sync failed, or clears it if err is nil.
+func (s *SyncState) setErr(err error) {
+	s.LastError = ""
+	if err != nil {
+		s.LastError = err.Error()
+	}
+	s.Unauthorized = IsAuthError(err)
+}
+
+// MemoryStore is a Store that only lasts as long as the process, for tests
+// and trying things out. Everything is copied in and out so that callers
+// can't change what's stored by accident.
+type MemoryStore struct {
+	mu         sync.Mutex
+	users      map[int64]User
+	plans      map[int64]TrainingPlan
+	activities map[int64]map[int64]Activity
+	states     map[int64]SyncState
+	audit      []AuditEntry
+}
+
+// NewMemoryStore makes an empty MemoryStore.
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		users:      map[int64]User{},
+		plans:      map[int64]TrainingPlan{},
+		activities: map[int64]map[int64]Activity{},
+		states:     map[int64]SyncState{},
+	}
+}
+
+func (s *MemoryStore) GetUsers(ctx context.Context) ([]User, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	result := make([]User, 0, len(s.users))
+	for _, u := range s.users {
+		result = append(result, u)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].FirstName != result[j].FirstName {
+			return result[i].FirstName < result[j].FirstName
+		}
+		return result[i].ID < result[j].ID
+	})
+	return result, nil
+}
+
+func (s *MemoryStore) GetUser(ctx context.Context, id int64) (*User, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	u, ok := s.users[id]
+	if !ok {
+		return nil, ErrNoSuchUser
+	}
+	return &u, nil
+}
+
+func (s *MemoryStore) PutUser(ctx context.Context, u *User) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.users[u.ID] = *u
+	return nil
+}
+
+func (s *MemoryStore) UpdateUser(ctx context.Context, id int64, update func(u *User) error) (*User, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	u, ok := s.users[id]
+	if !ok {
+		return nil, ErrNoSuchUser
+	}
+	if err := update(&u); err != nil {
+		return nil, err
+	}
+	s.users[id] = u
+	return &u, nil
+}
+
+func (s *MemoryStore) DeleteUser(ctx context.Context, id int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.users, id)
+	delete(s.plans, id)
+	delete(s.activities, id)
+	delete(s.states, id)
+	return nil
+}
+
+func (s *MemoryStore) GetTrainingPlan(ctx context.Context, user int64) (*TrainingPlan, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	plan, ok := s.plans[user]
+	if !ok {
+		return nil, nil
+	}
+	plan.Weeks = append([]PlanWeek(nil), plan.Weeks...)
+	return &plan, nil
+}
+
+func (s *MemoryStore) PutTrainingPlan(ctx context.Context, user int64, plan *TrainingPlan) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	p := *plan
+	p.Weeks = append([]PlanWeek(nil), plan.Weeks...)
+	s.plans[user] = p
+	return nil
+}
+
+func (s *MemoryStore) PutActivities(ctx context.Context, user int64, acts []*strava.ActivitySummary) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	stored := s.activities[user]
+	if stored == nil {
+		stored = map[int64]Activity{}
+		s.activities[user] = stored
+	}
+	for _, act := range acts {
+		stored[act.Id] = *NewActivity(act)
+	}
+	return nil
+}
+
+func (s *MemoryStore) DeleteActivities(ctx context.Context, user int64, ids []int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, id := range ids {
+		delete(s.activities[user], id)
+	}
+	return nil
+}
+
+func (s *MemoryStore) GetActivityIDs(ctx context.Context, user int64, after time.Time) ([]int64, error) {
+	acts, err := s.GetActivities(ctx, user)
+	if err != nil {
+		return nil, err
+	}
+	var ids []int64
+	for _, act := range acts {
+		if act.StartDate.After(after) {
+			ids = append(ids, act.Id)
+		}
+	}
+	return ids, nil
+}
+
+func (s *MemoryStore) GetActivities(ctx context.Context, user int64) ([]*strava.ActivitySummary, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	result := make([]*strava.ActivitySummary, 0, len(s.activities[user]))
+	for id, a := range s.activities[user] {
+		result = append(result, a.Summary(id))
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if !result[i].StartDate.Equal(result[j].StartDate) {
+			return result[i].StartDate.Before(result[j].StartDate)
+		}
+		return result[i].Id < result[j].Id
+	})
+	return result, nil
+}
+
+func (s *MemoryStore) GetSyncState(ctx context.Context, user int64) (*SyncState, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	state := s.states[user]
+	return &state, nil
+}
+
+func (s *MemoryStore) PutSyncState(ctx context.Context, user int64, state *SyncState) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.states[user] = *state
+	return nil
+}
+
+func (s *MemoryStore) AddAuditEntry(ctx context.Context, e *AuditEntry) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.audit = append(s.audit, *e)
+	return nil
+}
+
+func (s *MemoryStore) GetAuditLog(ctx context.Context) ([]AuditEntry, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]AuditEntry{}, s.audit...), nil
+}
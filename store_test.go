@@ -0,0 +1,157 @@
+package handlers
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	strava "github.com/strava/go.strava"
+)
+
+// testStore checks that a Store keeps what it's given.
+func testStore(t *testing.T, ctx context.Context, s Store) {
+	if _, err := s.GetUser(ctx, 1); err != ErrNoSuchUser {
+		t.Errorf("Expected ErrNoSuchUser, got %v", err)
+	}
+	alice := &User{ID: 2, FirstName: "alice", StravaToken: "a", TokenExpiry: saturday}
+	for _, u := range []*User{{ID: 1, FirstName: "bob"}, alice} {
+		if err := s.PutUser(ctx, u); err != nil {
+			t.Fatal(err)
+		}
+	}
+	alice.StravaToken = "b"
+	if err := s.PutUser(ctx, alice); err != nil {
+		t.Fatal(err)
+	}
+	users, err := s.GetUsers(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(users) != 2 || !reflect.DeepEqual(users[0], *alice) || users[1].ID != 1 {
+		t.Errorf("Expected alice then bob, got %+v", users)
+	}
+	if u, err := s.GetUser(ctx, 2); err != nil || !reflect.DeepEqual(u, alice) {
+		t.Errorf("Expected %+v, got %+v (%v)", alice, u, err)
+	}
+	if _, err := s.UpdateUser(ctx, 3, func(u *User) error { return nil }); err != ErrNoSuchUser {
+		t.Errorf("Expected ErrNoSuchUser, got %v", err)
+	}
+	alice.City = "Sydney"
+	u, err := s.UpdateUser(ctx, 2, func(u *User) error {
+		u.City = "Sydney"
+		return nil
+	})
+	if err != nil || !reflect.DeepEqual(u, alice) {
+		t.Errorf("Expected %+v, got %+v (%v)", alice, u, err)
+	}
+	if _, err := s.UpdateUser(ctx, 2, func(u *User) error {
+		u.City = "Perth"
+		return errNoName
+	}); err != errNoName {
+		t.Errorf("Expected the update's error, got %v", err)
+	}
+	if u, err := s.GetUser(ctx, 2); err != nil || !reflect.DeepEqual(u, alice) {
+		t.Errorf("Expected %+v, got %+v (%v)", alice, u, err)
+	}
+
+	first := run(saturday.Add(morning), 20*time.Minute, short)
+	first.Id = 10
+	first.Athlete = strava.AthleteSummary{}
+	second := run(monday.Add(morning), 30*time.Minute, long)
+	second.Id = 5
+	second.Athlete = strava.AthleteSummary{}
+	if err := s.PutActivities(ctx, 2, []*strava.ActivitySummary{second, first}); err != nil {
+		t.Fatal(err)
+	}
+	second.Name = "renamed"
+	if err := s.PutActivities(ctx, 2, []*strava.ActivitySummary{second}); err != nil {
+		t.Fatal(err)
+	}
+	acts, err := s.GetActivities(ctx, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := []*strava.ActivitySummary{first, second}; !reflect.DeepEqual(acts, expected) {
+		t.Errorf("Expected %v, got %v", expected, acts)
+	}
+	if acts, err := s.GetActivities(ctx, 1); err != nil || len(acts) != 0 {
+		t.Errorf("Expected bob to have no activities, got %v (%v)", acts, err)
+	}
+	ids, err := s.GetActivityIDs(ctx, 2, saturday.Add(morning))
+	if err != nil || !reflect.DeepEqual(ids, []int64{5}) {
+		t.Errorf("Expected only the later activity, got %v (%v)", ids, err)
+	}
+	if err := s.DeleteActivities(ctx, 2, []int64{5}); err != nil {
+		t.Fatal(err)
+	}
+	ids, err = s.GetActivityIDs(ctx, 2, time.Time{})
+	if err != nil || !reflect.DeepEqual(ids, []int64{10}) {
+		t.Errorf("Expected the activity to be deleted, got %v (%v)", ids, err)
+	}
+
+	state, err := s.GetSyncState(ctx, 2)
+	if err != nil || !reflect.DeepEqual(state, &SyncState{}) {
+		t.Errorf("Expected an empty sync state, got %+v (%v)", state, err)
+	}
+	state = &SyncState{LastActivityStart: saturday, LastError: "oops", Unauthorized: true}
+	if err := s.PutSyncState(ctx, 2, state); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := s.GetSyncState(ctx, 2); err != nil || !reflect.DeepEqual(got, state) {
+		t.Errorf("Expected %+v, got %+v (%v)", state, got, err)
+	}
+
+	if plan, err := s.GetTrainingPlan(ctx, 2); err != nil || plan != nil {
+		t.Errorf("Expected no plan, got %+v (%v)", plan, err)
+	}
+	plan := &TrainingPlan{RaceName: "race", RaceDate: nextSaturday, Weeks: []PlanWeek{{Start: week1, Distance: long, LongRun: short}}}
+	if err := s.PutTrainingPlan(ctx, 2, plan); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := s.GetTrainingPlan(ctx, 2); err != nil || !reflect.DeepEqual(got, plan) {
+		t.Errorf("Expected %+v, got %+v (%v)", plan, got, err)
+	}
+
+	if err := s.DeleteUser(ctx, 2); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.GetUser(ctx, 2); err != ErrNoSuchUser {
+		t.Errorf("Expected alice to be deleted, got %v", err)
+	}
+	if acts, err := s.GetActivities(ctx, 2); err != nil || len(acts) != 0 {
+		t.Errorf("Expected alice's activities to be deleted, got %v (%v)", acts, err)
+	}
+	if state, err := s.GetSyncState(ctx, 2); err != nil || !reflect.DeepEqual(state, &SyncState{}) {
+		t.Errorf("Expected alice's sync state to be deleted, got %+v (%v)", state, err)
+	}
+	if plan, err := s.GetTrainingPlan(ctx, 2); err != nil || plan != nil {
+		t.Errorf("Expected alice's plan to be deleted, got %+v (%v)", plan, err)
+	}
+	if users, err := s.GetUsers(ctx); err != nil || len(users) != 1 || users[0].ID != 1 {
+		t.Errorf("Expected only bob to be left, got %+v (%v)", users, err)
+	}
+	if err := s.DeleteUser(ctx, 2); err != nil {
+		t.Errorf("Expected deleting a missing user to do nothing, got %v", err)
+	}
+
+	if log, err := s.GetAuditLog(ctx); err != nil || len(log) != 0 {
+		t.Errorf("Expected an empty audit log, got %+v (%v)", log, err)
+	}
+	entries := []AuditEntry{
+		{Time: saturday, AthleteID: 2, Name: "alice", Action: "disconnect", By: "member"},
+		{Time: monday, AthleteID: 1, Name: "bob", Action: "disconnect", By: "admin"},
+	}
+	for i := range entries {
+		if err := s.AddAuditEntry(ctx, &entries[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if log, err := s.GetAuditLog(ctx); err != nil || !reflect.DeepEqual(log, entries) {
+		t.Errorf("Expected %+v, got %+v (%v)", entries, log, err)
+	}
+}
+
+func TestMemoryStore(t *testing.T) {
+	testStore(t, context.Background(), NewMemoryStore())
+}
@@ -2,23 +2,132 @@ package handlers
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"net/http"
 	"time"
 
 	strava "github.com/strava/go.strava"
-	"google.golang.org/appengine/urlfetch"
+	"golang.org/x/oauth2"
 )
 
-// NewStravaClient creates a strava client using the given access token.
-func NewStravaClient(ctx context.Context, accessToken string) *strava.Client {
-	return strava.NewClient(accessToken, urlfetch.Client(ctx))
+// NewStravaClient creates a strava client that sends requests with client
+// using the given access token.
+func NewStravaClient(client *http.Client, accessToken string) *strava.Client {
+	return strava.NewClient(accessToken, client)
+}
+
+// ErrUnauthorized means Strava no longer accepts a user's tokens, usually
+// because they revoked our access.
+var ErrUnauthorized = errors.New("strava rejected the user's token")
+
+// IsAuthError says whether err means the user has to authorise us on Strava again.
+func IsAuthError(err error) bool {
+	if err == nil {
+		return false
+	}
+	if errors.Is(err, ErrUnauthorized) {
+		return true
+	}
+	var se strava.Error
+	if errors.As(err, &se) && se.Message == "Authorization Error" {
+		return true
+	}
+	var re *oauth2.RetrieveError
+	if errors.As(err, &re) && re.Response != nil {
+		return re.Response.StatusCode == http.StatusBadRequest || re.Response.StatusCode == http.StatusUnauthorized
+	}
+	return false
+}
+
+// ErrNotFound means Strava has no activity with the id asked for, or won't
+// show it to us.
+var ErrNotFound = errors.New("strava has no such activity")
+
+// isNotFound says whether err is Strava saying it has no such record.
+func isNotFound(err error) bool {
+	var se strava.Error
+	return errors.As(err, &se) && se.Message == "Record Not Found"
 }
 
 type stravaFetcher struct {
 	httpClient *http.Client
 }
 
-func (f stravaFetcher) FetchActivities(token string) ([]*strava.ActivitySummary, error) {
-	s := strava.NewClient(token, f.httpClient)
-	return strava.NewCurrentAthleteService(s).ListActivities().After(int(time.Now().Add(-30 * 24 * time.Hour).Unix())).Do()
+// stravaLimiter tracks Strava's rate limits across every user's requests.
+var stravaLimiter = NewRateLimiter()
+
+// newStravaFetcher creates a fetcher that sends requests with client, keeping
+// within Strava's rate limits. The client's Timeout applies to each attempt
+// at a request, so that waiting for the rate limit and retrying aren't cut
+// short.
+func newStravaFetcher(client *http.Client) stravaFetcher {
+	t := NewRateLimitTransport(client.Transport, stravaLimiter)
+	t.Timeout = client.Timeout
+	return stravaFetcher{&http.Client{Transport: t}}
+}
+
+// activitiesPerPage is the largest page size Strava allows when listing activities.
+const activitiesPerPage = 200
+
+func (f stravaFetcher) FetchActivities(ctx context.Context, ts oauth2.TokenSource, after, before time.Time) ([]*strava.ActivitySummary, error) {
+	tok, err := ts.Token()
+	if err != nil {
+		return nil, err
+	}
+	s := strava.NewClient(tok.AccessToken, f.httpClient)
+	return fetchAllPages(ctx, func(page int) ([]*strava.ActivitySummary, error) {
+		call := strava.NewCurrentAthleteService(s).ListActivities().Page(page).PerPage(activitiesPerPage)
+		if !after.IsZero() {
+			call = call.After(int(after.Unix()))
+		}
+		if !before.IsZero() {
+			call = call.Before(int(before.Unix()))
+		}
+		return call.Do()
+	})
+}
+
+func (f stravaFetcher) FetchActivity(ctx context.Context, ts oauth2.TokenSource, id int64) (*strava.ActivitySummary, error) {
+	tok, err := ts.Token()
+	if err != nil {
+		return nil, err
+	}
+	s := strava.NewClient(tok.AccessToken, f.httpClient)
+	act, err := strava.NewActivitiesService(s).Get(id).Do()
+	if isNotFound(err) {
+		return nil, fmt.Errorf("activity %d: %w", id, ErrNotFound)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &act.ActivitySummary, nil
+}
+
+func (f stravaFetcher) FetchAthlete(ctx context.Context, ts oauth2.TokenSource) (*strava.AthleteDetailed, error) {
+	tok, err := ts.Token()
+	if err != nil {
+		return nil, err
+	}
+	s := strava.NewClient(tok.AccessToken, f.httpClient)
+	return strava.NewCurrentAthleteService(s).Get().Do()
+}
+
+// fetchAllPages calls fetchPage with successive page numbers, starting at 1,
+// and collects the results until a page comes back short or ctx is done.
+func fetchAllPages(ctx context.Context, fetchPage func(page int) ([]*strava.ActivitySummary, error)) ([]*strava.ActivitySummary, error) {
+	var result []*strava.ActivitySummary
+	for page := 1; ; page++ {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		acts, err := fetchPage(page)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, acts...)
+		if len(acts) < activitiesPerPage {
+			return result, nil
+		}
+	}
 }
@@ -41,7 +41,7 @@ func TestThings(t *testing.T) {
 		<-b
 		_, ok := <-c
 		if ok {
-			t.Fatal("Didn't expect to be able to read from c")
+			t.Error("Didn't expect to be able to read from c")
 		}
 		d <- true
 	}()
@@ -0,0 +1,213 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	strava "github.com/strava/go.strava"
+	"golang.org/x/oauth2"
+)
+
+// HistoryWindow is how far back activities are synced from Strava. It is long
+// enough to cover a whole marathon build.
+const HistoryWindow = 20 * 7 * 24 * time.Hour
+
+// SyncMode controls how much of each user's history a sync fetches.
+type SyncMode int
+
+const (
+	// IncrementalSync only fetches activities that started after the last
+	// one that was synced.
+	IncrementalSync SyncMode = iota
+
+	// FullSync refetches everything in the HistoryWindow so that activities
+	// that were edited or deleted on Strava are reconciled.
+	FullSync
+)
+
+// SyncAll syncs every user's activities from Strava, sending requests and
+// refreshing tokens with client.
+func SyncAll(ctx context.Context, store Store, client *http.Client, mode SyncMode, now time.Time) error {
+	users, err := store.GetUsers(ctx)
+	if err != nil {
+		return err
+	}
+	ctx = context.WithValue(ctx, oauth2.HTTPClient, client)
+	return SyncActivities(ctx, store, users, newStravaFetcher(client), mode, now)
+}
+
+// SyncActivities fetches each user's activities from Strava and keeps them in
+// store. Users who haven't connected Strava are skipped. A failure for one
+// user doesn't stop the others from being synced. Expired access tokens are
+// refreshed using the HTTP client from ctx as described by oauth2.HTTPClient.
+func SyncActivities(ctx context.Context, store Store, users []User, fetcher ActivityFetcher, mode SyncMode, now time.Time) error {
+	results := FanOut(ctx, FetchParallelism, indices(len(users)), func(ctx context.Context, i int) (int, error) {
+		if !users[i].Connected() {
+			// Their activities were imported, so there's nothing to sync.
+			return 0, nil
+		}
+		n, err := syncUser(ctx, store, &users[i], fetcher, mode, now)
+		if IsAuthError(err) {
+			// There's no point trying again until they reconnect.
+			if _, err := clearRejectedToken(ctx, store, &users[i]); err != nil {
+				logErrorf(ctx, "Failed to disconnect %s: %s", users[i].FirstName, err)
+			}
+		}
+		if err != nil {
+			if err := recordSyncError(ctx, store, users[i].ID, err); err != nil {
+				logErrorf(ctx, "Failed to record sync error for %s: %s", users[i].FirstName, err)
+			}
+			return 0, err
+		}
+		return n, nil
+	})
+	failed := 0
+	for i, r := range results {
+		if r.Err != nil {
+			logErrorf(ctx, "Failed to sync activities for %s: %s", users[i].FirstName, r.Err)
+			failed++
+			continue
+		}
+		logInfof(ctx, "Synced %d activities for %s", r.Value, users[i].FirstName)
+	}
+	if failed > 0 {
+		return fmt.Errorf("failed to sync %d of %d users", failed, len(users))
+	}
+	return nil
+}
+
+// indices returns the numbers from 0 to n-1, for fanning out over parallel slices.
+func indices(n int) []int {
+	result := make([]int, n)
+	for i := range result {
+		result[i] = i
+	}
+	return result
+}
+
+// syncUser syncs a single user's activities and returns how many were fetched.
+// Users that have never been synced always get a full sync.
+func syncUser(ctx context.Context, store Store, u *User, fetcher ActivityFetcher, mode SyncMode, now time.Time) (int, error) {
+	state, err := store.GetSyncState(ctx, u.ID)
+	if err != nil {
+		return 0, err
+	}
+	full := mode == FullSync || state.LastActivityStart.IsZero()
+	after := state.LastActivityStart
+	if full {
+		after = now.Add(-HistoryWindow)
+	}
+	acts, err := fetcher.FetchActivities(ctx, UserTokenSource(ctx, store, u), after, time.Time{})
+	if err != nil {
+		return 0, err
+	}
+	if err := putSyncedActivities(ctx, store, u.ID, acts); err != nil {
+		return 0, err
+	}
+	if full {
+		if err := deleteMissingActivities(ctx, store, u.ID, after, acts); err != nil {
+			return 0, err
+		}
+		state.LastFullSync = now
+	}
+	for _, act := range acts {
+		if act.StartDate.After(state.LastActivityStart) {
+			state.LastActivityStart = act.StartDate
+		}
+	}
+	state.setErr(nil)
+	return len(acts), store.PutSyncState(ctx, u.ID, state)
+}
+
+// recordSyncError saves the reason the user's last sync failed so that it
+// can be shown alongside their stale activities.
+func recordSyncError(ctx context.Context, store ActivityStore, user int64, syncErr error) error {
+	state, err := store.GetSyncState(ctx, user)
+	if err != nil {
+		return err
+	}
+	state.setErr(syncErr)
+	return store.PutSyncState(ctx, user, state)
+}
+
+// putSyncedActivities stores activities fetched from Strava, deleting any
+// imported copies of them so that they aren't counted twice.
+func putSyncedActivities(ctx context.Context, store ActivityStore, user int64, acts []*strava.ActivitySummary) error {
+	if err := store.PutActivities(ctx, user, acts); err != nil {
+		return err
+	}
+	if len(acts) == 0 {
+		return nil
+	}
+	stored, err := store.GetActivities(ctx, user)
+	if err != nil {
+		return err
+	}
+	copies := importedCopies(stored, acts)
+	if len(copies) == 0 {
+		return nil
+	}
+	return store.DeleteActivities(ctx, user, copies)
+}
+
+// deleteMissingActivities deletes stored activities that started after after
+// but aren't in acts, because they have been deleted from Strava. Activities
+// that were imported from files rather than Strava are kept.
+func deleteMissingActivities(ctx context.Context, store ActivityStore, user int64, after time.Time, acts []*strava.ActivitySummary) error {
+	fetched := make(map[int64]bool, len(acts))
+	for _, act := range acts {
+		fetched[act.Id] = true
+	}
+	stored, err := store.GetActivityIDs(ctx, user, after)
+	if err != nil {
+		return err
+	}
+	var missing []int64
+	for _, id := range stored {
+		if !fetched[id] && !isImportedID(id) {
+			missing = append(missing, id)
+		}
+	}
+	return store.DeleteActivities(ctx, user, missing)
+}
+
+// LoadUserHistory builds each user's marathon training history from the
+// activities in store, alongside their training plan.
+// Users whose activities couldn't be loaded, or whose last sync failed, have
+// Err set rather than failing everyone else.
+func LoadUserHistory(ctx context.Context, store Store, users []User, opts HistoryOptions) []*UserMarathonTracking {
+	results := FanOut(ctx, 0, indices(len(users)), func(ctx context.Context, i int) (*UserMarathonTracking, error) {
+		umt := &UserMarathonTracking{AthleteID: users[i].ID, Name: users[i].FirstName, Picture: users[i].ProfilePictureMedium, Types: opts.Types, Units: opts.unitsFor(&users[i])}
+		acts, err := store.GetActivities(ctx, users[i].ID)
+		if err != nil {
+			return nil, err
+		}
+		umt.Weeks = SummarizeWeeks(opts.FilterActivities(acts), opts.WeekStart, opts.Types, opts.Policy)
+		// The weeks before the range still count towards the workload,
+		// which only goes by running.
+		AnalyzeWorkload(umt.Weeks, SummarizeWeeks(acts, opts.WeekStart, opts.Types.Runs(), opts.Policy))
+		plan, err := store.GetTrainingPlan(ctx, users[i].ID)
+		if err != nil {
+			return nil, err
+		}
+		umt.Plan = plan
+		umt.Weeks = ApplyPlan(umt.Weeks, opts.FilterPlan(plan), opts.WeekStart)
+		state, err := store.GetSyncState(ctx, users[i].ID)
+		if err != nil {
+			return nil, err
+		}
+		umt.Err = state.Err()
+		return umt, nil
+	})
+	result := make([]*UserMarathonTracking, len(users))
+	for i, r := range results {
+		result[i] = r.Value
+		if r.Err != nil {
+			logErrorf(ctx, "Failed to load history for %s: %s", users[i].FirstName, r.Err)
+			result[i] = &UserMarathonTracking{AthleteID: users[i].ID, Name: users[i].FirstName, Picture: users[i].ProfilePictureMedium, Units: opts.unitsFor(&users[i]), Err: r.Err}
+		}
+	}
+	return result
+}
@@ -0,0 +1,252 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	strava "github.com/strava/go.strava"
+	"golang.org/x/oauth2"
+)
+
+func TestActivityRoundTrip(t *testing.T) {
+	act := run(saturday.Add(morning), 20*time.Minute, short)
+	act.Id = 42
+	act.Athlete = strava.AthleteSummary{}
+	act.Manual = true
+	if got := NewActivity(act).Summary(42); !reflect.DeepEqual(got, act) {
+		t.Errorf("Expected %v, got %v", act, got)
+	}
+}
+
+func TestSyncActivities(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemoryStore()
+	for _, auth := range []*Authorization{
+		makeAuth("a", "alice", "k", 1),
+		makeAuth("mystery", "bob", "k", 2),
+	} {
+		if _, err := RegisterNewUser(ctx, store, auth, time.Now()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	first := run(saturday.Add(morning), 20*time.Minute, short)
+	first.Id = 1
+	second := run(monday.Add(morning), 30*time.Minute, long)
+	second.Id = 2
+	f := stubFetcher(map[string][]*strava.ActivitySummary{
+		"a": {second, first},
+	})
+	now := nextSaturday
+
+	users, err := store.GetUsers(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := SyncActivities(ctx, store, users, f, IncrementalSync, now); err == nil {
+		t.Error("Expected an error for the user with an unknown token")
+	}
+	// Syncing again must update activities in place rather than duplicating them.
+	if err := SyncActivities(ctx, store, users[:1], f, FullSync, now); err != nil {
+		t.Fatal(err)
+	}
+
+	umt := LoadUserHistory(ctx, store, users, HistoryOptions{WeekStart: DefaultWeekStart})
+	expected := []*UserMarathonTracking{
+		{AthleteID: 1, Name: "alice", Units: Metric, Weeks: []WeekSummary{summary(week1, 2, 50*time.Minute, short+long, long, 30*time.Minute)}},
+		{AthleteID: 2, Name: "bob", Units: Metric, Err: errors.New("not found")},
+	}
+	if !reflect.DeepEqual(umt, expected) {
+		t.Errorf("Expected %v, got %v", expected, umt)
+	}
+
+	state, err := store.GetSyncState(ctx, users[0].ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !state.LastActivityStart.Equal(second.StartDate) || !state.LastFullSync.Equal(now) {
+		t.Errorf("Unexpected sync state %+v", state)
+	}
+}
+
+func TestLoadUserHistoryWorkloadRunsOnly(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemoryStore()
+	if _, err := RegisterNewUser(ctx, store, makeAuth("a", "alice", "k", 1), time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	acts := []*strava.ActivitySummary{
+		run(saturday.Add(morning), 20*time.Minute, short),
+		run(nextSaturday.Add(morning), 20*time.Minute, short),
+		ride(nextSaturday.Add(afternoon), 2*time.Hour, 4*long),
+	}
+	for i, act := range acts {
+		act.Id = int64(i + 1)
+	}
+	if err := store.PutActivities(ctx, 1, acts); err != nil {
+		t.Fatal(err)
+	}
+	users, err := store.GetUsers(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The ride counts towards the second week's distance, but running
+	// didn't go up.
+	umt := LoadUserHistory(ctx, store, users, HistoryOptions{WeekStart: DefaultWeekStart, Types: AllEndurance()})
+	weeks := umt[0].Weeks
+	if len(weeks) != 2 || weeks[1].Distance != short+4*long {
+		t.Fatalf("Expected the ride to be counted, got %+v", weeks)
+	}
+	if w := weeks[1].Workload; w.PreviousDistance != short || w.Change != 0 || w.TooFast {
+		t.Errorf("Expected the workload to only go by runs, got %+v", w)
+	}
+}
+
+func TestIncrementalAndFullSync(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemoryStore()
+	if _, err := RegisterNewUser(ctx, store, makeAuth("a", "alice", "k", 1), time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	users, err := store.GetUsers(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	first := run(saturday.Add(morning), 20*time.Minute, short)
+	first.Id = 1
+	second := run(monday.Add(morning), 30*time.Minute, long)
+	second.Id = 2
+	f := stubFetcher{"a": {first}}
+	now := nextSaturday
+	if err := SyncActivities(ctx, store, users, f, IncrementalSync, now); err != nil {
+		t.Fatal(err)
+	}
+
+	// The first activity is deleted on Strava and two more are uploaded.
+	third := run(tuesday.Add(morning), 10*time.Minute, short)
+	third.Id = 3
+	f["a"] = []*strava.ActivitySummary{second, third}
+	if err := SyncActivities(ctx, store, users, f, IncrementalSync, now); err != nil {
+		t.Fatal(err)
+	}
+	ids, err := store.GetActivityIDs(ctx, users[0].ID, time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// An incremental sync only picks up activities newer than the last one.
+	if expected := []int64{1, 2, 3}; !reflect.DeepEqual(ids, expected) {
+		t.Errorf("After incremental sync expected %v, got %v", expected, ids)
+	}
+
+	if err := SyncActivities(ctx, store, users, f, FullSync, now); err != nil {
+		t.Fatal(err)
+	}
+	ids, err = store.GetActivityIDs(ctx, users[0].ID, time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := []int64{2, 3}; !reflect.DeepEqual(ids, expected) {
+		t.Errorf("After full sync expected %v, got %v", expected, ids)
+	}
+}
+
+func TestSyncReplacesImportedCopies(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemoryStore()
+	if _, err := RegisterNewUser(ctx, store, makeAuth("a", "alice", "k", 1), time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	users, err := store.GetUsers(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Alice's Saturday run was imported from a GPX file before she
+	// connected Strava, along with an older run that Strava doesn't have.
+	copied := run(saturday.Add(morning), 20*time.Minute, short)
+	copied.Id = importedIDBase + copied.StartDate.Unix()
+	older := run(saturday.Add(-7*24*time.Hour), 20*time.Minute, short)
+	older.Id = importedIDBase + older.StartDate.Unix()
+	if err := store.PutActivities(ctx, 1, []*strava.ActivitySummary{copied, older}); err != nil {
+		t.Fatal(err)
+	}
+	synced := run(saturday.Add(morning+time.Second), 20*time.Minute, short)
+	synced.Id = 7
+	f := stubFetcher{"a": {synced}}
+	if err := SyncActivities(ctx, store, users, f, FullSync, nextSaturday); err != nil {
+		t.Fatal(err)
+	}
+	ids, err := store.GetActivityIDs(ctx, 1, time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := []int64{older.Id, 7}; !reflect.DeepEqual(ids, expected) {
+		t.Errorf("Expected the imported copy to be replaced, got %v", ids)
+	}
+
+	// Importing the file again doesn't bring the copy back.
+	stored, err := store.GetActivities(ctx, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if copies := importedCopies([]*strava.ActivitySummary{copied}, stored); !reflect.DeepEqual(copies, []int64{copied.Id}) {
+		t.Errorf("Expected the imported activity to be a copy, got %v", copies)
+	}
+}
+
+func TestSyncStateErr(t *testing.T) {
+	for _, tc := range []struct {
+		err       error
+		reconnect bool
+	}{
+		{nil, false},
+		{errors.New("strava is down"), false},
+		{fmt.Errorf("refreshing: %w", ErrUnauthorized), true},
+		{strava.Error{Message: "Authorization Error"}, true},
+		{&oauth2.RetrieveError{Response: &http.Response{StatusCode: http.StatusUnauthorized}}, true},
+		{&oauth2.RetrieveError{Response: &http.Response{StatusCode: http.StatusInternalServerError}}, false},
+	} {
+		var state SyncState
+		state.setErr(tc.err)
+		err := state.Err()
+		if (err == nil) != (tc.err == nil) {
+			t.Errorf("Expected %v to round trip, got %v", tc.err, err)
+		}
+		if tc.err != nil && err.Error() != tc.err.Error() && !strings.HasPrefix(err.Error(), tc.err.Error()) {
+			t.Errorf("Expected message %q, got %q", tc.err, err)
+		}
+		umt := &UserMarathonTracking{Err: err}
+		if umt.NeedsReconnect() != tc.reconnect {
+			t.Errorf("Expected %v to need reconnecting to be %v", tc.err, tc.reconnect)
+		}
+	}
+}
+
+func TestSyncDisconnectsRejectedUsers(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemoryStore()
+	if _, err := RegisterNewUser(ctx, store, makeAuth("a", "alice", "k", 1), time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	users, err := store.GetUsers(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := SyncActivities(ctx, store, users, revokedFetcher{}, IncrementalSync, nextSaturday); err == nil {
+		t.Error("Expected the sync to fail")
+	}
+	if u, err := store.GetUser(ctx, 1); err != nil || u.Connected() {
+		t.Errorf("Expected alice to be disconnected, got %+v (%v)", u, err)
+	}
+	umt := LoadUserHistory(ctx, store, []User{{ID: 1, FirstName: "alice"}}, HistoryOptions{WeekStart: DefaultWeekStart})
+	if !umt[0].NeedsReconnect() {
+		t.Errorf("Expected alice to be asked to reconnect, got %+v", umt[0])
+	}
+}
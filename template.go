@@ -4,52 +4,379 @@ import (
 	"bytes"
 	"fmt"
 	"html/template"
+	"net/url"
+	"strings"
+	"time"
 
 	"github.com/olekukonko/tablewriter"
 )
 
 type mainTplArgs struct {
-	Umt         []*UserMarathonTracking
-	ClientID    string
-	RedirectURI string
+	Umt []*UserMarathonTracking
+
+	// The logged in user, and the CSRF token for their forms.
+	Me        *User
+	CSRFToken string
+
+	// The logged in user's new API token, only shown on their dashboard
+	// straight after they make it.
+	APIToken string
+
+	// The page's query, for the links that change one thing about it.
+	Query url.Values
+}
+
+// withParams makes a link to the current page with its query q changed by
+// setting each name in pairs to the value that follows it, or removing the
+// name if the value is empty. Everything else about the query is kept.
+func withParams(q url.Values, pairs ...string) string {
+	changed := url.Values{}
+	for k, v := range q {
+		changed[k] = v
+	}
+	for i := 0; i+1 < len(pairs); i += 2 {
+		if pairs[i+1] == "" {
+			changed.Del(pairs[i])
+		} else {
+			changed.Set(pairs[i], pairs[i+1])
+		}
+	}
+	return "?" + changed.Encode()
 }
 
 func makeTable(umt *UserMarathonTracking) string {
+	units := umt.Units
 	buf := bytes.NewBuffer(nil)
 	tw := tablewriter.NewWriter(buf)
-	tw.SetHeader([]string{"Date", "Count", "Distance", "Duration"})
+	header := []string{"Date", "Count", "Distance", "Duration", "Moving", "Elev", "Pace", "Longest", "Change", "A:C"}
+	if umt.Plan != nil {
+		header = append(header, "Planned", "Done", "To race")
+	}
+	byType := len(umt.Types.Types()) > 1
+	if byType {
+		header = append(header, "By type")
+	}
+	excluded := false
 	for _, w := range umt.Weeks {
-
-		tw.Append([]string{
+		excluded = excluded || w.Excluded > 0
+	}
+	if excluded {
+		header = append(header, "Excluded")
+	}
+	tw.SetHeader(header)
+	for _, w := range umt.Weeks {
+		row := []string{
 			w.Date.Format("2006/01/02"),
 			fmt.Sprintf("%d", w.Count),
-			fmt.Sprintf("%0.1fkm", w.Distance/1000),
-			fmt.Sprintf("%dh %dm", int(w.Time.Hours()), int(w.Time.Minutes())%60),
-		})
+			formatDistance(units, w.Distance),
+			formatDuration(w.Time),
+			formatDuration(w.MovingTime),
+			formatElevation(units, w.Elevation),
+			formatPace(units, w.Pace()),
+			formatLongest(units, w),
+			formatChange(w.Workload),
+			formatRatio(w.Workload),
+		}
+		if umt.Plan != nil {
+			row = append(row, formatPlan(units, w)...)
+		}
+		if byType {
+			row = append(row, formatByType(units, w.ByType))
+		}
+		if excluded {
+			row = append(row, fmt.Sprintf("%d", w.Excluded))
+		}
+		tw.Append(row)
 	}
 	tw.Render()
 	return buf.String()
 }
 
+// formatPlan formats the planned columns of a week, which are blank for weeks
+// outside the plan.
+func formatPlan(units Units, w WeekSummary) []string {
+	if w.Plan == nil {
+		return []string{"", "", ""}
+	}
+	return []string{
+		fmt.Sprintf("%s / %s", formatDistance(units, w.Plan.Distance), formatDistance(units, w.Plan.LongRun)),
+		fmt.Sprintf("%.0f%%", w.PercentComplete()),
+		fmt.Sprintf("%dw", w.Plan.WeeksToRace),
+	}
+}
+
+// formatByType lists the count and distance of each type of activity, e.g.
+// "Run 3 22.4km, Walk 1 5.0km".
+func formatByType(units Units, types []TypeSummary) string {
+	var parts []string
+	for _, t := range types {
+		parts = append(parts, fmt.Sprintf("%s %d %s", t.Type, t.Count, formatDistance(units, t.Distance)))
+	}
+	return strings.Join(parts, ", ")
+}
+
+// formatLongest formats the distance and time of the week's longest run, or
+// nothing if there weren't any runs.
+func formatLongest(units Units, w WeekSummary) string {
+	if w.LongestDistance == 0 {
+		return ""
+	}
+	return fmt.Sprintf("%s / %s", formatDistance(units, w.LongestDistance), formatDuration(w.LongestTime))
+}
+
+// formatChange formats the change in distance on the week before as a
+// percentage, marked with a ! if it breaks the 10% rule.
+func formatChange(w Workload) string {
+	if w.PreviousDistance == 0 {
+		return ""
+	}
+	return fmt.Sprintf("%+.0f%%", w.Change*100) + riskMark(w.TooFast)
+}
+
+// formatRatio formats the acute:chronic workload ratio, marked with a ! if
+// it's risky.
+func formatRatio(w Workload) string {
+	if w.Ratio == 0 {
+		return ""
+	}
+	return fmt.Sprintf("%.2f", w.Ratio) + riskMark(w.HighRisk)
+}
+
+func riskMark(risky bool) string {
+	if risky {
+		return "!"
+	}
+	return ""
+}
+
+// formatDistance formats a distance in metres as kilometres or miles.
+func formatDistance(units Units, metres float64) string {
+	return fmt.Sprintf("%0.1f%s", units.Distance(metres), units.DistanceUnit())
+}
+
+// formatElevation formats an elevation in metres as metres or feet.
+func formatElevation(units Units, metres float64) string {
+	return fmt.Sprintf("%.0f%s", units.Elevation(metres), units.ElevationUnit())
+}
+
+// formatDuration formats a duration in hours and minutes.
+func formatDuration(d time.Duration) string {
+	return fmt.Sprintf("%dh %dm", int(d.Hours()), int(d.Minutes())%60)
+}
+
+// formatPace formats a time per kilometre like a stopwatch, in the given
+// units, e.g. 5:36/km or 9:01/mi, or nothing if there's no pace.
+func formatPace(units Units, perKm time.Duration) string {
+	if perKm == 0 {
+		return ""
+	}
+	secs := int(units.Pace(perKm).Round(time.Second).Seconds())
+	return fmt.Sprintf("%d:%02d/%s", secs/60, secs%60, units.DistanceUnit())
+}
+
 const mainTplText = `
 <div>
   <div style="display: flex; justify-content: center">
   {{range .Umt}}
     <div style="padding: 0 1em">
+      {{with .Picture}}<img src="{{.}}" width="62" height="62" alt="">{{end}}
       <pre>{{.Name}}</pre>
+      {{with .Plan}}
+      <p>Training for {{with .RaceName}}{{.}}{{else}}a race{{end}} on {{.RaceDate.Format "2 Jan 2006"}}</p>
+      {{end}}
+      {{if .NeedsReconnect}}
+      <p>Strava isn't sharing {{.Name}}'s activities with us any more. <a href="/login">Reconnect your Strava account</a></p>
+      {{else if .Err}}
+      <p>Couldn't load {{.Name}}'s latest activities.</p>
+      {{end}}
+      {{if .Weeks}}
       <pre>
 {{. | makeTable}}
       </pre>
+      {{end}}
     </div>
   {{end}}
   </div>
 
-  <a href="https://www.strava.com/oauth/authorize?client_id={{.ClientId}}&redirect_uri={{.RedirectURI | urlquery}}&response_type=code">
-    Register
-  </a>
+  <p>
+    A:C is the acute:chronic workload ratio, this week's distance against the average of the last four.
+    ! marks weeks that went up more than 10% on the week before, or whose ratio is over 1.5.
+  </p>
+
+  <a href="/me">My dashboard</a>
+  <a href="/leaderboard">Leaderboard</a>
+  <a href="{{withParams .Query "types" "all"}}">Include cross-training</a>
+  <a href="{{withParams .Query "exclude" "manual,flagged"}}">Leave out manual and flagged activities</a>
+  <a href="{{withParams .Query "units" "metric"}}">Kilometres</a>
+  <a href="{{withParams .Query "units" "imperial"}}">Miles</a>
+  ` + logoutFormText + `
 </div>
 `
 
+// logoutFormText is a button that logs the user out.
+const logoutFormText = `<form method="post" action="/logout" style="display: inline">
+    <input type="hidden" name="csrf_token" value="{{.CSRFToken}}">
+    <button>Log out</button>
+  </form>`
+
+type loginTplArgs struct {
+	// Why the user couldn't log in, if they just tried.
+	Error string
+}
+
+// loginTplText is the front page for people who aren't logged in.
+const loginTplText = `
+<div>
+  <p>Marathon training for the group, from Strava.</p>
+  {{with .Error}}<p>Couldn't log you in: {{.}}</p>{{end}}
+  <a href="/login">Connect with Strava to log in</a>
+</div>
+`
+
+var loginTpl = template.Must(template.New("").Parse(loginTplText))
+
+// dashboardTplText is the logged in user's own page.
+const dashboardTplText = `
+<div>
+  {{with .Me.ProfilePictureMedium}}<img src="{{.}}" width="62" height="62" alt="">{{end}}
+  <p>Logged in as {{.Me.FirstName}} {{.Me.LastName}}</p>
+  {{range .Umt}}
+    {{with .Plan}}
+    <p>Training for {{with .RaceName}}{{.}}{{else}}a race{{end}} on {{.RaceDate.Format "2 Jan 2006"}}</p>
+    {{end}}
+    {{if .NeedsReconnect}}
+    <p>Strava isn't sharing your activities with us any more. <a href="/login">Reconnect your Strava account</a></p>
+    {{else if .Err}}
+    <p>Couldn't load your latest activities.</p>
+    {{end}}
+    {{if .Weeks}}
+    <pre>
+{{. | makeTable}}
+    </pre>
+    {{else}}
+    <p>No runs yet.</p>
+    {{end}}
+  {{end}}
+
+  <form method="post" action="/me/plan" enctype="multipart/form-data">
+    <input type="hidden" name="csrf_token" value="{{.CSRFToken}}">
+    <p>Upload a training plan, as a .csv or .yaml file, to replace your old one.</p>
+    <input type="file" name="plan" required>
+    <label>Race <input name="race"></label>
+    <label>Race date <input type="date" name="race_date"></label>
+    <button>Upload</button>
+  </form>
+
+  <p>Scripts can use the <a href="/api/v1/users">JSON API</a> with an API token, in an <code>Authorization: Bearer</code> header.</p>
+  {{if .APIToken}}
+  <p>Here's your new API token. Keep it secret; it won't be shown again.</p>
+  <pre>{{.APIToken}}</pre>
+  {{else if .Me.APITokenHash}}
+  <p>You made an API token on {{.Me.APITokenCreated.Format "2 Jan 2006"}}.</p>
+  {{end}}
+  <form method="post" action="/me/api_token">
+    <input type="hidden" name="csrf_token" value="{{.CSRFToken}}">
+    <button>{{if .Me.APITokenHash}}Replace{{else}}Make{{end}} API token</button>
+  </form>
+  {{if .Me.APITokenHash}}
+  <form method="post" action="/me/api_token/revoke">
+    <input type="hidden" name="csrf_token" value="{{.CSRFToken}}">
+    <button>Revoke API token</button>
+  </form>
+  {{end}}
+
+  <p>Disconnecting stops Strava sharing your activities with us and deletes everything we keep about you. You can join again by connecting Strava.</p>
+  <form method="post" action="/me/disconnect" onsubmit="return confirm('Delete everything we keep about you?')">
+    <input type="hidden" name="csrf_token" value="{{.CSRFToken}}">
+    <button>Disconnect and delete my data</button>
+  </form>
+
+  <a href="/">Everyone</a>
+  <a href="/leaderboard">Leaderboard</a>
+  <a href="/me{{withParams .Query "units" "metric"}}">Kilometres</a>
+  <a href="/me{{withParams .Query "units" "imperial"}}">Miles</a>
+  ` + logoutFormText + `
+</div>
+`
+
+var dashboardTpl = template.Must(template.New("").Funcs(template.FuncMap{
+	"makeTable":  makeTable,
+	"withParams": withParams,
+}).Parse(dashboardTplText))
+
 var mainTpl = template.Must(template.New("").Funcs(template.FuncMap{
-	"makeTable": makeTable,
+	"makeTable":  makeTable,
+	"withParams": withParams,
 }).Parse(mainTplText))
+
+// makeLeaderboardTable lays out a leaderboard with the group's totals and
+// averages at the bottom.
+func makeLeaderboardTable(lb *Leaderboard) string {
+	buf := bytes.NewBuffer(nil)
+	tw := tablewriter.NewWriter(buf)
+	tw.SetHeader([]string{"Rank", "Name", "Distance", "Duration", "Runs", "Streak"})
+	for _, e := range lb.Entries {
+		if e.Err != nil {
+			tw.Append([]string{"", e.Name, "couldn't load", "", "", ""})
+			continue
+		}
+		tw.Append([]string{
+			fmt.Sprintf("%d", e.Rank),
+			e.Name,
+			formatDistance(lb.Units, e.Distance),
+			formatDuration(e.Time),
+			fmt.Sprintf("%d", e.Count),
+			fmt.Sprintf("%dd", e.Streak),
+		})
+	}
+	tw.SetFooter([]string{
+		"", "Total / average",
+		fmt.Sprintf("%s / %s", formatDistance(lb.Units, lb.Total.Distance), formatDistance(lb.Units, lb.AverageDistance())),
+		fmt.Sprintf("%s / %s", formatDuration(lb.Total.Time), formatDuration(lb.AverageTime())),
+		fmt.Sprintf("%d / %.1f", lb.Total.Count, lb.AverageCount()),
+		"",
+	})
+	tw.Render()
+	return buf.String()
+}
+
+const leaderboardTplText = `
+<div>
+  <p>
+    {{if eq .Period.Kind "month"}}{{.Period.Start.Format "January 2006"}}{{else}}Week of {{.Period.Start.Format "2 Jan 2006"}}{{end}},
+    ranked by {{.Metric}}, counting {{.Types}}
+  </p>
+  <p>
+    Rank by
+    <a href="{{withParams .Query "metric" "distance"}}">distance</a>
+    <a href="{{withParams .Query "metric" "time"}}">time</a>
+    <a href="{{withParams .Query "metric" "count"}}">activities</a>
+    <a href="{{withParams .Query "metric" "streak"}}">streak</a>
+    &middot;
+    <a href="{{withParams .Query "period" "week" "date" ""}}">This week</a>
+    <a href="{{withParams .Query "period" "month" "date" ""}}">This month</a>
+    &middot;
+    <a href="{{withParams .Query "types" ""}}">Runs only</a>
+    <a href="{{withParams .Query "types" "all"}}">All endurance</a>
+    &middot;
+    <a href="{{withParams .Query "units" "metric"}}">Kilometres</a>
+    <a href="{{withParams .Query "units" "imperial"}}">Miles</a>
+  </p>
+  <pre>
+{{.Leaderboard | makeLeaderboardTable}}
+  </pre>
+  <a href="/">Back</a>
+</div>
+`
+
+type leaderboardTplArgs struct {
+	*Leaderboard
+
+	// The page's query, for the links that change one thing about it.
+	Query url.Values
+}
+
+var leaderboardTpl = template.Must(template.New("").Funcs(template.FuncMap{
+	"makeLeaderboardTable": makeLeaderboardTable,
+	"withParams":           withParams,
+}).Parse(leaderboardTplText))
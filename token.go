@@ -0,0 +1,101 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	strava "github.com/strava/go.strava"
+	"golang.org/x/oauth2"
+)
+
+// stravaEndpoint is where Strava's OAuth flow is served. Tests point it at a
+// local server.
+var stravaEndpoint = oauth2.Endpoint{
+	AuthURL:   "https://www.strava.com/oauth/authorize",
+	TokenURL:  "https://www.strava.com/oauth/token",
+	AuthStyle: oauth2.AuthStyleInParams,
+}
+
+// refreshMargin is how long before an access token expires that it gets refreshed.
+const refreshMargin = 5 * time.Minute
+
+// oauthConfig is the OAuth client configuration for talking to Strava.
+func oauthConfig() *oauth2.Config {
+	return &oauth2.Config{
+		ClientID:     strconv.Itoa(strava.ClientId),
+		ClientSecret: strava.ClientSecret,
+		Endpoint:     stravaEndpoint,
+	}
+}
+
+// Authorization is the result of a user authorising us to access their Strava data.
+type Authorization struct {
+	Token   *oauth2.Token
+	Athlete strava.AthleteDetailed
+}
+
+// ExchangeCode swaps the code from Strava's OAuth callback for the user's
+// tokens and athlete details. The HTTP client is taken from ctx as described
+// by oauth2.HTTPClient.
+func ExchangeCode(ctx context.Context, code string) (*Authorization, error) {
+	if code == "" {
+		return nil, strava.OAuthInvalidCodeErr
+	}
+	tok, err := oauthConfig().Exchange(ctx, code)
+	if err != nil {
+		return nil, err
+	}
+	athlete := tok.Extra("athlete")
+	if athlete == nil {
+		return nil, errors.New("token response has no athlete")
+	}
+	// The athlete is only available as generic JSON, so round trip it into
+	// the strava type.
+	b, err := json.Marshal(athlete)
+	if err != nil {
+		return nil, err
+	}
+	auth := &Authorization{Token: tok}
+	if err := json.Unmarshal(b, &auth.Athlete); err != nil {
+		return nil, err
+	}
+	return auth, nil
+}
+
+// newTokenSource returns a token source that starts with tok and refreshes it
+// shortly before it expires, calling save with each new token so that it
+// can be persisted.
+func newTokenSource(ctx context.Context, tok *oauth2.Token, save func(*oauth2.Token) error) oauth2.TokenSource {
+	return oauth2.ReuseTokenSourceWithExpiry(tok, &refreshingTokenSource{
+		ctx:          ctx,
+		refreshToken: tok.RefreshToken,
+		save:         save,
+	}, refreshMargin)
+}
+
+// refreshingTokenSource gets a new token from Strava every time it is asked.
+type refreshingTokenSource struct {
+	ctx          context.Context
+	refreshToken string
+	save         func(*oauth2.Token) error
+}
+
+func (s *refreshingTokenSource) Token() (*oauth2.Token, error) {
+	if s.refreshToken == "" {
+		return nil, fmt.Errorf("access token has expired and there is no refresh token: %w", ErrUnauthorized)
+	}
+	// A token with no access token is always refreshed straight away.
+	tok, err := oauthConfig().TokenSource(s.ctx, &oauth2.Token{RefreshToken: s.refreshToken}).Token()
+	if err != nil {
+		return nil, err
+	}
+	if err := s.save(tok); err != nil {
+		return nil, err
+	}
+	s.refreshToken = tok.RefreshToken
+	return tok, nil
+}
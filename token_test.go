@@ -0,0 +1,181 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	strava "github.com/strava/go.strava"
+	"golang.org/x/oauth2"
+)
+
+// fakeTokenServer is a stand-in for Strava's OAuth token endpoint.
+type fakeTokenServer struct {
+	*httptest.Server
+	refreshes int
+}
+
+// newFakeTokenServer starts a fake token endpoint and points stravaEndpoint at it.
+// The returned function restores the real endpoint and stops the server.
+func newFakeTokenServer(t *testing.T) (*fakeTokenServer, func()) {
+	f := &fakeTokenServer{}
+	f.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.FormValue("client_secret") != "secret" {
+			http.Error(w, `{"message": "Bad Request"}`, http.StatusBadRequest)
+			return
+		}
+		var resp map[string]interface{}
+		switch r.FormValue("grant_type") {
+		case "authorization_code":
+			if r.FormValue("code") != "good-code" {
+				http.Error(w, `{"message": "Bad Request"}`, http.StatusBadRequest)
+				return
+			}
+			resp = map[string]interface{}{
+				"token_type":    "Bearer",
+				"access_token":  "access-0",
+				"refresh_token": "refresh-0",
+				"expires_in":    21600,
+				"athlete": map[string]interface{}{
+					"id":        1234,
+					"firstname": "james",
+					"lastname":  "k",
+				},
+			}
+		case "refresh_token":
+			if r.FormValue("refresh_token") != "refresh-0" {
+				http.Error(w, `{"message": "Bad Request"}`, http.StatusBadRequest)
+				return
+			}
+			f.refreshes++
+			resp = map[string]interface{}{
+				"token_type":    "Bearer",
+				"access_token":  "access-1",
+				"refresh_token": "refresh-1",
+				"expires_in":    21600,
+			}
+		default:
+			http.Error(w, `{"message": "Bad Request"}`, http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(resp) // nolint: errcheck
+	}))
+
+	oldEndpoint, oldID, oldSecret := stravaEndpoint, strava.ClientId, strava.ClientSecret
+	stravaEndpoint.TokenURL = f.URL
+	strava.ClientId, strava.ClientSecret = 1, "secret"
+	return f, func() {
+		stravaEndpoint, strava.ClientId, strava.ClientSecret = oldEndpoint, oldID, oldSecret
+		f.Close()
+	}
+}
+
+func TestExchangeCode(t *testing.T) {
+	_, done := newFakeTokenServer(t)
+	defer done()
+
+	auth, err := ExchangeCode(context.Background(), "good-code")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if auth.Athlete.Id != 1234 || auth.Athlete.FirstName != "james" || auth.Athlete.LastName != "k" {
+		t.Errorf("Unexpected athlete %+v", auth.Athlete)
+	}
+	if auth.Token.AccessToken != "access-0" || auth.Token.RefreshToken != "refresh-0" {
+		t.Errorf("Unexpected token %+v", auth.Token)
+	}
+	if d := time.Until(auth.Token.Expiry); d < 5*time.Hour || d > 6*time.Hour {
+		t.Errorf("Expected token to expire in 6 hours, got %s", d)
+	}
+
+	if _, err := ExchangeCode(context.Background(), "bad-code"); err == nil {
+		t.Error("Expected a bad code to fail")
+	}
+	if _, err := ExchangeCode(context.Background(), ""); err == nil {
+		t.Error("Expected a missing code to fail")
+	}
+}
+
+func TestTokenSource(t *testing.T) {
+	f, done := newFakeTokenServer(t)
+	defer done()
+
+	for _, tc := range []struct {
+		message  string
+		expiry   time.Time
+		expected string
+		refresh  bool
+	}{
+		{"tokens that don't expire are used as is", time.Time{}, "access-0", false},
+		{"tokens with plenty of time left are used as is", time.Now().Add(time.Hour), "access-0", false},
+		{"tokens about to expire are refreshed", time.Now().Add(time.Minute), "access-1", true},
+		{"expired tokens are refreshed", time.Now().Add(-time.Minute), "access-1", true},
+	} {
+		f.refreshes = 0
+		var saved []*oauth2.Token
+		ts := newTokenSource(context.Background(), &oauth2.Token{
+			AccessToken:  "access-0",
+			RefreshToken: "refresh-0",
+			Expiry:       tc.expiry,
+		}, func(tok *oauth2.Token) error {
+			saved = append(saved, tok)
+			return nil
+		})
+		// Asking twice must only refresh once.
+		for i := 0; i < 2; i++ {
+			tok, err := ts.Token()
+			if err != nil {
+				t.Fatalf("Case '%s': %s", tc.message, err)
+			}
+			if tok.AccessToken != tc.expected {
+				t.Errorf("Case '%s': expected %s, got %s", tc.message, tc.expected, tok.AccessToken)
+			}
+		}
+		if !tc.refresh {
+			if f.refreshes != 0 || len(saved) != 0 {
+				t.Errorf("Case '%s': expected no refresh, got %d refreshes and %d saves", tc.message, f.refreshes, len(saved))
+			}
+			continue
+		}
+		if f.refreshes != 1 || len(saved) != 1 {
+			t.Fatalf("Case '%s': expected one refresh, got %d refreshes and %d saves", tc.message, f.refreshes, len(saved))
+		}
+		if saved[0].AccessToken != "access-1" || saved[0].RefreshToken != "refresh-1" {
+			t.Errorf("Case '%s': saved unexpected token %+v", tc.message, saved[0])
+		}
+	}
+}
+
+func TestTokenSourceSaveFails(t *testing.T) {
+	_, done := newFakeTokenServer(t)
+	defer done()
+
+	ts := newTokenSource(context.Background(), &oauth2.Token{
+		AccessToken:  "access-0",
+		RefreshToken: "refresh-0",
+		Expiry:       time.Now().Add(-time.Minute),
+	}, func(tok *oauth2.Token) error {
+		return errors.New("datastore is down")
+	})
+	if _, err := ts.Token(); err == nil {
+		t.Error("Expected an error when the refreshed token can't be saved")
+	}
+}
+
+func TestTokenSourceNoRefreshToken(t *testing.T) {
+	ts := newTokenSource(context.Background(), &oauth2.Token{
+		AccessToken: "access-0",
+		Expiry:      time.Now().Add(-time.Minute),
+	}, func(tok *oauth2.Token) error {
+		t.Error("Didn't expect a token to be saved")
+		return nil
+	})
+	if _, err := ts.Token(); err == nil {
+		t.Error("Expected an expired token with no refresh token to fail")
+	}
+}
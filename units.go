@@ -0,0 +1,87 @@
+package handlers
+
+import (
+	"fmt"
+	"time"
+)
+
+// Units is the system of units that distances, paces and elevations are
+// shown in. Everything is kept in metres and converted when it's shown; the
+// zero value shows it in metric.
+type Units string
+
+const (
+	Metric   Units = "metric"
+	Imperial Units = "imperial"
+)
+
+const (
+	metresPerMile = 1609.344
+	metresPerFoot = 0.3048
+)
+
+// ParseUnits parses "metric" or "imperial".
+func ParseUnits(s string) (Units, error) {
+	switch u := Units(s); u {
+	case Metric, Imperial:
+		return u, nil
+	}
+	return "", fmt.Errorf("units must be metric or imperial, not %q", s)
+}
+
+// PreferredUnits gets the units for a Strava measurement preference, which is
+// "meters" or "feet". Users who haven't said get metric.
+func PreferredUnits(measurementPreference string) Units {
+	if measurementPreference == "feet" {
+		return Imperial
+	}
+	return Metric
+}
+
+// DistanceUnit is the abbreviation for the units' distances, "km" or "mi".
+func (u Units) DistanceUnit() string {
+	if u == Imperial {
+		return "mi"
+	}
+	return "km"
+}
+
+// ElevationUnit is the abbreviation for the units' elevations, "m" or "ft".
+func (u Units) ElevationUnit() string {
+	if u == Imperial {
+		return "ft"
+	}
+	return "m"
+}
+
+// Distance converts a distance in metres to kilometres or miles.
+func (u Units) Distance(metres float64) float64 {
+	if u == Imperial {
+		return metres / metresPerMile
+	}
+	return metres / 1000
+}
+
+// Elevation converts an elevation in metres to metres or feet.
+func (u Units) Elevation(metres float64) float64 {
+	if u == Imperial {
+		return metres / metresPerFoot
+	}
+	return metres
+}
+
+// Pace converts a time per kilometre to a time per kilometre or mile.
+func (u Units) Pace(perKm time.Duration) time.Duration {
+	if u == Imperial {
+		return time.Duration(float64(perKm) * metresPerMile / 1000)
+	}
+	return perKm
+}
+
+// orMetric makes the zero value's metric explicit.
+func (u Units) orMetric() Units {
+	if u == "" {
+		return Metric
+	}
+	return u
+}
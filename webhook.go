@@ -0,0 +1,240 @@
+package handlers
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	strava "github.com/strava/go.strava"
+	"golang.org/x/oauth2"
+)
+
+// Strava pushes changes to users' activities to the webhook as they happen,
+// rather than waiting for the next sync to notice them. See
+// https://developers.strava.com/docs/webhooks/ for how to subscribe.
+
+// WebhookEvent is a change that Strava pushes to the webhook.
+type WebhookEvent struct {
+	// "activity" or "athlete".
+	ObjectType string `json:"object_type"`
+
+	// The activity's id, or the athlete's for athlete events.
+	ObjectID int64 `json:"object_id"`
+
+	// "create", "update" or "delete".
+	AspectType string `json:"aspect_type"`
+
+	// The athlete id of the user the object belongs to.
+	OwnerID int64 `json:"owner_id"`
+
+	SubscriptionID int64 `json:"subscription_id"`
+
+	// When the change happened, in seconds since the epoch.
+	EventTime int64 `json:"event_time"`
+
+	// The fields that changed, for updates. Athletes who deauthorise us
+	// are sent as an update with authorized set to "false".
+	Updates map[string]interface{} `json:"updates"`
+}
+
+// Deauthorized says whether the event is the athlete revoking our access.
+func (ev *WebhookEvent) Deauthorized() bool {
+	return ev.ObjectType == "athlete" && fmt.Sprint(ev.Updates["authorized"]) == "false"
+}
+
+// key identifies what the event is about, for collapsing events about the
+// same thing. Handling an event fetches the latest from Strava, so one of
+// them is as good as many.
+func (ev *WebhookEvent) key() string {
+	return fmt.Sprintf("%s-%d-%d", ev.ObjectType, ev.OwnerID, ev.ObjectID)
+}
+
+// EventQueue holds webhook events until they can be handled. Strava only
+// waits two seconds for the webhook to answer, which isn't long enough to
+// call it back. Events about something that already has an event waiting
+// can be dropped.
+type EventQueue interface {
+	Add(ctx context.Context, ev *WebhookEvent) error
+}
+
+// errQueueFull is returned when there are too many events waiting to be handled.
+var errQueueFull = errors.New("too many webhook events waiting")
+
+// localQueue handles events one at a time in the background of the process
+// that receives them.
+type localQueue struct {
+	events chan *WebhookEvent
+
+	mu sync.Mutex
+	// The keys of the events waiting in events.
+	waiting map[string]bool
+}
+
+// localQueueSize is how many events a localQueue holds before turning more away.
+const localQueueSize = 100
+
+// newLocalQueue starts a localQueue that passes each event to handle.
+func newLocalQueue(handle func(ctx context.Context, ev *WebhookEvent) error) *localQueue {
+	q := &localQueue{events: make(chan *WebhookEvent, localQueueSize), waiting: map[string]bool{}}
+	go func() {
+		ctx := context.Background()
+		for ev := range q.events {
+			q.mu.Lock()
+			delete(q.waiting, ev.key())
+			q.mu.Unlock()
+			if err := handle(ctx, ev); err != nil {
+				logErrorf(ctx, "Failed to handle %s %s event for %d: %s", ev.ObjectType, ev.AspectType, ev.ObjectID, err)
+			}
+		}
+	}()
+	return q
+}
+
+func (q *localQueue) Add(ctx context.Context, ev *WebhookEvent) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.waiting[ev.key()] {
+		return nil
+	}
+	select {
+	case q.events <- ev:
+		q.waiting[ev.key()] = true
+		return nil
+	default:
+		return errQueueFull
+	}
+}
+
+// HandleEvent does what a webhook event asks for. Strava doesn't sign its
+// events, so nothing is taken on trust: changed activities are refetched,
+// and deleted ones only deleted if Strava no longer has them, and athletes
+// are only disconnected once Strava rejects their token.
+func HandleEvent(ctx context.Context, store Store, fetcher ActivityFetcher, ev *WebhookEvent) error {
+	u, err := store.GetUser(ctx, ev.OwnerID)
+	if err == ErrNoSuchUser {
+		// Someone who authorised us but never finished registering.
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if !u.Connected() {
+		return nil
+	}
+	ts := UserTokenSource(ctx, store, u)
+	switch {
+	case ev.ObjectType == "activity":
+		err = refetchActivity(ctx, store, fetcher, ts, u.ID, ev.ObjectID)
+	case ev.Deauthorized():
+		err = checkAuthorized(ctx, store, fetcher, ts, u)
+	}
+	if IsAuthError(err) {
+		return recordSyncError(ctx, store, u.ID, err)
+	}
+	return err
+}
+
+// refetchActivity brings the stored copy of one of the user's activities up
+// to date, deleting it if Strava no longer has it.
+func refetchActivity(ctx context.Context, store ActivityStore, fetcher ActivityFetcher, ts oauth2.TokenSource, user, id int64) error {
+	act, err := fetcher.FetchActivity(ctx, ts, id)
+	if errors.Is(err, ErrNotFound) {
+		return store.DeleteActivities(ctx, user, []int64{id})
+	}
+	if err != nil {
+		return err
+	}
+	return putSyncedActivities(ctx, store, user, []*strava.ActivitySummary{act})
+}
+
+// checkAuthorized disconnects the user if Strava no longer accepts their
+// token, keeping their activities until they reconnect.
+func checkAuthorized(ctx context.Context, store Store, fetcher ActivityFetcher, ts oauth2.TokenSource, u *User) error {
+	// Listing activities from now on is cheap, and only works if we're
+	// still authorised.
+	_, err := fetcher.FetchActivities(ctx, ts, time.Now(), time.Time{})
+	if !IsAuthError(err) {
+		return err
+	}
+	cleared, err := clearRejectedToken(ctx, store, u)
+	if err != nil || !cleared {
+		return err
+	}
+	return fmt.Errorf("deauthorised on Strava: %w", ErrUnauthorized)
+}
+
+// registerWebhookHandlers sets up receiving pushes from Strava:
+//
+//	GET /webhook
+//	    Answers the challenge Strava sends when subscribing, if the
+//	    hub.verify_token matches Env.VerifyToken.
+//	POST /webhook
+//	    Receives a WebhookEvent and queues it to be handled, if it's for
+//	    Env.SubscriptionID and there's anything to do about it.
+//	POST /tasks/webhook
+//	    Handles a WebhookEvent in the event form value, for queues that
+//	    post their events back to the app.
+func registerWebhookHandlers(mux *http.ServeMux, env *Env) {
+	queue := env.Events
+	if queue == nil {
+		queue = newLocalQueue(func(ctx context.Context, ev *WebhookEvent) error {
+			return HandleEvent(env.oauthContext(ctx), env.Store, newStravaFetcher(env.client(ctx)), ev)
+		})
+	}
+
+	mux.HandleFunc("/webhook", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			token := r.FormValue("hub.verify_token")
+			if r.FormValue("hub.mode") != "subscribe" || env.VerifyToken == "" || subtle.ConstantTimeCompare([]byte(token), []byte(env.VerifyToken)) != 1 {
+				http.Error(w, "forbidden", http.StatusForbidden)
+				return
+			}
+			writeJSON(w, http.StatusOK, map[string]string{"hub.challenge": r.FormValue("hub.challenge")})
+		case http.MethodPost:
+			ctx := env.context(r)
+			var ev WebhookEvent
+			if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<16)).Decode(&ev); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			// Athlete ids are public, so anyone could use up our Strava
+			// quota by posting events about them.
+			if env.SubscriptionID == 0 || ev.SubscriptionID != env.SubscriptionID {
+				http.Error(w, "forbidden", http.StatusForbidden)
+				return
+			}
+			if ev.ObjectType != "activity" && !ev.Deauthorized() {
+				w.Write([]byte("ok")) // nolint: errcheck
+				return
+			}
+			if err := queue.Add(ctx, &ev); err != nil {
+				handleError(w, err)
+				return
+			}
+			w.Write([]byte("ok")) // nolint: errcheck
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+
+	mux.Handle("/tasks/webhook", env.admin(func(w http.ResponseWriter, r *http.Request) {
+		ctx := env.context(r)
+		var ev WebhookEvent
+		if err := json.Unmarshal([]byte(r.FormValue("event")), &ev); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		// Failing makes the queue try again later.
+		if err := HandleEvent(env.oauthContext(ctx), env.Store, newStravaFetcher(env.client(ctx)), &ev); err != nil {
+			handleError(w, err)
+			return
+		}
+		w.Write([]byte("ok")) // nolint: errcheck
+	}))
+}
@@ -0,0 +1,309 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	strava "github.com/strava/go.strava"
+	"golang.org/x/oauth2"
+)
+
+// Events as Strava sends them, from https://developers.strava.com/docs/webhooks/.
+const (
+	createEvent = `{
+		"aspect_type": "create",
+		"event_time": 1549560669,
+		"object_id": 1360128428,
+		"object_type": "activity",
+		"owner_id": 134815,
+		"subscription_id": 120475,
+		"updates": {}
+	}`
+	updateEvent = `{
+		"aspect_type": "update",
+		"event_time": 1516126040,
+		"object_id": 1360128428,
+		"object_type": "activity",
+		"owner_id": 134815,
+		"subscription_id": 120475,
+		"updates": {"title": "Messy"}
+	}`
+	deleteEvent = `{
+		"aspect_type": "delete",
+		"event_time": 1516126040,
+		"object_id": 1360128429,
+		"object_type": "activity",
+		"owner_id": 134815,
+		"subscription_id": 120475,
+		"updates": {}
+	}`
+	deauthEvent = `{
+		"aspect_type": "update",
+		"event_time": 1516126040,
+		"object_id": 134815,
+		"object_type": "athlete",
+		"owner_id": 134815,
+		"subscription_id": 120475,
+		"updates": {"authorized": "false"}
+	}`
+)
+
+// recordingQueue keeps the events it's given.
+type recordingQueue []*WebhookEvent
+
+func (q *recordingQueue) Add(ctx context.Context, ev *WebhookEvent) error {
+	*q = append(*q, ev)
+	return nil
+}
+
+// revokedFetcher is Strava once a user has deauthorised us.
+type revokedFetcher struct{}
+
+func (revokedFetcher) FetchActivities(ctx context.Context, ts oauth2.TokenSource, after, before time.Time) ([]*strava.ActivitySummary, error) {
+	return nil, fmt.Errorf("listing activities: %w", ErrUnauthorized)
+}
+
+func (revokedFetcher) FetchActivity(ctx context.Context, ts oauth2.TokenSource, id int64) (*strava.ActivitySummary, error) {
+	return nil, fmt.Errorf("getting activity: %w", ErrUnauthorized)
+}
+
+func TestWebhookHandshake(t *testing.T) {
+	srv := httptest.NewServer(NewHandler(&Env{Store: NewMemoryStore(), VerifyToken: "STRAVA", Events: &recordingQueue{}}))
+	defer srv.Close()
+	for _, tc := range []struct {
+		query    string
+		expected int
+	}{
+		{"hub.verify_token=STRAVA&hub.challenge=15f7d1a91c1f40f8a748fd134752feb3&hub.mode=subscribe", http.StatusOK},
+		{"hub.verify_token=WRONG&hub.challenge=15f7d1a91c1f40f8a748fd134752feb3&hub.mode=subscribe", http.StatusForbidden},
+		{"hub.challenge=15f7d1a91c1f40f8a748fd134752feb3&hub.mode=subscribe", http.StatusForbidden},
+	} {
+		resp, err := http.Get(srv.URL + "/webhook?" + tc.query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != tc.expected {
+			t.Errorf("%s: expected %d, got %s", tc.query, tc.expected, resp.Status)
+		}
+		if tc.expected == http.StatusOK && strings.TrimSpace(string(b)) != `{"hub.challenge":"15f7d1a91c1f40f8a748fd134752feb3"}` {
+			t.Errorf("Expected the challenge to be echoed, got %s", b)
+		}
+	}
+}
+
+func TestWebhookNeedsSubscription(t *testing.T) {
+	queue := &recordingQueue{}
+	srv := httptest.NewServer(NewHandler(&Env{Store: NewMemoryStore(), Events: queue}))
+	defer srv.Close()
+	resp, err := http.Post(srv.URL+"/webhook", "application/json", strings.NewReader(createEvent))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden || len(*queue) != 0 {
+		t.Errorf("Expected events to be turned away without a subscription, got %s and %v", resp.Status, *queue)
+	}
+}
+
+// hostTransport only sends requests to one host, and fails the rest.
+type hostTransport struct {
+	host string
+	sent *int
+}
+
+func (t hostTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	if r.URL.Host != t.host {
+		return nil, fmt.Errorf("unexpected request to %s", r.URL)
+	}
+	*t.sent++
+	return http.DefaultTransport.RoundTrip(r)
+}
+
+func TestWebhookTaskRefreshesWithClient(t *testing.T) {
+	ctx := context.Background()
+	f, done := newFakeTokenServer(t)
+	defer done()
+	store := NewMemoryStore()
+	if err := store.PutUser(ctx, &User{ID: 134815, StravaToken: "access-0", RefreshToken: "refresh-0", TokenExpiry: saturday}); err != nil {
+		t.Fatal(err)
+	}
+	sent := 0
+	client := &http.Client{Transport: hostTransport{strings.TrimPrefix(f.URL, "http://"), &sent}}
+	srv := httptest.NewServer(NewHandler(&Env{
+		Store:      store,
+		HTTPClient: func(context.Context) *http.Client { return client },
+	}))
+	defer srv.Close()
+
+	// Fetching the activity fails, but only once the token has been
+	// refreshed with the Env's client.
+	resp, err := http.PostForm(srv.URL+"/tasks/webhook", url.Values{"event": {createEvent}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if f.refreshes != 1 || sent != 1 {
+		t.Errorf("Expected the token to be refreshed through the Env's client, got %d refreshes and %d requests", f.refreshes, sent)
+	}
+	if u, err := store.GetUser(ctx, 134815); err != nil || u.RefreshToken != "refresh-1" {
+		t.Errorf("Expected the new token to be saved, got %+v, %v", u, err)
+	}
+}
+
+func TestLocalQueueCollapses(t *testing.T) {
+	started, release := make(chan bool), make(chan bool)
+	handled := make(chan string, 10)
+	q := newLocalQueue(func(ctx context.Context, ev *WebhookEvent) error {
+		if ev.ObjectID == 0 {
+			started <- true
+			<-release
+		}
+		handled <- ev.key()
+		return nil
+	})
+	// Hold the queue up so that the rest wait.
+	if err := q.Add(context.Background(), &WebhookEvent{ObjectType: "activity"}); err != nil {
+		t.Fatal(err)
+	}
+	<-started
+	for _, id := range []int64{1, 2, 1, 1} {
+		if err := q.Add(context.Background(), &WebhookEvent{ObjectType: "activity", OwnerID: 7, ObjectID: id}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	release <- true
+	var keys []string
+	for i := 0; i < 3; i++ {
+		keys = append(keys, <-handled)
+	}
+	if expected := []string{"activity-0-0", "activity-7-1", "activity-7-2"}; !reflect.DeepEqual(keys, expected) {
+		t.Errorf("Expected %v to be handled, got %v", expected, keys)
+	}
+	// Events that arrive once the last one is being handled aren't dropped.
+	if err := q.Add(context.Background(), &WebhookEvent{ObjectType: "activity", OwnerID: 7, ObjectID: 1}); err != nil {
+		t.Fatal(err)
+	}
+	if key := <-handled; key != "activity-7-1" {
+		t.Errorf("Expected the event to be handled again, got %s", key)
+	}
+}
+
+func TestWebhookEvents(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemoryStore()
+	queue := &recordingQueue{}
+	srv := httptest.NewServer(NewHandler(&Env{Store: store, Events: queue, SubscriptionID: 120475}))
+	defer srv.Close()
+	post := func(body string) int {
+		resp, err := http.Post(srv.URL+"/webhook", "application/json", strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	for _, body := range []string{createEvent, updateEvent, deleteEvent, deauthEvent} {
+		if status := post(body); status != http.StatusOK {
+			t.Errorf("Expected the event to be accepted, got %d", status)
+		}
+	}
+	// Events for other subscriptions are turned away, and athlete updates
+	// other than deauthorisations are ignored.
+	if status := post(strings.Replace(createEvent, "120475", "666", 1)); status != http.StatusForbidden {
+		t.Errorf("Expected an event for another subscription to be forbidden, got %d", status)
+	}
+	if status := post(strings.Replace(deauthEvent, `"authorized": "false"`, `"title": "Dr"`, 1)); status != http.StatusOK {
+		t.Errorf("Expected an athlete update to be accepted, got %d", status)
+	}
+	if len(*queue) != 4 {
+		t.Fatalf("Expected four events to be queued, got %v", *queue)
+	}
+	create, update, del, deauth := (*queue)[0], (*queue)[1], (*queue)[2], (*queue)[3]
+	if expected := (&WebhookEvent{ObjectType: "activity", ObjectID: 1360128428, AspectType: "create", OwnerID: 134815, SubscriptionID: 120475, EventTime: 1549560669, Updates: map[string]interface{}{}}); !reflect.DeepEqual(create, expected) {
+		t.Errorf("Expected %+v, got %+v", expected, create)
+	}
+	if create.Deauthorized() || !deauth.Deauthorized() {
+		t.Errorf("Expected only the athlete event to be a deauthorisation")
+	}
+
+	// Events for people who haven't registered are ignored.
+	if err := HandleEvent(ctx, store, stubFetcher{}, create); err != nil {
+		t.Errorf("Expected an unknown athlete to be ignored, got %v", err)
+	}
+
+	if _, err := RegisterNewUser(ctx, store, makeAuth("a", "james", "k", 134815), time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	act := run(saturday.Add(morning), time.Hour, long)
+	act.Id = 1360128428
+	act.Athlete = strava.AthleteSummary{}
+	deleted := run(monday.Add(morning), time.Hour, short)
+	deleted.Id = 1360128429
+	deleted.Athlete = strava.AthleteSummary{}
+	f := stubFetcher{"a": {act}}
+	if err := store.PutActivities(ctx, 134815, []*strava.ActivitySummary{deleted}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := HandleEvent(ctx, store, f, create); err != nil {
+		t.Fatal(err)
+	}
+	renamed := *act
+	renamed.Name = "Messy"
+	f["a"] = []*strava.ActivitySummary{&renamed}
+	if err := HandleEvent(ctx, store, f, update); err != nil {
+		t.Fatal(err)
+	}
+	if acts, _ := store.GetActivities(ctx, 134815); !reflect.DeepEqual(acts, []*strava.ActivitySummary{&renamed, deleted}) {
+		t.Errorf("Expected the new activity to be stored with its new name, got %v", acts)
+	}
+	// Only the activity the event is about is refetched.
+	if err := HandleEvent(ctx, store, f, del); err != nil {
+		t.Fatal(err)
+	}
+	if acts, _ := store.GetActivities(ctx, 134815); !reflect.DeepEqual(acts, []*strava.ActivitySummary{&renamed}) {
+		t.Errorf("Expected the deleted activity to be gone, got %v", acts)
+	}
+	// Deleting something Strava still has doesn't work.
+	forged := *del
+	forged.ObjectID = act.Id
+	if err := HandleEvent(ctx, store, f, &forged); err != nil {
+		t.Fatal(err)
+	}
+	if ids, _ := store.GetActivityIDs(ctx, 134815, time.Time{}); len(ids) != 1 {
+		t.Errorf("Expected the activity to be kept, got %v", ids)
+	}
+
+	// Nor does deauthorising someone who hasn't.
+	if err := HandleEvent(ctx, store, f, deauth); err != nil {
+		t.Fatal(err)
+	}
+	if u, _ := store.GetUser(ctx, 134815); !u.Connected() {
+		t.Errorf("Expected the user to still be connected, got %+v", u)
+	}
+	if err := HandleEvent(ctx, store, revokedFetcher{}, deauth); err != nil {
+		t.Fatal(err)
+	}
+	if u, _ := store.GetUser(ctx, 134815); u.Connected() {
+		t.Errorf("Expected the user to be disconnected, got %+v", u)
+	}
+	if state, _ := store.GetSyncState(ctx, 134815); !IsAuthError(state.Err()) {
+		t.Errorf("Expected the user to be asked to reconnect, got %+v", state)
+	}
+	if acts, _ := store.GetActivities(ctx, 134815); len(acts) != 1 {
+		t.Errorf("Expected the user's activities to be kept, got %v", acts)
+	}
+}
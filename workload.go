@@ -0,0 +1,83 @@
+package handlers
+
+import "time"
+
+const (
+	// The most a week's distance should go up by on the week before.
+	tenPercentRule = 0.10
+
+	// Acute:chronic workload ratios above this are linked to a higher risk of injury.
+	highRiskRatio = 1.5
+
+	// How many weeks the chronic workload is averaged over, including the week itself.
+	chronicWeeks = 4
+)
+
+// Workload describes how a week's running compares with the weeks before it.
+type Workload struct {
+	// The distance run the week before, in metres.
+	PreviousDistance float64
+
+	// The change in distance since the week before, as a fraction of that
+	// week's distance. Zero if nothing was run the week before.
+	Change float64
+
+	// The acute:chronic workload ratio: the week's distance divided by the
+	// average weekly distance over the 28 days ending with the week. Zero if
+	// there isn't 28 days of history yet, or no running in it.
+	Ratio float64
+
+	// Whether distance went up by more than 10% on the week before.
+	TooFast bool
+
+	// Whether the acute:chronic workload ratio is high enough to risk injury.
+	HighRisk bool
+}
+
+// AnalyzeWorkload fills in the workload of each of weeks, going by the
+// weekly summaries in history, which should only count runs. Weeks missing
+// from history had no running.
+// history should cover at least the four weeks before the earliest of weeks
+// for all of them to have a ratio.
+func AnalyzeWorkload(weeks, history []WeekSummary) {
+	if len(history) == 0 {
+		return
+	}
+	distance := make(map[time.Time]float64, len(history))
+	for _, w := range history {
+		distance[w.Date] = w.Distance
+	}
+	first := history[0].Date
+	for i := range weeks {
+		weeks[i].Workload = workload(weeks[i].Date, first, distance)
+	}
+}
+
+// workload works out the workload for the week starting on date, where
+// distance has the distance of every week of history from first on.
+func workload(date, first time.Time, distance map[time.Time]float64) Workload {
+	var w Workload
+	acute := distance[date]
+	w.PreviousDistance = distance[weeksBefore(date, 1)]
+	if w.PreviousDistance > 0 {
+		w.Change = acute/w.PreviousDistance - 1
+		w.TooFast = acute > w.PreviousDistance*(1+tenPercentRule)
+	}
+	if weeksBefore(date, chronicWeeks-1).Before(first) {
+		return w
+	}
+	var total float64
+	for i := 0; i < chronicWeeks; i++ {
+		total += distance[weeksBefore(date, i)]
+	}
+	if total > 0 {
+		w.Ratio = acute / (total / chronicWeeks)
+		w.HighRisk = w.Ratio > highRiskRatio
+	}
+	return w
+}
+
+// weeksBefore is the date n weeks before date.
+func weeksBefore(date time.Time, n int) time.Time {
+	return date.AddDate(0, 0, -7*n)
+}
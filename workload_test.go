@@ -0,0 +1,75 @@
+package handlers
+
+import (
+	"math"
+	"testing"
+)
+
+// weekly makes summaries of consecutive weeks starting at week1 with the given
+// distances in kilometres. Weeks with no distance are left out.
+func weekly(km ...float64) []WeekSummary {
+	var result []WeekSummary
+	for i, d := range km {
+		if d > 0 {
+			result = append(result, WeekSummary{Date: weeksBefore(week1, -i), Distance: d * 1000})
+		}
+	}
+	return result
+}
+
+func TestAnalyzeWorkload(t *testing.T) {
+	// The gap in the fourth week still counts towards the chronic workload.
+	weeks := weekly(10, 11, 20, 0, 20)
+	AnalyzeWorkload(weeks, weeks)
+	for i, expected := range []Workload{
+		{},
+		{PreviousDistance: 10000, Change: 0.1},
+		{PreviousDistance: 11000, Change: 20.0/11 - 1, TooFast: true},
+		{Ratio: 20 / (51.0 / 4), HighRisk: true},
+	} {
+		actual := weeks[i].Workload
+		if actual.PreviousDistance != expected.PreviousDistance ||
+			math.Abs(actual.Change-expected.Change) > 1e-9 ||
+			math.Abs(actual.Ratio-expected.Ratio) > 1e-9 ||
+			actual.TooFast != expected.TooFast ||
+			actual.HighRisk != expected.HighRisk {
+			t.Errorf("Week %d: expected %+v, got %+v", i, expected, actual)
+		}
+	}
+}
+
+func TestAnalyzeWorkloadHistory(t *testing.T) {
+	// Only the last week is shown, but the ones before it are still used.
+	history := weekly(10, 10, 10, 10, 10)
+	weeks := history[4:]
+	weeks[0].Workload = Workload{}
+	AnalyzeWorkload(weeks, history)
+	if expected := (Workload{PreviousDistance: 10000, Ratio: 1}); weeks[0].Workload != expected {
+		t.Errorf("Expected %+v, got %+v", expected, weeks[0].Workload)
+	}
+
+	// Nothing to go on.
+	weeks = []WeekSummary{{Date: week1, Distance: 1000}}
+	AnalyzeWorkload(weeks, nil)
+	if weeks[0].Workload != (Workload{}) {
+		t.Errorf("Expected no workload without history, got %+v", weeks[0].Workload)
+	}
+}
+
+func TestFormatWorkload(t *testing.T) {
+	for _, tc := range []struct {
+		w             Workload
+		change, ratio string
+	}{
+		{Workload{}, "", ""},
+		{Workload{PreviousDistance: 1, Change: -0.2, Ratio: 0.8}, "-20%", "0.80"},
+		{Workload{PreviousDistance: 1, Change: 0.5, TooFast: true, Ratio: 1.6, HighRisk: true}, "+50%!", "1.60!"},
+	} {
+		if actual := formatChange(tc.w); actual != tc.change {
+			t.Errorf("formatChange(%+v): expected %q, got %q", tc.w, tc.change, actual)
+		}
+		if actual := formatRatio(tc.w); actual != tc.ratio {
+			t.Errorf("formatRatio(%+v): expected %q, got %q", tc.w, tc.ratio, actual)
+		}
+	}
+}